@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"github.com/bdaler/wallet/pkg/wallet"
+	"log"
+	"os"
+)
+
+func main() {
+	dir := flag.String("dir", "data", "directory with accounts.dump, payments.dump and favorites.dump")
+	archive := flag.String("file", "wallet.backup", "backup archive")
+	restore := flag.Bool("restore", false, "restore the archive into dir instead of creating it")
+	compression := flag.String("compression", "gzip", "compression of a new archive: gzip or zstd")
+	flag.Parse()
+
+	options := wallet.BackupOptions{
+		Compression: wallet.Compression(*compression),
+		Passphrase:  os.Getenv("WALLET_BACKUP_PASSPHRASE"),
+	}
+	var err error
+	if *restore {
+		err = restoreBackup(*archive, *dir, options)
+	} else {
+		err = createBackup(*dir, *archive, options)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func createBackup(dir string, path string, options wallet.BackupOptions) error {
+	s := &wallet.Service{}
+	if err := s.Import(dir); err != nil {
+		return err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err = s.Backup(file, options); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func restoreBackup(path string, dir string, options wallet.BackupOptions) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := file.Close(); closeErr != nil {
+			log.Print(closeErr)
+		}
+	}()
+
+	s := &wallet.Service{}
+	report, err := s.Restore(file, options)
+	if err != nil {
+		return err
+	}
+	log.Print("restored accounts: ", report.Accounts, ", payments: ", report.Payments, ", favorites: ", report.Favorites)
+	return s.Export(dir)
+}
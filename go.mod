@@ -1,5 +1,9 @@
 module github.com/bdaler/wallet
 
-go 1.15
+go 1.18
 
-require github.com/google/uuid v1.1.2
+require (
+	github.com/google/uuid v1.1.2
+	github.com/klauspost/compress v1.11.3
+	golang.org/x/crypto v0.0.0-20201016220609-9e8e0b390897
+)
@@ -1,5 +1,7 @@
 package types
 
+import "time"
+
 type Money int64
 
 type PaymentCategory string
@@ -10,6 +12,16 @@ const (
 	PaymentStatusOK         PaymentStatus = "OK"
 	PaymentStatusFail       PaymentStatus = "FAIL"
 	PaymentStatusInProgress PaymentStatus = "INPROGRESS"
+	PaymentStatusPending    PaymentStatus = "PENDING"
+	PaymentStatusHeld       PaymentStatus = "HELD"
+)
+
+type PaymentDecision string
+
+const (
+	DecisionAllow PaymentDecision = "ALLOW"
+	DecisionHold  PaymentDecision = "HOLD"
+	DecisionDeny  PaymentDecision = "DENY"
 )
 
 const (
@@ -19,30 +31,116 @@ const (
 )
 
 type Payment struct {
-	ID        string
-	AccountID int64
-	Amount    Money
-	Category  PaymentCategory
-	Status    PaymentStatus
+	ID        string          `json:"id"`
+	AccountID int64           `json:"account_id"`
+	Amount    Money           `json:"amount"`
+	Fee       Money           `json:"fee"`
+	Category  PaymentCategory `json:"category"`
+	Status    PaymentStatus   `json:"status"`
+	// Decision and DecisionReason are set by the risk rules, when there
+	// are any.
+	Decision       PaymentDecision `json:"decision,omitempty"`
+	DecisionReason string          `json:"decision_reason,omitempty"`
+}
+
+type Category struct {
+	ID     PaymentCategory
+	Name   string
+	Parent PaymentCategory
+	Active bool
 }
 
 type Phone string
 
 type Account struct {
-	ID      int64
-	Phone   Phone
-	Balance Money
+	ID      int64 `json:"id"`
+	Phone   Phone `json:"phone"`
+	Balance Money `json:"balance"`
 }
 
 type Favorite struct {
+	ID        string          `json:"id"`
+	AccountID int64           `json:"account_id"`
+	Name      string          `json:"name"`
+	Amount    Money           `json:"amount"`
+	Category  PaymentCategory `json:"category"`
+}
+
+type CashbackStatus string
+
+const (
+	CashbackStatusPending  CashbackStatus = "PENDING"
+	CashbackStatusCredited CashbackStatus = "CREDITED"
+	CashbackStatusCanceled CashbackStatus = "CANCELED"
+	CashbackStatusReversed CashbackStatus = "REVERSED"
+)
+
+type CashbackRule struct {
+	ID          string
+	Category    PaymentCategory
+	BasisPoints int64
+	Cap         Money
+	Period      time.Duration
+}
+
+type Cashback struct {
 	ID        string
+	PaymentID string
+	AccountID int64
+	RuleID    string
+	Amount    Money
+	Status    CashbackStatus
+	Created   time.Time
+}
+
+type FeeTier struct {
+	From        Money
+	Fixed       Money
+	BasisPoints int64
+}
+
+type FeeRule struct {
+	ID          string
+	Category    PaymentCategory
+	Fixed       Money
+	BasisPoints int64
+	Tiers       []FeeTier
+	Min         Money
+	Max         Money
+}
+
+type Refund struct {
+	ID        string
+	PaymentID string
+	AccountID int64
+	Amount    Money
+	Fee       Money
+}
+
+type BalanceChangeReason string
+
+const (
+	BalanceChangeOpen     BalanceChangeReason = "OPEN"
+	BalanceChangeDeposit  BalanceChangeReason = "DEPOSIT"
+	BalanceChangePayment  BalanceChangeReason = "PAYMENT"
+	BalanceChangeReject   BalanceChangeReason = "REJECT"
+	BalanceChangeRefund   BalanceChangeReason = "REFUND"
+	BalanceChangeCashback BalanceChangeReason = "CASHBACK"
+	BalanceChangeImport   BalanceChangeReason = "IMPORT"
+)
+
+type BalanceChange struct {
 	AccountID int64
-	Name      string
+	PaymentID string
+	Reason    BalanceChangeReason
 	Amount    Money
-	Category  PaymentCategory
+	Balance   Money
+	Time      time.Time
 }
 
 type Progress struct {
-	Part   int
-	Result Money
+	Part      int
+	Processed int
+	Total     int
+	Result    Money
 }
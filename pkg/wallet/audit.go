@@ -0,0 +1,766 @@
+package wallet
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bdaler/wallet/pkg/types"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrAuditTampered = errors.New("audit log has been tampered with")
+var ErrAuditNotRecorded = errors.New("audit entry not recorded")
+
+type AuditOutcome string
+
+const (
+	AuditSuccess AuditOutcome = "success"
+	AuditFailure AuditOutcome = "failure"
+	AuditDenied  AuditOutcome = "denied"
+)
+
+// AuditEntry records one call. Before and After describe the state the call
+// touched: the balance of the account and the status of the payment, or the
+// number of records for calls that are not about one account. Result is the
+// ID of a record the call created besides its subject. Hash covers
+// the whole entry, PrevHash included, which chains every entry to the ones
+// before it. In a log with a key Hash is an HMAC, so whoever can rewrite the
+// store but does not have the key can not compute a new chain.
+type AuditEntry struct {
+	Seq       int64             `json:"seq"`
+	Time      time.Time         `json:"time"`
+	Actor     string            `json:"actor"`
+	Action    string            `json:"action"`
+	AccountID int64             `json:"account_id,omitempty"`
+	Params    map[string]string `json:"params,omitempty"`
+	Before    map[string]string `json:"before,omitempty"`
+	After     map[string]string `json:"after,omitempty"`
+	Result    string            `json:"result,omitempty"`
+	Outcome   AuditOutcome      `json:"outcome"`
+	Error     string            `json:"error,omitempty"`
+	PrevHash  string            `json:"prev_hash"`
+	Hash      string            `json:"hash"`
+}
+
+func (e AuditEntry) hash(key []byte) string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	if key == nil {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// AuditHead identifies the last entry of a chain. Kept apart from the store,
+// it shows entries cut off the end of the log, which leave a chain that is
+// valid on its own.
+type AuditHead struct {
+	Seq  int64  `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+type AuditStore interface {
+	Append(entry AuditEntry) error
+	Entries() ([]AuditEntry, error)
+}
+
+// AuditLog chains the entries it records and keeps them in its store.
+type AuditLog struct {
+	mu    sync.Mutex
+	store AuditStore
+	key   []byte
+	seq   int64
+	last  string
+}
+
+// NewAuditLog continues the chain of the entries already in store.
+func NewAuditLog(store AuditStore) (*AuditLog, error) {
+	return NewKeyedAuditLog(store, nil)
+}
+
+// NewKeyedAuditLog continues the chain of the entries already in store,
+// hashing the entries with an HMAC under key.
+func NewKeyedAuditLog(store AuditStore, key []byte) (*AuditLog, error) {
+	entries, err := store.Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	l := &AuditLog{store: store}
+	if key != nil {
+		l.key = append([]byte{}, key...)
+	}
+	if len(entries) > 0 {
+		l.seq = entries[len(entries)-1].Seq
+		l.last = entries[len(entries)-1].Hash
+	}
+	return l, nil
+}
+
+// Record numbers entry, links it to the previous entry and stores it.
+func (l *AuditLog) Record(entry AuditEntry) (AuditEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry.Seq = l.seq + 1
+	entry.PrevHash = l.last
+	entry.Hash = entry.hash(l.key)
+	if err := l.store.Append(entry); err != nil {
+		return AuditEntry{}, err
+	}
+	l.seq = entry.Seq
+	l.last = entry.Hash
+	return entry, nil
+}
+
+// Head returns the head of the chain, to be kept where the store can not
+// change it and passed to VerifyHead later.
+func (l *AuditLog) Head() AuditHead {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return AuditHead{Seq: l.seq, Hash: l.last}
+}
+
+// AuditFilter selects entries. Zero fields match every entry; From and To
+// are inclusive.
+type AuditFilter struct {
+	AccountID int64
+	Actor     string
+	Action    string
+	From      time.Time
+	To        time.Time
+}
+
+func (f AuditFilter) match(entry AuditEntry) bool {
+	switch {
+	case f.AccountID != 0 && f.AccountID != entry.AccountID:
+		return false
+	case f.Actor != "" && f.Actor != entry.Actor:
+		return false
+	case f.Action != "" && f.Action != entry.Action:
+		return false
+	case !f.From.IsZero() && entry.Time.Before(f.From):
+		return false
+	case !f.To.IsZero() && entry.Time.After(f.To):
+		return false
+	}
+	return true
+}
+
+func (l *AuditLog) Query(filter AuditFilter) ([]AuditEntry, error) {
+	entries, err := l.store.Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	var found []AuditEntry
+	for _, entry := range entries {
+		if filter.match(entry) {
+			found = append(found, entry)
+		}
+	}
+	return found, nil
+}
+
+// Verify checks the chain of the stored entries.
+func (l *AuditLog) Verify() error {
+	entries, err := l.store.Entries()
+	if err != nil {
+		return err
+	}
+	return verifyAuditEntries(entries, l.key)
+}
+
+// VerifyHead is Verify for a log that must still hold the entry of head, a
+// head returned by Head earlier.
+func (l *AuditLog) VerifyHead(head AuditHead) error {
+	entries, err := l.store.Entries()
+	if err != nil {
+		return err
+	}
+	if err = verifyAuditEntries(entries, l.key); err != nil {
+		return err
+	}
+	if head.Seq > int64(len(entries)) {
+		return fmt.Errorf("%w: entries after %d removed", ErrAuditTampered, len(entries))
+	}
+	if head.Seq > 0 && entries[head.Seq-1].Hash != head.Hash {
+		return fmt.Errorf("%w: entry %d", ErrAuditTampered, head.Seq)
+	}
+	return nil
+}
+
+// VerifyAuditEntries returns ErrAuditTampered for the first entry that was
+// changed, removed or inserted since it was recorded. It checks logs without
+// a key; with the entries alone it can not tell a log cut short, or one
+// rehashed from the changed entry on.
+func VerifyAuditEntries(entries []AuditEntry) error {
+	return verifyAuditEntries(entries, nil)
+}
+
+func verifyAuditEntries(entries []AuditEntry, key []byte) error {
+	previous := ""
+	for i, entry := range entries {
+		if entry.Seq != int64(i+1) || entry.PrevHash != previous || !hmac.Equal([]byte(entry.Hash), []byte(entry.hash(key))) {
+			return fmt.Errorf("%w: entry %d", ErrAuditTampered, i+1)
+		}
+		previous = entry.Hash
+	}
+	return nil
+}
+
+type MemoryAuditStore struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+}
+
+func (m *MemoryAuditStore) Append(entry AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = append(m.entries, entry)
+	return nil
+}
+
+func (m *MemoryAuditStore) Entries() ([]AuditEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]AuditEntry(nil), m.entries...), nil
+}
+
+// FileAuditStore keeps the entries in a JSON Lines file, each synced to disk
+// before Append returns.
+type FileAuditStore struct {
+	mu     sync.Mutex
+	memory MemoryAuditStore
+	file   *os.File
+}
+
+func OpenFileAuditStore(path string) (*FileAuditStore, error) {
+	store := &FileAuditStore{}
+	file, err := openLogFile(path, "audit", func(line []byte) error {
+		entry := AuditEntry{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return err
+		}
+		store.memory.entries = append(store.memory.entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	store.file = file
+	return store, nil
+}
+
+func (f *FileAuditStore) Append(entry AuditEntry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := appendLogLine(f.file, entry); err != nil {
+		return err
+	}
+	return f.memory.Append(entry)
+}
+
+func (f *FileAuditStore) Entries() ([]AuditEntry, error) {
+	return f.memory.Entries()
+}
+
+func (f *FileAuditStore) Close() error {
+	return f.file.Close()
+}
+
+// AuditedService performs the financial and administrative calls of a
+// service on behalf of actor and records each of them, failed ones included,
+// in the audit log. A call whose entry cannot be recorded returns
+// ErrAuditNotRecorded, after its change was made; with a nil log nothing is
+// recorded. Lookups, SetOutbox, SetEventStore and the subscriptions are left
+// out: they neither change the records nor read them out in bulk.
+type AuditedService struct {
+	service *Service
+	log     *AuditLog
+	actor   string
+}
+
+func NewAuditedService(service *Service, audit *AuditLog, actor string) *AuditedService {
+	return &AuditedService{service: service, log: audit, actor: actor}
+}
+
+type auditTarget struct {
+	accountID int64
+	paymentID string
+}
+
+type auditCall struct {
+	entry  AuditEntry
+	target auditTarget
+}
+
+// begin starts the entry of action on target with params given as key and
+// value pairs.
+func (a *AuditedService) begin(action string, target auditTarget, params ...interface{}) *auditCall {
+	call := &auditCall{
+		entry: AuditEntry{
+			Actor:  a.actor,
+			Action: action,
+		},
+		target: target,
+	}
+	if len(params) > 0 {
+		call.entry.Params = make(map[string]string, len(params)/2)
+		for i := 0; i+1 < len(params); i += 2 {
+			call.entry.Params[fmt.Sprint(params[i])] = fmt.Sprint(params[i+1])
+		}
+	}
+	if a.log != nil {
+		call.entry.Before = a.state(call)
+	}
+	return call
+}
+
+// finish records the outcome of call and returns err, the error of the call,
+// joined by the error of recording it.
+func (a *AuditedService) finish(call *auditCall, err error) error {
+	if err != nil {
+		return a.record(call, AuditFailure, err)
+	}
+	return a.record(call, AuditSuccess, nil)
+}
+
+// deny records that action on target was refused with err and returns err.
+func (a *AuditedService) deny(action string, target auditTarget, err error) error {
+	if a.log == nil {
+		return err
+	}
+	return a.record(a.begin(action, target), AuditDenied, err)
+}
+
+func (a *AuditedService) record(call *auditCall, outcome AuditOutcome, err error) error {
+	if a.log == nil {
+		return err
+	}
+
+	entry := call.entry
+	entry.Time = a.service.clock()
+	entry.After = a.state(call)
+	entry.AccountID = call.target.accountID
+	entry.Outcome = outcome
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if _, logErr := a.log.Record(entry); logErr != nil {
+		if err != nil {
+			return fmt.Errorf("%w (%v: %v)", err, ErrAuditNotRecorded, logErr)
+		}
+		return fmt.Errorf("%w: %v", ErrAuditNotRecorded, logErr)
+	}
+	return err
+}
+
+// state describes the account and payment of call, or the whole service when
+// call has no target.
+func (a *AuditedService) state(call *auditCall) map[string]string {
+	s := a.service
+	state := make(map[string]string)
+	if call.target.paymentID != "" {
+		if payment, err := s.FindPaymentByID(call.target.paymentID); err == nil {
+			call.target.accountID = payment.AccountID
+			state["payment_status"] = string(payment.Status)
+		}
+	}
+	if call.target.accountID != 0 {
+		if account, err := s.FindAccountByID(call.target.accountID); err == nil {
+			state["balance"] = strconv.FormatInt(int64(account.Balance), 10)
+		}
+		return state
+	}
+	if call.target.paymentID != "" {
+		return state
+	}
+
+	state["accounts"] = strconv.Itoa(len(s.accounts))
+	state["payments"] = strconv.Itoa(len(s.payments))
+	state["favorites"] = strconv.Itoa(len(s.favorites))
+	return state
+}
+
+func (a *AuditedService) RegisterAccount(ctx context.Context, phone types.Phone) (*types.Account, error) {
+	call := a.begin("RegisterAccount", auditTarget{}, "phone", phone)
+	account, err := a.service.RegisterAccountContext(ctx, phone)
+	if account != nil {
+		call.target.accountID = account.ID
+	}
+	err = a.finish(call, err)
+	return account, err
+}
+
+func (a *AuditedService) AddAccountWithBalance(ctx context.Context, phone types.Phone, balance types.Money) (*types.Account, error) {
+	call := a.begin("AddAccountWithBalance", auditTarget{}, "phone", phone, "balance", balance)
+	account, err := a.service.AddAccountWithBalanceContext(ctx, phone, balance)
+	if account != nil {
+		call.target.accountID = account.ID
+	}
+	err = a.finish(call, err)
+	return account, err
+}
+
+func (a *AuditedService) Deposit(ctx context.Context, accountID int64, amount types.Money) error {
+	call := a.begin("Deposit", auditTarget{accountID: accountID}, "amount", amount)
+	err := a.service.DepositContext(ctx, accountID, amount)
+	err = a.finish(call, err)
+	return err
+}
+
+func (a *AuditedService) Pay(ctx context.Context, accountID int64, amount types.Money, category types.PaymentCategory) (*types.Payment, error) {
+	call := a.begin("Pay", auditTarget{accountID: accountID}, "amount", amount, "category", category)
+	payment, err := a.service.PayContext(ctx, accountID, amount, category)
+	if payment != nil {
+		call.target.paymentID = payment.ID
+	}
+	err = a.finish(call, err)
+	return payment, err
+}
+
+func (a *AuditedService) Reject(ctx context.Context, paymentID string) error {
+	call := a.begin("Reject", auditTarget{paymentID: paymentID}, "payment_id", paymentID)
+	err := a.service.RejectContext(ctx, paymentID)
+	err = a.finish(call, err)
+	return err
+}
+
+func (a *AuditedService) Complete(ctx context.Context, paymentID string) error {
+	call := a.begin("Complete", auditTarget{paymentID: paymentID}, "payment_id", paymentID)
+	err := a.service.CompleteContext(ctx, paymentID)
+	err = a.finish(call, err)
+	return err
+}
+
+// ConfirmPayment leaves the code out of the entry.
+func (a *AuditedService) ConfirmPayment(ctx context.Context, paymentID string, code string) error {
+	call := a.begin("ConfirmPayment", auditTarget{paymentID: paymentID}, "payment_id", paymentID)
+	err := a.service.ConfirmPaymentContext(ctx, paymentID, code)
+	err = a.finish(call, err)
+	return err
+}
+
+func (a *AuditedService) ResendPaymentCode(ctx context.Context, paymentID string) error {
+	call := a.begin("ResendPaymentCode", auditTarget{paymentID: paymentID}, "payment_id", paymentID)
+	err := a.service.ResendPaymentCodeContext(ctx, paymentID)
+	err = a.finish(call, err)
+	return err
+}
+
+func (a *AuditedService) ReviewPayment(ctx context.Context, paymentID string, approve bool) error {
+	call := a.begin("ReviewPayment", auditTarget{paymentID: paymentID}, "payment_id", paymentID, "approve", approve)
+	err := a.service.ReviewPaymentContext(ctx, paymentID, approve)
+	err = a.finish(call, err)
+	return err
+}
+
+func (a *AuditedService) Refund(ctx context.Context, paymentID string, amount types.Money) (*types.Refund, error) {
+	call := a.begin("Refund", auditTarget{paymentID: paymentID}, "payment_id", paymentID, "amount", amount)
+	refund, err := a.service.RefundContext(ctx, paymentID, amount)
+	err = a.finish(call, err)
+	return refund, err
+}
+
+func (a *AuditedService) Repeat(ctx context.Context, paymentID string) (*types.Payment, error) {
+	call := a.begin("Repeat", auditTarget{paymentID: paymentID}, "payment_id", paymentID)
+	payment, err := a.service.RepeatContext(ctx, paymentID)
+	if payment != nil {
+		call.entry.Result = payment.ID
+	}
+	err = a.finish(call, err)
+	return payment, err
+}
+
+func (a *AuditedService) FavoritePayment(ctx context.Context, paymentID string, name string) (*types.Favorite, error) {
+	call := a.begin("FavoritePayment", auditTarget{paymentID: paymentID}, "payment_id", paymentID, "name", name)
+	favorite, err := a.service.FavoritePaymentContext(ctx, paymentID, name)
+	err = a.finish(call, err)
+	return favorite, err
+}
+
+func (a *AuditedService) PayFromFavorite(ctx context.Context, favoriteID string) (*types.Payment, error) {
+	target := auditTarget{}
+	if favorite, err := a.service.FindFavoriteByID(favoriteID); err == nil {
+		target.accountID = favorite.AccountID
+	}
+	call := a.begin("PayFromFavorite", target, "favorite_id", favoriteID)
+	payment, err := a.service.PayFromFavoriteContext(ctx, favoriteID)
+	if payment != nil {
+		call.target.paymentID = payment.ID
+	}
+	err = a.finish(call, err)
+	return payment, err
+}
+
+func (a *AuditedService) ExportAccountHistory(ctx context.Context, accountID int64) ([]types.Payment, error) {
+	call := a.begin("ExportAccountHistory", auditTarget{accountID: accountID})
+	payments, err := a.service.ExportAccountHistoryContext(ctx, accountID)
+	err = a.finish(call, err)
+	return payments, err
+}
+
+func (a *AuditedService) RegisterCategory(ctx context.Context, id types.PaymentCategory, name string, parent types.PaymentCategory) (*types.Category, error) {
+	call := a.begin("RegisterCategory", auditTarget{}, "id", id, "name", name, "parent", parent)
+	category, err := a.service.RegisterCategoryContext(ctx, id, name, parent)
+	err = a.finish(call, err)
+	return category, err
+}
+
+func (a *AuditedService) SetCategoryActive(ctx context.Context, id types.PaymentCategory, active bool) error {
+	call := a.begin("SetCategoryActive", auditTarget{}, "id", id, "active", active)
+	err := a.service.SetCategoryActiveContext(ctx, id, active)
+	err = a.finish(call, err)
+	return err
+}
+
+func (a *AuditedService) SetTOTPSecret(ctx context.Context, accountID int64, secret []byte) error {
+	call := a.begin("SetTOTPSecret", auditTarget{accountID: accountID})
+	err := ctx.Err()
+	if err == nil {
+		err = a.service.SetTOTPSecret(accountID, secret)
+	}
+	err = a.finish(call, err)
+	return err
+}
+
+func (a *AuditedService) SetRiskRules(ctx context.Context, rules ...RiskRule) error {
+	names := make([]string, len(rules))
+	for i, rule := range rules {
+		names[i] = fmt.Sprintf("%T%+v", rule, rule)
+	}
+	call := a.begin("SetRiskRules", auditTarget{}, "rules", strings.Join(names, ", "))
+	err := ctx.Err()
+	if err == nil {
+		a.service.SetRiskRules(rules...)
+	}
+	err = a.finish(call, err)
+	return err
+}
+
+// SetPaymentConfirmation leaves the sender out of the entry.
+func (a *AuditedService) SetPaymentConfirmation(ctx context.Context, options ConfirmationOptions) error {
+	call := a.begin("SetPaymentConfirmation", auditTarget{}, "threshold", options.Threshold, "ttl", options.TTL, "max_attempts", options.MaxAttempts, "lockout", options.Lockout)
+	err := ctx.Err()
+	if err == nil {
+		a.service.SetPaymentConfirmation(options)
+	}
+	err = a.finish(call, err)
+	return err
+}
+
+func (a *AuditedService) AddCashbackRule(ctx context.Context, category types.PaymentCategory, basisPoints int64, cap types.Money, period time.Duration) (*types.CashbackRule, error) {
+	call := a.begin("AddCashbackRule", auditTarget{}, "category", category, "basis_points", basisPoints, "cap", cap, "period", period)
+	rule, err := a.service.AddCashbackRuleContext(ctx, category, basisPoints, cap, period)
+	err = a.finish(call, err)
+	return rule, err
+}
+
+func (a *AuditedService) RemoveCashbackRule(ctx context.Context, ruleID string) error {
+	call := a.begin("RemoveCashbackRule", auditTarget{}, "rule_id", ruleID)
+	err := a.service.RemoveCashbackRuleContext(ctx, ruleID)
+	err = a.finish(call, err)
+	return err
+}
+
+func (a *AuditedService) AddFeeRule(ctx context.Context, rule types.FeeRule) (*types.FeeRule, error) {
+	call := a.begin("AddFeeRule", auditTarget{}, "category", rule.Category, "fixed", rule.Fixed, "basis_points", rule.BasisPoints, "min", rule.Min, "max", rule.Max)
+	added, err := a.service.AddFeeRuleContext(ctx, rule)
+	err = a.finish(call, err)
+	return added, err
+}
+
+func (a *AuditedService) RemoveFeeRule(ctx context.Context, ruleID string) error {
+	call := a.begin("RemoveFeeRule", auditTarget{}, "rule_id", ruleID)
+	err := a.service.RemoveFeeRuleContext(ctx, ruleID)
+	err = a.finish(call, err)
+	return err
+}
+
+func (a *AuditedService) Import(ctx context.Context, dir string, options ImportOptions) (*ImportReport, error) {
+	call := a.begin("Import", auditTarget{}, "dir", dir, "dry_run", options.DryRun, "policy", options.Policy, "conflict", options.Conflict)
+	report, err := a.service.ImportWithOptionsContext(ctx, dir, options)
+	err = a.finish(call, err)
+	return report, err
+}
+
+func (a *AuditedService) ImportAuto(ctx context.Context, path string, options ImportOptions) (*ImportReport, error) {
+	call := a.begin("ImportAuto", auditTarget{}, "path", path, "dry_run", options.DryRun, "policy", options.Policy, "conflict", options.Conflict)
+	report, err := a.service.ImportAutoContext(ctx, path, options)
+	err = a.finish(call, err)
+	return report, err
+}
+
+func (a *AuditedService) ImportFromFile(ctx context.Context, path string, options ImportOptions) (*ImportReport, error) {
+	call := a.begin("ImportFromFile", auditTarget{}, "path", path, "dry_run", options.DryRun, "policy", options.Policy, "conflict", options.Conflict)
+	report, err := a.service.ImportFromFileWithOptionsContext(ctx, path, options)
+	err = a.finish(call, err)
+	return report, err
+}
+
+func (a *AuditedService) ImportJSON(ctx context.Context, r io.Reader, options ImportOptions) (*ImportReport, error) {
+	call := a.begin("ImportJSON", auditTarget{}, "dry_run", options.DryRun, "policy", options.Policy, "conflict", options.Conflict)
+	report, err := a.service.ImportJSONWithOptionsContext(ctx, r, options)
+	err = a.finish(call, err)
+	return report, err
+}
+
+func (a *AuditedService) ImportJSONLines(ctx context.Context, r io.Reader, options ImportOptions) (*ImportReport, error) {
+	call := a.begin("ImportJSONLines", auditTarget{}, "dry_run", options.DryRun, "policy", options.Policy, "conflict", options.Conflict)
+	report, err := a.service.ImportJSONLinesWithOptionsContext(ctx, r, options)
+	err = a.finish(call, err)
+	return report, err
+}
+
+func (a *AuditedService) ImportAccountsCSV(ctx context.Context, r io.Reader, options CSVOptions, importOptions ImportOptions) (*ImportReport, error) {
+	call := a.begin("ImportAccountsCSV", auditTarget{}, "dry_run", importOptions.DryRun, "policy", importOptions.Policy, "conflict", importOptions.Conflict)
+	report, err := a.service.ImportAccountsCSVContext(ctx, r, options, importOptions)
+	err = a.finish(call, err)
+	return report, err
+}
+
+func (a *AuditedService) ImportPaymentsCSV(ctx context.Context, r io.Reader, options CSVOptions, importOptions ImportOptions) (*ImportReport, error) {
+	call := a.begin("ImportPaymentsCSV", auditTarget{}, "dry_run", importOptions.DryRun, "policy", importOptions.Policy, "conflict", importOptions.Conflict)
+	report, err := a.service.ImportPaymentsCSVContext(ctx, r, options, importOptions)
+	err = a.finish(call, err)
+	return report, err
+}
+
+func (a *AuditedService) ImportFavoritesCSV(ctx context.Context, r io.Reader, options CSVOptions, importOptions ImportOptions) (*ImportReport, error) {
+	call := a.begin("ImportFavoritesCSV", auditTarget{}, "dry_run", importOptions.DryRun, "policy", importOptions.Policy, "conflict", importOptions.Conflict)
+	report, err := a.service.ImportFavoritesCSVContext(ctx, r, options, importOptions)
+	err = a.finish(call, err)
+	return report, err
+}
+
+func (a *AuditedService) ImportFrom(ctx context.Context, r io.Reader, options ImportOptions) (*ImportReport, error) {
+	call := a.begin("ImportFrom", auditTarget{}, "dry_run", options.DryRun, "policy", options.Policy, "conflict", options.Conflict)
+	report, err := a.service.ImportFromWithOptionsContext(ctx, r, options)
+	err = a.finish(call, err)
+	return report, err
+}
+
+func (a *AuditedService) Restore(ctx context.Context, r io.Reader, options BackupOptions, importOptions ImportOptions) (*ImportReport, error) {
+	call := a.begin("Restore", auditTarget{}, "encrypted", options.Passphrase != "", "dry_run", importOptions.DryRun, "policy", importOptions.Policy, "conflict", importOptions.Conflict)
+	report, err := a.service.RestoreWithOptionsContext(ctx, r, options, importOptions)
+	err = a.finish(call, err)
+	return report, err
+}
+
+func (a *AuditedService) RestoreChain(ctx context.Context, dir string) (*ImportReport, error) {
+	call := a.begin("RestoreChain", auditTarget{}, "dir", dir)
+	report, err := a.service.RestoreChainContext(ctx, dir)
+	err = a.finish(call, err)
+	return report, err
+}
+
+func (a *AuditedService) Export(ctx context.Context, dir string) error {
+	call := a.begin("Export", auditTarget{}, "dir", dir)
+	err := a.service.ExportContext(ctx, dir)
+	err = a.finish(call, err)
+	return err
+}
+
+func (a *AuditedService) ExportTo(ctx context.Context, w io.Writer) error {
+	call := a.begin("ExportTo", auditTarget{})
+	err := a.service.ExportToContext(ctx, w)
+	err = a.finish(call, err)
+	return err
+}
+
+func (a *AuditedService) ExportToFile(ctx context.Context, path string) error {
+	call := a.begin("ExportToFile", auditTarget{}, "path", path)
+	err := a.service.ExportToFileContext(ctx, path)
+	err = a.finish(call, err)
+	return err
+}
+
+func (a *AuditedService) ExportJSON(ctx context.Context, w io.Writer) error {
+	call := a.begin("ExportJSON", auditTarget{})
+	err := a.service.ExportJSONContext(ctx, w)
+	err = a.finish(call, err)
+	return err
+}
+
+func (a *AuditedService) ExportJSONLines(ctx context.Context, w io.Writer) error {
+	call := a.begin("ExportJSONLines", auditTarget{})
+	err := a.service.ExportJSONLinesContext(ctx, w)
+	err = a.finish(call, err)
+	return err
+}
+
+func (a *AuditedService) ExportAccountsCSV(ctx context.Context, w io.Writer, options CSVOptions) error {
+	call := a.begin("ExportAccountsCSV", auditTarget{}, "columns", options.Columns)
+	err := a.service.ExportAccountsCSVContext(ctx, w, options)
+	err = a.finish(call, err)
+	return err
+}
+
+func (a *AuditedService) ExportPaymentsCSV(ctx context.Context, w io.Writer, options CSVOptions) error {
+	call := a.begin("ExportPaymentsCSV", auditTarget{}, "columns", options.Columns)
+	err := a.service.ExportPaymentsCSVContext(ctx, w, options)
+	err = a.finish(call, err)
+	return err
+}
+
+func (a *AuditedService) ExportFavoritesCSV(ctx context.Context, w io.Writer, options CSVOptions) error {
+	call := a.begin("ExportFavoritesCSV", auditTarget{}, "columns", options.Columns)
+	err := a.service.ExportFavoritesCSVContext(ctx, w, options)
+	err = a.finish(call, err)
+	return err
+}
+
+func (a *AuditedService) ExportAccountHistoryCSV(ctx context.Context, accountID int64, w io.Writer, options CSVOptions) error {
+	call := a.begin("ExportAccountHistoryCSV", auditTarget{accountID: accountID}, "columns", options.Columns)
+	err := a.service.ExportAccountHistoryCSVContext(ctx, accountID, w, options)
+	err = a.finish(call, err)
+	return err
+}
+
+func (a *AuditedService) HistoryToFiles(ctx context.Context, payments []types.Payment, dir string, records int) error {
+	call := a.begin("HistoryToFiles", auditTarget{}, "payments", len(payments), "dir", dir, "records", records)
+	err := a.service.HistoryToFilesContext(ctx, payments, dir, records)
+	err = a.finish(call, err)
+	return err
+}
+
+func (a *AuditedService) HistoryToCSVFiles(ctx context.Context, payments []types.Payment, dir string, records int, options CSVOptions) error {
+	call := a.begin("HistoryToCSVFiles", auditTarget{}, "payments", len(payments), "dir", dir, "records", records, "columns", options.Columns)
+	err := a.service.HistoryToCSVFilesContext(ctx, payments, dir, records, options)
+	err = a.finish(call, err)
+	return err
+}
+
+func (a *AuditedService) ExportFull(ctx context.Context, dir string) (*ChainEntry, error) {
+	call := a.begin("ExportFull", auditTarget{}, "dir", dir)
+	entry, err := a.service.ExportFullContext(ctx, dir)
+	err = a.finish(call, err)
+	return entry, err
+}
+
+func (a *AuditedService) ExportIncremental(ctx context.Context, dir string) (*ChainEntry, error) {
+	call := a.begin("ExportIncremental", auditTarget{}, "dir", dir)
+	entry, err := a.service.ExportIncrementalContext(ctx, dir)
+	err = a.finish(call, err)
+	return entry, err
+}
+
+func (a *AuditedService) Backup(ctx context.Context, w io.Writer, options BackupOptions) error {
+	call := a.begin("Backup", auditTarget{}, "compression", options.Compression, "encrypted", options.Passphrase != "")
+	err := a.service.BackupContext(ctx, w, options)
+	err = a.finish(call, err)
+	return err
+}
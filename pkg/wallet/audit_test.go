@@ -0,0 +1,234 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/bdaler/wallet/pkg/types"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditedService(t *testing.T) {
+	s := newTestService()
+	start := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	s.now = func() time.Time { return now }
+	audit, _ := NewAuditLog(&MemoryAuditStore{})
+	customer := NewAuditedService(s.Service, audit, "customer")
+	operator := NewAuditedService(s.Service, audit, "operator")
+	ctx := context.Background()
+
+	account, _ := customer.AddAccountWithBalance(ctx, "9127660305", 100)
+	now = start.Add(time.Hour)
+	payment, _ := customer.Pay(ctx, account.ID, 30, types.CategoryIt)
+	_, _ = customer.Pay(ctx, account.ID, 1000, types.CategoryIt)
+	now = start.Add(2 * time.Hour)
+	_ = operator.Reject(ctx, payment.ID)
+
+	entries, err := audit.Query(AuditFilter{AccountID: account.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, entry := range entries {
+		actions = append(actions, entry.Action+":"+string(entry.Outcome))
+	}
+	want := []string{"AddAccountWithBalance:success", "Pay:success", "Pay:failure", "Reject:success"}
+	if !reflect.DeepEqual(actions, want) {
+		t.Fatalf("Query() actions = %v, want %v", actions, want)
+	}
+
+	reject := entries[3]
+	if reject.Actor != "operator" || reject.Params["payment_id"] != payment.ID {
+		t.Errorf("Query() reject entry = %+v", reject)
+	}
+	if reject.Before["balance"] != "70" || reject.Before["payment_status"] != string(types.PaymentStatusInProgress) ||
+		reject.After["balance"] != "100" || reject.After["payment_status"] != string(types.PaymentStatusFail) {
+		t.Errorf("Query() reject before = %v, after = %v", reject.Before, reject.After)
+	}
+	if entries[2].Error != ErrNotEnoughBalance.Error() {
+		t.Errorf("Query() failed pay error = %q", entries[2].Error)
+	}
+
+	entries, _ = audit.Query(AuditFilter{Actor: "customer", From: start.Add(30 * time.Minute), To: start.Add(time.Hour)})
+	if len(entries) != 2 {
+		t.Errorf("Query() by actor and time got %d entries, want 2", len(entries))
+	}
+
+	if err = audit.Verify(); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+}
+
+func TestAuditedService_settingsAndFiles(t *testing.T) {
+	s := newTestService()
+	audit, _ := NewAuditLog(&MemoryAuditStore{})
+	admin := NewAuditedService(s.Service, audit, "admin")
+	ctx := context.Background()
+
+	account, _ := admin.AddAccountWithBalance(ctx, "9127660305", 100)
+	payment, _ := admin.Pay(ctx, account.ID, 10, types.CategoryIt)
+	repeated, _ := admin.Repeat(ctx, payment.ID)
+	_ = admin.SetTOTPSecret(ctx, account.ID, []byte("12345678901234567890"))
+	_ = admin.SetRiskRules(ctx, VelocityRule{Window: time.Minute, MaxPayments: 2})
+	_ = admin.SetPaymentConfirmation(ctx, ConfirmationOptions{Threshold: 500})
+	buffer := &bytes.Buffer{}
+	_ = admin.ExportJSON(ctx, buffer)
+	_, _ = admin.ImportJSON(ctx, buffer, ImportOptions{DryRun: true})
+	_ = admin.ExportPaymentsCSV(ctx, &bytes.Buffer{}, CSVOptions{})
+
+	entries, _ := audit.Query(AuditFilter{})
+	var actions []string
+	for _, entry := range entries {
+		actions = append(actions, entry.Action)
+	}
+	want := []string{"AddAccountWithBalance", "Pay", "Repeat", "SetTOTPSecret", "SetRiskRules", "SetPaymentConfirmation", "ExportJSON", "ImportJSON", "ExportPaymentsCSV"}
+	if !reflect.DeepEqual(actions, want) {
+		t.Fatalf("Query() actions = %v, want %v", actions, want)
+	}
+
+	repeat := entries[2]
+	if repeat.Result != repeated.ID || repeat.Params["payment_id"] != payment.ID ||
+		repeat.Before["payment_status"] != repeat.After["payment_status"] || repeat.Before["balance"] != "90" || repeat.After["balance"] != "80" {
+		t.Errorf("Query() repeat entry = %+v", repeat)
+	}
+	for _, value := range entries[3].Params {
+		if strings.Contains(value, "1234567890") {
+			t.Errorf("Query() TOTP entry holds the secret: %+v", entries[3])
+		}
+	}
+	if entries[5].Params["threshold"] != "500" {
+		t.Errorf("Query() confirmation entry = %+v", entries[5])
+	}
+}
+
+func TestAuditLog_Verify_tampered(t *testing.T) {
+	s := newTestService()
+	store := &MemoryAuditStore{}
+	audit, _ := NewAuditLog(store)
+	audited := NewAuditedService(s.Service, audit, "admin")
+	ctx := context.Background()
+	account, _ := audited.AddAccountWithBalance(ctx, "9127660305", 100)
+	_ = audited.Deposit(ctx, account.ID, 50)
+	_ = audited.Deposit(ctx, account.ID, 10)
+
+	entries, _ := store.Entries()
+	tests := []struct {
+		name   string
+		change func(entries []AuditEntry) []AuditEntry
+	}{
+		{"changed", func(entries []AuditEntry) []AuditEntry {
+			entries[1].Params = map[string]string{"amount": "5"}
+			return entries
+		}},
+		{"removed", func(entries []AuditEntry) []AuditEntry {
+			return append(entries[:1], entries[2:]...)
+		}},
+		{"rehashed", func(entries []AuditEntry) []AuditEntry {
+			entries[1].Actor = "someone"
+			entries[1].Hash = entries[1].hash(nil)
+			return entries
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := tt.change(append([]AuditEntry(nil), entries...))
+			if err := VerifyAuditEntries(tampered); !errors.Is(err, ErrAuditTampered) {
+				t.Errorf("VerifyAuditEntries() error = %v, want %v", err, ErrAuditTampered)
+			}
+		})
+	}
+}
+
+func TestAuditLog_VerifyHead(t *testing.T) {
+	s := newTestService()
+	store := &MemoryAuditStore{}
+	audit, _ := NewKeyedAuditLog(store, []byte("secret"))
+	audited := NewAuditedService(s.Service, audit, "admin")
+	ctx := context.Background()
+	account, _ := audited.AddAccountWithBalance(ctx, "9127660305", 100)
+	_ = audited.Deposit(ctx, account.ID, 50)
+	_ = audited.Deposit(ctx, account.ID, 10)
+	head := audit.Head()
+	if err := audit.VerifyHead(head); err != nil {
+		t.Fatalf("VerifyHead() error = %v", err)
+	}
+	entries, _ := store.Entries()
+
+	store.entries = entries[:2]
+	if err := audit.VerifyHead(head); !errors.Is(err, ErrAuditTampered) {
+		t.Errorf("VerifyHead() after truncation error = %v, want %v", err, ErrAuditTampered)
+	}
+
+	rehashed := append([]AuditEntry(nil), entries...)
+	rehashed[1].Params = map[string]string{"amount": "5"}
+	for i := 1; i < len(rehashed); i++ {
+		rehashed[i].PrevHash = rehashed[i-1].Hash
+		rehashed[i].Hash = rehashed[i].hash(nil)
+	}
+	store.entries = rehashed
+	if err := audit.Verify(); !errors.Is(err, ErrAuditTampered) {
+		t.Errorf("Verify() after rehash error = %v, want %v", err, ErrAuditTampered)
+	}
+	if err := VerifyAuditEntries(rehashed); err == nil {
+		t.Errorf("VerifyAuditEntries() of an HMAC chain got no error")
+	}
+}
+
+type failingAuditStore struct {
+	MemoryAuditStore
+}
+
+func (f *failingAuditStore) Append(entry AuditEntry) error {
+	return errors.New("disk full")
+}
+
+func TestAuditedService_recordError(t *testing.T) {
+	s := newTestService()
+	audit, _ := NewAuditLog(&failingAuditStore{})
+	audited := NewAuditedService(s.Service, audit, "admin")
+	ctx := context.Background()
+
+	account, err := audited.RegisterAccount(ctx, "9127660305")
+	if !errors.Is(err, ErrAuditNotRecorded) || account == nil {
+		t.Errorf("RegisterAccount() = %v, %v, want account and %v", account, err, ErrAuditNotRecorded)
+	}
+	err = audited.Deposit(ctx, account.ID, 0)
+	if !errors.Is(err, ErrAmountMustBePositive) || !strings.Contains(err.Error(), ErrAuditNotRecorded.Error()) {
+		t.Errorf("Deposit() error = %v, want %v noting %v", err, ErrAmountMustBePositive, ErrAuditNotRecorded)
+	}
+}
+
+func TestFileAuditStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	store, err := OpenFileAuditStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit, _ := NewAuditLog(store)
+	s := newTestService()
+	_, _ = NewAuditedService(s.Service, audit, "admin").RegisterAccount(context.Background(), "9127660305")
+	_ = store.Close()
+
+	store, err = OpenFileAuditStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	audit, _ = NewAuditLog(store)
+	if err = NewAuditedService(s.Service, audit, "admin").Export(context.Background(), t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, _ := store.Entries()
+	if len(entries) != 2 || entries[1].Before["accounts"] != "1" {
+		t.Errorf("Entries() = %+v", entries)
+	}
+	if err = audit.Verify(); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+}
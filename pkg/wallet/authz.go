@@ -0,0 +1,536 @@
+package wallet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bdaler/wallet/pkg/types"
+	"io"
+	"time"
+)
+
+var ErrPermissionDenied = errors.New("permission denied")
+
+type Role string
+
+const (
+	RoleCustomer Role = "customer"
+	RoleOperator Role = "operator"
+	RoleAdmin    Role = "admin"
+)
+
+// Principal is the caller of an AuthorizedService. AccountID is the account a
+// customer owns.
+type Principal struct {
+	ID        string
+	Role      Role
+	AccountID int64
+}
+
+// PermissionError is returned when Principal may not perform Action on
+// AccountID. It matches ErrPermissionDenied with errors.Is.
+type PermissionError struct {
+	Principal Principal
+	Action    string
+	AccountID int64
+}
+
+func (e *PermissionError) Error() string {
+	if e.AccountID != 0 {
+		return fmt.Sprintf("%v: %s %q can not %s on account %d", ErrPermissionDenied, e.Principal.Role, e.Principal.ID, e.Action, e.AccountID)
+	}
+	return fmt.Sprintf("%v: %s %q can not %s", ErrPermissionDenied, e.Principal.Role, e.Principal.ID, e.Action)
+}
+
+func (e *PermissionError) Unwrap() error {
+	return ErrPermissionDenied
+}
+
+var (
+	anyRole    = []Role{RoleCustomer, RoleOperator, RoleAdmin}
+	staffRoles = []Role{RoleOperator, RoleAdmin}
+	ownerRoles = []Role{RoleCustomer, RoleAdmin}
+	adminRoles = []Role{RoleAdmin}
+)
+
+// policy lists the roles allowed to perform each action. Customers may only
+// act on their own account. Operators can not credit money: a deposit is made
+// by the owner of the account or an admin, and opening balances are set by
+// admins.
+var policy = map[string][]Role{
+	"RegisterAccount":         staffRoles,
+	"AddAccountWithBalance":   adminRoles,
+	"Deposit":                 ownerRoles,
+	"Pay":                     ownerRoles,
+	"Repeat":                  ownerRoles,
+	"FavoritePayment":         ownerRoles,
+	"PayFromFavorite":         ownerRoles,
+	"ConfirmPayment":          ownerRoles,
+	"ResendPaymentCode":       ownerRoles,
+	"Reject":                  staffRoles,
+	"Complete":                staffRoles,
+	"ReviewPayment":           staffRoles,
+	"Refund":                  staffRoles,
+	"FindAccountByID":         anyRole,
+	"FindPaymentByID":         anyRole,
+	"ExportAccountHistory":    anyRole,
+	"ExportAccountHistoryCSV": anyRole,
+	"BalanceAt":               anyRole,
+	"SetTOTPSecret":           adminRoles,
+	"SetRiskRules":            adminRoles,
+	"SetPaymentConfirmation":  adminRoles,
+	"RegisterCategory":        adminRoles,
+	"SetCategoryActive":       adminRoles,
+	"AddCashbackRule":         adminRoles,
+	"RemoveCashbackRule":      adminRoles,
+	"AddFeeRule":              adminRoles,
+	"RemoveFeeRule":           adminRoles,
+	"Import":                  adminRoles,
+	"ImportAuto":              adminRoles,
+	"ImportFrom":              adminRoles,
+	"ImportFromFile":          adminRoles,
+	"ImportJSON":              adminRoles,
+	"ImportJSONLines":         adminRoles,
+	"ImportAccountsCSV":       adminRoles,
+	"ImportPaymentsCSV":       adminRoles,
+	"ImportFavoritesCSV":      adminRoles,
+	"Restore":                 adminRoles,
+	"RestoreChain":            adminRoles,
+	"Export":                  adminRoles,
+	"ExportTo":                adminRoles,
+	"ExportToFile":            adminRoles,
+	"ExportJSON":              adminRoles,
+	"ExportJSONLines":         adminRoles,
+	"ExportAccountsCSV":       adminRoles,
+	"ExportPaymentsCSV":       adminRoles,
+	"ExportFavoritesCSV":      adminRoles,
+	"HistoryToFiles":          adminRoles,
+	"HistoryToCSVFiles":       adminRoles,
+	"ExportFull":              adminRoles,
+	"ExportIncremental":       adminRoles,
+	"Backup":                  adminRoles,
+}
+
+// AuthorizedService performs the calls of a service on behalf of principal
+// after checking them against the policy. With an audit log, the calls and
+// the refusals are recorded with the principal ID as actor.
+// The records it returns are copies, so changing them does not go around
+// the policy.
+type AuthorizedService struct {
+	service   *Service
+	principal Principal
+	audited   *AuditedService
+}
+
+func NewAuthorizedService(service *Service, principal Principal, audit *AuditLog) *AuthorizedService {
+	return &AuthorizedService{
+		service:   service,
+		principal: principal,
+		audited:   NewAuditedService(service, audit, principal.ID),
+	}
+}
+
+// Can reports whether the principal may perform action on accountID, zero
+// for actions that are not about one account.
+func (a *AuthorizedService) Can(action string, accountID int64) bool {
+	for _, role := range policy[action] {
+		if role != a.principal.Role {
+			continue
+		}
+		return role != RoleCustomer || (accountID != 0 && accountID == a.principal.AccountID)
+	}
+	return false
+}
+
+func (a *AuthorizedService) authorize(action string, target auditTarget) error {
+	if a.Can(action, target.accountID) {
+		return nil
+	}
+	err := &PermissionError{Principal: a.principal, Action: action, AccountID: target.accountID}
+	return a.audited.deny(action, target, err)
+}
+
+// detached returns a copy of the record value points to.
+func detached[T any](value *T, err error) (*T, error) {
+	if value == nil {
+		return nil, err
+	}
+	copied := *value
+	return &copied, err
+}
+
+func (a *AuthorizedService) paymentTarget(paymentID string) auditTarget {
+	target := auditTarget{paymentID: paymentID}
+	if payment, err := a.service.FindPaymentByID(paymentID); err == nil {
+		target.accountID = payment.AccountID
+	}
+	return target
+}
+
+func (a *AuthorizedService) RegisterAccount(ctx context.Context, phone types.Phone) (*types.Account, error) {
+	if err := a.authorize("RegisterAccount", auditTarget{}); err != nil {
+		return nil, err
+	}
+	return detached(a.audited.RegisterAccount(ctx, phone))
+}
+
+func (a *AuthorizedService) AddAccountWithBalance(ctx context.Context, phone types.Phone, balance types.Money) (*types.Account, error) {
+	if err := a.authorize("AddAccountWithBalance", auditTarget{}); err != nil {
+		return nil, err
+	}
+	return detached(a.audited.AddAccountWithBalance(ctx, phone, balance))
+}
+
+func (a *AuthorizedService) Deposit(ctx context.Context, accountID int64, amount types.Money) error {
+	if err := a.authorize("Deposit", auditTarget{accountID: accountID}); err != nil {
+		return err
+	}
+	return a.audited.Deposit(ctx, accountID, amount)
+}
+
+func (a *AuthorizedService) Pay(ctx context.Context, accountID int64, amount types.Money, category types.PaymentCategory) (*types.Payment, error) {
+	if err := a.authorize("Pay", auditTarget{accountID: accountID}); err != nil {
+		return nil, err
+	}
+	return detached(a.audited.Pay(ctx, accountID, amount, category))
+}
+
+func (a *AuthorizedService) Repeat(ctx context.Context, paymentID string) (*types.Payment, error) {
+	if err := a.authorize("Repeat", a.paymentTarget(paymentID)); err != nil {
+		return nil, err
+	}
+	return detached(a.audited.Repeat(ctx, paymentID))
+}
+
+func (a *AuthorizedService) FavoritePayment(ctx context.Context, paymentID string, name string) (*types.Favorite, error) {
+	if err := a.authorize("FavoritePayment", a.paymentTarget(paymentID)); err != nil {
+		return nil, err
+	}
+	return detached(a.audited.FavoritePayment(ctx, paymentID, name))
+}
+
+func (a *AuthorizedService) PayFromFavorite(ctx context.Context, favoriteID string) (*types.Payment, error) {
+	target := auditTarget{}
+	if favorite, err := a.service.FindFavoriteByID(favoriteID); err == nil {
+		target.accountID = favorite.AccountID
+	}
+	if err := a.authorize("PayFromFavorite", target); err != nil {
+		return nil, err
+	}
+	return detached(a.audited.PayFromFavorite(ctx, favoriteID))
+}
+
+func (a *AuthorizedService) ConfirmPayment(ctx context.Context, paymentID string, code string) error {
+	if err := a.authorize("ConfirmPayment", a.paymentTarget(paymentID)); err != nil {
+		return err
+	}
+	return a.audited.ConfirmPayment(ctx, paymentID, code)
+}
+
+func (a *AuthorizedService) ResendPaymentCode(ctx context.Context, paymentID string) error {
+	if err := a.authorize("ResendPaymentCode", a.paymentTarget(paymentID)); err != nil {
+		return err
+	}
+	return a.audited.ResendPaymentCode(ctx, paymentID)
+}
+
+func (a *AuthorizedService) Reject(ctx context.Context, paymentID string) error {
+	if err := a.authorize("Reject", a.paymentTarget(paymentID)); err != nil {
+		return err
+	}
+	return a.audited.Reject(ctx, paymentID)
+}
+
+func (a *AuthorizedService) Complete(ctx context.Context, paymentID string) error {
+	if err := a.authorize("Complete", a.paymentTarget(paymentID)); err != nil {
+		return err
+	}
+	return a.audited.Complete(ctx, paymentID)
+}
+
+func (a *AuthorizedService) ReviewPayment(ctx context.Context, paymentID string, approve bool) error {
+	if err := a.authorize("ReviewPayment", a.paymentTarget(paymentID)); err != nil {
+		return err
+	}
+	return a.audited.ReviewPayment(ctx, paymentID, approve)
+}
+
+func (a *AuthorizedService) Refund(ctx context.Context, paymentID string, amount types.Money) (*types.Refund, error) {
+	if err := a.authorize("Refund", a.paymentTarget(paymentID)); err != nil {
+		return nil, err
+	}
+	return detached(a.audited.Refund(ctx, paymentID, amount))
+}
+
+func (a *AuthorizedService) FindAccountByID(ctx context.Context, accountID int64) (*types.Account, error) {
+	if err := a.authorize("FindAccountByID", auditTarget{accountID: accountID}); err != nil {
+		return nil, err
+	}
+	return detached(a.service.FindAccountByIDContext(ctx, accountID))
+}
+
+func (a *AuthorizedService) FindPaymentByID(ctx context.Context, paymentID string) (*types.Payment, error) {
+	if err := a.authorize("FindPaymentByID", a.paymentTarget(paymentID)); err != nil {
+		return nil, err
+	}
+	return detached(a.service.FindPaymentByIDContext(ctx, paymentID))
+}
+
+func (a *AuthorizedService) ExportAccountHistory(ctx context.Context, accountID int64) ([]types.Payment, error) {
+	if err := a.authorize("ExportAccountHistory", auditTarget{accountID: accountID}); err != nil {
+		return nil, err
+	}
+	return a.audited.ExportAccountHistory(ctx, accountID)
+}
+
+func (a *AuthorizedService) BalanceAt(ctx context.Context, accountID int64, t time.Time) (types.Money, error) {
+	if err := a.authorize("BalanceAt", auditTarget{accountID: accountID}); err != nil {
+		return 0, err
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return a.service.BalanceAt(accountID, t)
+}
+
+func (a *AuthorizedService) SetTOTPSecret(ctx context.Context, accountID int64, secret []byte) error {
+	if err := a.authorize("SetTOTPSecret", auditTarget{accountID: accountID}); err != nil {
+		return err
+	}
+	return a.audited.SetTOTPSecret(ctx, accountID, secret)
+}
+
+func (a *AuthorizedService) SetRiskRules(ctx context.Context, rules ...RiskRule) error {
+	if err := a.authorize("SetRiskRules", auditTarget{}); err != nil {
+		return err
+	}
+	return a.audited.SetRiskRules(ctx, rules...)
+}
+
+func (a *AuthorizedService) SetPaymentConfirmation(ctx context.Context, options ConfirmationOptions) error {
+	if err := a.authorize("SetPaymentConfirmation", auditTarget{}); err != nil {
+		return err
+	}
+	return a.audited.SetPaymentConfirmation(ctx, options)
+}
+
+func (a *AuthorizedService) RegisterCategory(ctx context.Context, id types.PaymentCategory, name string, parent types.PaymentCategory) (*types.Category, error) {
+	if err := a.authorize("RegisterCategory", auditTarget{}); err != nil {
+		return nil, err
+	}
+	return detached(a.audited.RegisterCategory(ctx, id, name, parent))
+}
+
+func (a *AuthorizedService) SetCategoryActive(ctx context.Context, id types.PaymentCategory, active bool) error {
+	if err := a.authorize("SetCategoryActive", auditTarget{}); err != nil {
+		return err
+	}
+	return a.audited.SetCategoryActive(ctx, id, active)
+}
+
+func (a *AuthorizedService) AddCashbackRule(ctx context.Context, category types.PaymentCategory, basisPoints int64, cap types.Money, period time.Duration) (*types.CashbackRule, error) {
+	if err := a.authorize("AddCashbackRule", auditTarget{}); err != nil {
+		return nil, err
+	}
+	return detached(a.audited.AddCashbackRule(ctx, category, basisPoints, cap, period))
+}
+
+func (a *AuthorizedService) RemoveCashbackRule(ctx context.Context, ruleID string) error {
+	if err := a.authorize("RemoveCashbackRule", auditTarget{}); err != nil {
+		return err
+	}
+	return a.audited.RemoveCashbackRule(ctx, ruleID)
+}
+
+func (a *AuthorizedService) AddFeeRule(ctx context.Context, rule types.FeeRule) (*types.FeeRule, error) {
+	if err := a.authorize("AddFeeRule", auditTarget{}); err != nil {
+		return nil, err
+	}
+	added, err := detached(a.audited.AddFeeRule(ctx, rule))
+	if added != nil {
+		added.Tiers = append([]types.FeeTier(nil), added.Tiers...)
+	}
+	return added, err
+}
+
+func (a *AuthorizedService) RemoveFeeRule(ctx context.Context, ruleID string) error {
+	if err := a.authorize("RemoveFeeRule", auditTarget{}); err != nil {
+		return err
+	}
+	return a.audited.RemoveFeeRule(ctx, ruleID)
+}
+
+func (a *AuthorizedService) Import(ctx context.Context, dir string, options ImportOptions) (*ImportReport, error) {
+	if err := a.authorize("Import", auditTarget{}); err != nil {
+		return nil, err
+	}
+	return a.audited.Import(ctx, dir, options)
+}
+
+func (a *AuthorizedService) ImportAuto(ctx context.Context, path string, options ImportOptions) (*ImportReport, error) {
+	if err := a.authorize("ImportAuto", auditTarget{}); err != nil {
+		return nil, err
+	}
+	return a.audited.ImportAuto(ctx, path, options)
+}
+
+func (a *AuthorizedService) ImportFromFile(ctx context.Context, path string, options ImportOptions) (*ImportReport, error) {
+	if err := a.authorize("ImportFromFile", auditTarget{}); err != nil {
+		return nil, err
+	}
+	return a.audited.ImportFromFile(ctx, path, options)
+}
+
+func (a *AuthorizedService) ImportJSON(ctx context.Context, r io.Reader, options ImportOptions) (*ImportReport, error) {
+	if err := a.authorize("ImportJSON", auditTarget{}); err != nil {
+		return nil, err
+	}
+	return a.audited.ImportJSON(ctx, r, options)
+}
+
+func (a *AuthorizedService) ImportJSONLines(ctx context.Context, r io.Reader, options ImportOptions) (*ImportReport, error) {
+	if err := a.authorize("ImportJSONLines", auditTarget{}); err != nil {
+		return nil, err
+	}
+	return a.audited.ImportJSONLines(ctx, r, options)
+}
+
+func (a *AuthorizedService) ImportAccountsCSV(ctx context.Context, r io.Reader, options CSVOptions, importOptions ImportOptions) (*ImportReport, error) {
+	if err := a.authorize("ImportAccountsCSV", auditTarget{}); err != nil {
+		return nil, err
+	}
+	return a.audited.ImportAccountsCSV(ctx, r, options, importOptions)
+}
+
+func (a *AuthorizedService) ImportPaymentsCSV(ctx context.Context, r io.Reader, options CSVOptions, importOptions ImportOptions) (*ImportReport, error) {
+	if err := a.authorize("ImportPaymentsCSV", auditTarget{}); err != nil {
+		return nil, err
+	}
+	return a.audited.ImportPaymentsCSV(ctx, r, options, importOptions)
+}
+
+func (a *AuthorizedService) ImportFavoritesCSV(ctx context.Context, r io.Reader, options CSVOptions, importOptions ImportOptions) (*ImportReport, error) {
+	if err := a.authorize("ImportFavoritesCSV", auditTarget{}); err != nil {
+		return nil, err
+	}
+	return a.audited.ImportFavoritesCSV(ctx, r, options, importOptions)
+}
+
+func (a *AuthorizedService) ImportFrom(ctx context.Context, r io.Reader, options ImportOptions) (*ImportReport, error) {
+	if err := a.authorize("ImportFrom", auditTarget{}); err != nil {
+		return nil, err
+	}
+	return a.audited.ImportFrom(ctx, r, options)
+}
+
+func (a *AuthorizedService) Restore(ctx context.Context, r io.Reader, options BackupOptions, importOptions ImportOptions) (*ImportReport, error) {
+	if err := a.authorize("Restore", auditTarget{}); err != nil {
+		return nil, err
+	}
+	return a.audited.Restore(ctx, r, options, importOptions)
+}
+
+func (a *AuthorizedService) RestoreChain(ctx context.Context, dir string) (*ImportReport, error) {
+	if err := a.authorize("RestoreChain", auditTarget{}); err != nil {
+		return nil, err
+	}
+	return a.audited.RestoreChain(ctx, dir)
+}
+
+func (a *AuthorizedService) Export(ctx context.Context, dir string) error {
+	if err := a.authorize("Export", auditTarget{}); err != nil {
+		return err
+	}
+	return a.audited.Export(ctx, dir)
+}
+
+func (a *AuthorizedService) ExportTo(ctx context.Context, w io.Writer) error {
+	if err := a.authorize("ExportTo", auditTarget{}); err != nil {
+		return err
+	}
+	return a.audited.ExportTo(ctx, w)
+}
+
+func (a *AuthorizedService) ExportToFile(ctx context.Context, path string) error {
+	if err := a.authorize("ExportToFile", auditTarget{}); err != nil {
+		return err
+	}
+	return a.audited.ExportToFile(ctx, path)
+}
+
+func (a *AuthorizedService) ExportJSON(ctx context.Context, w io.Writer) error {
+	if err := a.authorize("ExportJSON", auditTarget{}); err != nil {
+		return err
+	}
+	return a.audited.ExportJSON(ctx, w)
+}
+
+func (a *AuthorizedService) ExportJSONLines(ctx context.Context, w io.Writer) error {
+	if err := a.authorize("ExportJSONLines", auditTarget{}); err != nil {
+		return err
+	}
+	return a.audited.ExportJSONLines(ctx, w)
+}
+
+func (a *AuthorizedService) ExportAccountsCSV(ctx context.Context, w io.Writer, options CSVOptions) error {
+	if err := a.authorize("ExportAccountsCSV", auditTarget{}); err != nil {
+		return err
+	}
+	return a.audited.ExportAccountsCSV(ctx, w, options)
+}
+
+func (a *AuthorizedService) ExportPaymentsCSV(ctx context.Context, w io.Writer, options CSVOptions) error {
+	if err := a.authorize("ExportPaymentsCSV", auditTarget{}); err != nil {
+		return err
+	}
+	return a.audited.ExportPaymentsCSV(ctx, w, options)
+}
+
+func (a *AuthorizedService) ExportFavoritesCSV(ctx context.Context, w io.Writer, options CSVOptions) error {
+	if err := a.authorize("ExportFavoritesCSV", auditTarget{}); err != nil {
+		return err
+	}
+	return a.audited.ExportFavoritesCSV(ctx, w, options)
+}
+
+func (a *AuthorizedService) ExportAccountHistoryCSV(ctx context.Context, accountID int64, w io.Writer, options CSVOptions) error {
+	if err := a.authorize("ExportAccountHistoryCSV", auditTarget{accountID: accountID}); err != nil {
+		return err
+	}
+	return a.audited.ExportAccountHistoryCSV(ctx, accountID, w, options)
+}
+
+func (a *AuthorizedService) HistoryToFiles(ctx context.Context, payments []types.Payment, dir string, records int) error {
+	if err := a.authorize("HistoryToFiles", auditTarget{}); err != nil {
+		return err
+	}
+	return a.audited.HistoryToFiles(ctx, payments, dir, records)
+}
+
+func (a *AuthorizedService) HistoryToCSVFiles(ctx context.Context, payments []types.Payment, dir string, records int, options CSVOptions) error {
+	if err := a.authorize("HistoryToCSVFiles", auditTarget{}); err != nil {
+		return err
+	}
+	return a.audited.HistoryToCSVFiles(ctx, payments, dir, records, options)
+}
+
+func (a *AuthorizedService) ExportFull(ctx context.Context, dir string) (*ChainEntry, error) {
+	if err := a.authorize("ExportFull", auditTarget{}); err != nil {
+		return nil, err
+	}
+	return a.audited.ExportFull(ctx, dir)
+}
+
+func (a *AuthorizedService) ExportIncremental(ctx context.Context, dir string) (*ChainEntry, error) {
+	if err := a.authorize("ExportIncremental", auditTarget{}); err != nil {
+		return nil, err
+	}
+	return a.audited.ExportIncremental(ctx, dir)
+}
+
+func (a *AuthorizedService) Backup(ctx context.Context, w io.Writer, options BackupOptions) error {
+	if err := a.authorize("Backup", auditTarget{}); err != nil {
+		return err
+	}
+	return a.audited.Backup(ctx, w, options)
+}
@@ -0,0 +1,141 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/bdaler/wallet/pkg/types"
+	"testing"
+)
+
+func TestAuthorizedService(t *testing.T) {
+	s := newTestService()
+	audit, _ := NewAuditLog(&MemoryAuditStore{})
+	ctx := context.Background()
+	operator := NewAuthorizedService(s.Service, Principal{ID: "op", Role: RoleOperator}, audit)
+	admin := NewAuthorizedService(s.Service, Principal{ID: "root", Role: RoleAdmin}, audit)
+
+	account1, err := admin.AddAccountWithBalance(ctx, "9127660305", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account2, _ := admin.AddAccountWithBalance(ctx, "9127660306", 100)
+	customer := NewAuthorizedService(s.Service, Principal{ID: "alice", Role: RoleCustomer, AccountID: account1.ID}, audit)
+
+	payment, err := customer.Pay(ctx, account1.ID, 30, types.CategoryIt)
+	if err != nil {
+		t.Fatalf("Pay() own account error = %v", err)
+	}
+	other, _ := admin.Pay(ctx, account2.ID, 10, types.CategoryIt)
+
+	tests := []struct {
+		name string
+		call func() error
+		want bool
+	}{
+		{"customer pays from another account", func() error {
+			_, err := customer.Pay(ctx, account2.ID, 10, types.CategoryIt)
+			return err
+		}, false},
+		{"customer reads another payment", func() error {
+			_, err := customer.FindPaymentByID(ctx, other.ID)
+			return err
+		}, false},
+		{"customer reads own history", func() error {
+			_, err := customer.ExportAccountHistory(ctx, account1.ID)
+			return err
+		}, true},
+		{"customer deposits to another account", func() error {
+			return customer.Deposit(ctx, account2.ID, 10)
+		}, false},
+		{"customer rejects", func() error {
+			return customer.Reject(ctx, payment.ID)
+		}, false},
+		{"operator pays", func() error {
+			_, err := operator.Pay(ctx, account1.ID, 10, types.CategoryIt)
+			return err
+		}, false},
+		{"operator deposits", func() error {
+			return operator.Deposit(ctx, account1.ID, 10)
+		}, false},
+		{"operator opens an account with balance", func() error {
+			_, err := operator.AddAccountWithBalance(ctx, "9127660307", 100)
+			return err
+		}, false},
+		{"admin deposits", func() error {
+			return admin.Deposit(ctx, account2.ID, 10)
+		}, true},
+		{"operator exports", func() error {
+			return operator.ExportTo(ctx, &bytes.Buffer{})
+		}, false},
+		{"operator rejects", func() error {
+			return operator.Reject(ctx, payment.ID)
+		}, true},
+		{"admin exports", func() error {
+			return admin.ExportTo(ctx, &bytes.Buffer{})
+		}, true},
+		{"admin imports", func() error {
+			_, err := admin.ImportFrom(ctx, &bytes.Buffer{}, ImportOptions{DryRun: true})
+			return err
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.call()
+			var permissionErr *PermissionError
+			denied := errors.As(err, &permissionErr)
+			if denied == tt.want {
+				t.Errorf("error = %v, allowed = %v", err, tt.want)
+			}
+			if denied && !errors.Is(err, ErrPermissionDenied) {
+				t.Errorf("error = %v, want %v", err, ErrPermissionDenied)
+			}
+		})
+	}
+
+	denied, _ := audit.Query(AuditFilter{Actor: "alice", Action: "Reject"})
+	if len(denied) != 1 || denied[0].Outcome != AuditDenied || denied[0].AccountID != account1.ID {
+		t.Errorf("Query() denied entries = %+v", denied)
+	}
+	if err = audit.Verify(); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+}
+
+func TestAuthorizedService_withoutAudit(t *testing.T) {
+	s := newTestService()
+	account, _ := s.AddAccountWithBalance("9127660305", 100)
+	customer := NewAuthorizedService(s.Service, Principal{ID: "alice", Role: RoleCustomer, AccountID: account.ID}, nil)
+
+	if err := customer.Deposit(context.Background(), account.ID, 10); err != nil {
+		t.Errorf("Deposit() error = %v", err)
+	}
+	if _, err := customer.RegisterAccount(context.Background(), "9127660306"); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("RegisterAccount() error = %v, want %v", err, ErrPermissionDenied)
+	}
+}
+
+func TestAuthorizedService_copies(t *testing.T) {
+	s := newTestService()
+	account, _ := s.AddAccountWithBalance("9127660305", 100)
+	customer := NewAuthorizedService(s.Service, Principal{ID: "alice", Role: RoleCustomer, AccountID: account.ID}, nil)
+	ctx := context.Background()
+
+	found, err := customer.FindAccountByID(ctx, account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found.Balance = 1_000_000_000
+	payment, err := customer.Pay(ctx, account.ID, 10, types.CategoryIt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment.Status = types.PaymentStatusOK
+	paid, _ := customer.FindPaymentByID(ctx, payment.ID)
+	paid.Amount = 1
+
+	stored, _ := s.FindPaymentByID(payment.ID)
+	if account.Balance != 90 || stored.Status != types.PaymentStatusInProgress || stored.Amount != 10 {
+		t.Errorf("changed copies reached the service: balance = %v, payment = %+v", account.Balance, stored)
+	}
+}
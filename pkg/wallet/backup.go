@@ -0,0 +1,359 @@
+package wallet
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/crypto/pbkdf2"
+	"io"
+	"io/ioutil"
+	"log"
+	"time"
+)
+
+var ErrUnsupportedCompression = errors.New("unsupported compression")
+var ErrInvalidBackup = errors.New("invalid backup")
+var ErrBackupChecksum = errors.New("backup checksum mismatch")
+var ErrPassphraseRequired = errors.New("backup is encrypted, passphrase required")
+var ErrBackupDecrypt = errors.New("cannot decrypt backup: wrong passphrase or corrupted data")
+
+type Compression string
+
+const (
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+type BackupOptions struct {
+	Compression Compression
+	Passphrase  string
+}
+
+type BackupManifest struct {
+	Version     int            `json:"version"`
+	Created     time.Time      `json:"created"`
+	Compression Compression    `json:"compression"`
+	Files       []ManifestFile `json:"files"`
+}
+
+const backupManifestName = "manifest.json"
+
+// Encrypted backups start with backupMagic, the PBKDF2 iteration count, the
+// salt and the AES-GCM nonce, followed by the sealed compressed archive.
+const backupMagic = "WLTBAK1\n"
+const backupIterations = 100_000
+const backupSaltSize = 16
+
+// Backup writes all entities as a single compressed archive with an integrity
+// manifest, encrypted with a key derived from options.Passphrase when set.
+func (s *Service) Backup(w io.Writer, options BackupOptions) error {
+	return s.backup(context.Background(), w, options)
+}
+
+func (s *Service) backup(ctx context.Context, w io.Writer, options BackupOptions) error {
+	if options.Compression == "" {
+		options.Compression = CompressionGzip
+	}
+	archive := bytes.Buffer{}
+	compressor, err := newCompressor(&archive, options.Compression)
+	if err != nil {
+		return err
+	}
+
+	created := s.clock()
+	dumps := s.snapshotDumps()
+	writer := tar.NewWriter(compressor)
+	manifest := BackupManifest{
+		Version:     DumpVersion,
+		Created:     created.UTC(),
+		Compression: options.Compression,
+	}
+	for _, dump := range dumps {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		data := bytes.Buffer{}
+		if err := writeDump(&data, dump.entity, created, dump.records); err != nil {
+			return err
+		}
+		if err := writeTarFile(writer, dump.name, data.Bytes(), created); err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data.Bytes())
+		manifest.Files = append(manifest.Files, ManifestFile{
+			Name:    dump.name,
+			Records: len(dump.records),
+			Size:    int64(data.Len()),
+			SHA256:  hex.EncodeToString(sum[:]),
+		})
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = writeTarFile(writer, backupManifestName, data, created); err != nil {
+		return err
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	if err = compressor.Close(); err != nil {
+		return err
+	}
+
+	w = newContextWriter(ctx, w)
+	if options.Passphrase == "" {
+		_, err = archive.WriteTo(w)
+		return err
+	}
+	return encryptBackup(w, archive.Bytes(), options.Passphrase)
+}
+
+func newCompressor(w io.Writer, compression Compression) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedCompression, compression)
+}
+
+// compressionOf tells the compression of a stream from its first bytes, empty
+// for an uncompressed one.
+func compressionOf(head []byte) Compression {
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return CompressionGzip
+	case bytes.HasPrefix(head, zstdMagic):
+		return CompressionZstd
+	}
+	return ""
+}
+
+func newDecompressor(r io.Reader, compression Compression) (io.ReadCloser, error) {
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionZstd:
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnsupportedCompression, compression)
+}
+
+func writeTarFile(writer *tar.Writer, name string, data []byte, modified time.Time) error {
+	err := writer.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: modified,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(data)
+	return err
+}
+
+func (s *Service) Restore(r io.Reader, options BackupOptions) (*ImportReport, error) {
+	return s.RestoreWithOptions(r, options, ImportOptions{})
+}
+
+// RestoreWithOptions verifies every file of the archive against its manifest
+// before any record is imported. An archive with a file its manifest does not
+// list is rejected, and so is a dump with another number of records than the
+// manifest has.
+func (s *Service) RestoreWithOptions(r io.Reader, options BackupOptions, importOptions ImportOptions) (*ImportReport, error) {
+	return s.restore(context.Background(), r, options, importOptions)
+}
+
+func (s *Service) restore(ctx context.Context, r io.Reader, options BackupOptions, importOptions ImportOptions) (*ImportReport, error) {
+	report := &ImportReport{DryRun: importOptions.DryRun}
+
+	data, err := ioutil.ReadAll(newContextReader(ctx, r))
+	if err != nil {
+		return report, err
+	}
+	if bytes.HasPrefix(data, []byte(backupMagic)) {
+		if options.Passphrase == "" {
+			return report, ErrPassphraseRequired
+		}
+		data, err = decryptBackup(data, options.Passphrase)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	files, manifest, err := readBackupArchive(data)
+	if err != nil {
+		return report, err
+	}
+
+	batch := s.newImportBatch(ctx, importOptions)
+	defer batch.rollback()
+	listed := make(map[string]ManifestFile, len(manifest.Files))
+	for _, file := range manifest.Files {
+		content, ok := files[file.Name]
+		if !ok {
+			return report, fmt.Errorf("%w: %s is missing", ErrInvalidBackup, file.Name)
+		}
+		if _, ok = dumpEntities[file.Name]; !ok {
+			return report, fmt.Errorf("%w: unknown file %s", ErrInvalidBackup, file.Name)
+		}
+		if !file.verify(content) {
+			return report, fmt.Errorf("%w: %s", ErrBackupChecksum, file.Name)
+		}
+		listed[file.Name] = file
+	}
+	for name := range files {
+		if _, ok := listed[name]; !ok && name != backupManifestName {
+			return report, fmt.Errorf("%w: %s is not in %s", ErrInvalidBackup, name, backupManifestName)
+		}
+	}
+
+	for _, name := range []string{"accounts.dump", "payments.dump", "favorites.dump"} {
+		file, ok := listed[name]
+		if !ok {
+			continue
+		}
+		records, err := readDump(bytes.NewReader(files[name]), name, dumpEntities[name], importOptions.Policy, batch, report)
+		if err != nil {
+			return report, err
+		}
+		if records != file.Records {
+			return report, fmt.Errorf("%w: %s manifest has %d, read %d", ErrDumpRecordCount, name, file.Records, records)
+		}
+	}
+
+	return report, batch.commit()
+}
+
+func readBackupArchive(data []byte) (map[string][]byte, *BackupManifest, error) {
+	decompressor, err := newDecompressor(bytes.NewReader(data), compressionOf(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	defer func() {
+		if closeErr := decompressor.Close(); closeErr != nil {
+			log.Print(closeErr)
+		}
+	}()
+
+	files := make(map[string][]byte)
+	reader := tar.NewReader(decompressor)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+		}
+		content, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+		}
+		files[header.Name] = content
+	}
+
+	manifest := &BackupManifest{}
+	content, ok := files[backupManifestName]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %s is missing", ErrInvalidBackup, backupManifestName)
+	}
+	if err = json.Unmarshal(content, manifest); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	if manifest.Version < 1 || manifest.Version > DumpVersion {
+		return nil, nil, fmt.Errorf("%w: %d", ErrUnsupportedDumpVersion, manifest.Version)
+	}
+	return files, manifest, nil
+}
+
+func encryptBackup(w io.Writer, plain []byte, passphrase string) error {
+	salt := make([]byte, backupSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	aead, err := backupCipher(passphrase, salt, backupIterations)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return err
+	}
+
+	header := bytes.Buffer{}
+	header.WriteString(backupMagic)
+	_ = binary.Write(&header, binary.BigEndian, uint32(backupIterations))
+	header.Write(salt)
+	header.Write(nonce)
+
+	sealed := aead.Seal(nil, nonce, plain, header.Bytes())
+	if _, err = w.Write(header.Bytes()); err != nil {
+		return err
+	}
+	_, err = w.Write(sealed)
+	return err
+}
+
+func decryptBackup(data []byte, passphrase string) ([]byte, error) {
+	offset := len(backupMagic)
+	if len(data) < offset+4+backupSaltSize {
+		return nil, ErrInvalidBackup
+	}
+	iterations := int(binary.BigEndian.Uint32(data[offset:]))
+	if iterations < 1 || iterations > 100*backupIterations {
+		return nil, ErrInvalidBackup
+	}
+	salt := data[offset+4 : offset+4+backupSaltSize]
+	offset += 4 + backupSaltSize
+
+	aead, err := backupCipher(passphrase, salt, iterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < offset+aead.NonceSize() {
+		return nil, ErrInvalidBackup
+	}
+	nonce := data[offset : offset+aead.NonceSize()]
+	offset += aead.NonceSize()
+
+	plain, err := aead.Open(nil, nonce, data[offset:], data[:offset])
+	if err != nil {
+		return nil, ErrBackupDecrypt
+	}
+	return plain, nil
+}
+
+func backupCipher(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	key := pbkdf2.Key([]byte(passphrase), salt, iterations, 32, sha256.New)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,121 @@
+package wallet
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestService_Backup_restore(t *testing.T) {
+	tests := []struct {
+		name    string
+		options BackupOptions
+	}{
+		{name: "compressed", options: BackupOptions{}},
+		{name: "zstd", options: BackupOptions{Compression: CompressionZstd}},
+		{name: "encrypted", options: BackupOptions{Passphrase: "secret"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newExportTestService()
+			buf := bytes.Buffer{}
+			if err := s.Backup(&buf, tt.options); err != nil {
+				t.Fatal(err)
+			}
+			if tt.options.Passphrase != "" && bytes.Contains(buf.Bytes(), []byte("9127660305")) {
+				t.Error("encrypted backup contains a phone number in cleartext")
+			}
+
+			i := newTestService()
+			if _, err := i.Restore(bytes.NewReader(buf.Bytes()), tt.options); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(s.accounts, i.accounts) ||
+				!reflect.DeepEqual(s.payments, i.payments) ||
+				!reflect.DeepEqual(s.favorites, i.favorites) {
+				t.Error("restored and backed up entities doesn't match")
+			}
+		})
+	}
+}
+
+func TestService_Restore_errors(t *testing.T) {
+	s := newExportTestService()
+	buf := bytes.Buffer{}
+	_ = s.Backup(&buf, BackupOptions{Passphrase: "secret"})
+
+	_, err := newTestService().Restore(bytes.NewReader(buf.Bytes()), BackupOptions{})
+	if err != ErrPassphraseRequired {
+		t.Errorf("Restore() error = %v, want %v", err, ErrPassphraseRequired)
+	}
+
+	_, err = newTestService().Restore(bytes.NewReader(buf.Bytes()), BackupOptions{Passphrase: "wrong"})
+	if err != ErrBackupDecrypt {
+		t.Errorf("Restore() error = %v, want %v", err, ErrBackupDecrypt)
+	}
+
+	err = s.Backup(&buf, BackupOptions{Compression: "lz4"})
+	if !errors.Is(err, ErrUnsupportedCompression) {
+		t.Errorf("Backup() error = %v, want %v", err, ErrUnsupportedCompression)
+	}
+}
+
+// writeBackupArchive writes an unencrypted backup archive of files and of
+// manifest as it is given.
+func writeBackupArchive(t *testing.T, files map[string]string, manifest BackupManifest) []byte {
+	buf := bytes.Buffer{}
+	compressor := gzip.NewWriter(&buf)
+	writer := tar.NewWriter(compressor)
+	data, _ := json.Marshal(manifest)
+	files[backupManifestName] = string(data)
+	for name, content := range files {
+		if err := writeTarFile(writer, name, []byte(content), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := compressor.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestService_Restore_manifest(t *testing.T) {
+	const accounts = "#wallet-dump;version=2;entity=accounts;records=1;created=2020-11-01T00:00:00Z\n1;9127660305;10\n"
+	listed := ManifestFile{Name: "accounts.dump", Records: 1, Size: int64(len(accounts))}
+	checksum := newChecksumWriter()
+	_, _ = checksum.Write([]byte(accounts))
+	listed.SHA256 = checksum.sum()
+	miscounted := listed
+	miscounted.Records = 2
+
+	tests := []struct {
+		name     string
+		manifest BackupManifest
+		want     error
+	}{
+		{name: "unlisted", manifest: BackupManifest{Version: DumpVersion}, want: ErrInvalidBackup},
+		{name: "miscounted", manifest: BackupManifest{Version: DumpVersion, Files: []ManifestFile{miscounted}}, want: ErrDumpRecordCount},
+		{name: "listed", manifest: BackupManifest{Version: DumpVersion, Files: []ManifestFile{listed}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive := writeBackupArchive(t, map[string]string{"accounts.dump": accounts}, tt.manifest)
+			s := newTestService()
+			_, err := s.Restore(bytes.NewReader(archive), BackupOptions{})
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Restore() error = %v, want %v", err, tt.want)
+			}
+			if restored := len(s.accounts); (tt.want == nil) != (restored == 1) {
+				t.Errorf("Restore() accounts = %v", s.accounts)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package wallet
+
+import (
+	"github.com/bdaler/wallet/pkg/types"
+	"sort"
+	"time"
+)
+
+// recordBalance adds the balance change carried by event to the history.
+// Imported accounts start their history with the balance they were imported
+// with, at the time of the import.
+func (s *Service) recordBalance(event Event) {
+	var reason types.BalanceChangeReason
+	switch event.Type {
+	case EventAccountRegistered:
+		reason = types.BalanceChangeOpen
+	case EventDeposited:
+		reason = types.BalanceChangeDeposit
+	case EventPaymentCreated:
+		reason = types.BalanceChangePayment
+	case EventPaymentRejected:
+		reason = types.BalanceChangeReject
+	case EventPaymentRefunded:
+		reason = types.BalanceChangeRefund
+	case EventPaymentCompleted:
+		if event.Amount == 0 {
+			return
+		}
+		reason = types.BalanceChangeCashback
+	case EventAccountImported:
+		reason = types.BalanceChangeImport
+	default:
+		return
+	}
+
+	change := types.BalanceChange{
+		AccountID: event.AccountID,
+		Reason:    reason,
+		Amount:    event.Amount,
+		Balance:   event.Balance,
+		Time:      event.Time,
+	}
+	if event.Payment != nil {
+		change.PaymentID = event.Payment.ID
+	}
+	if reason == types.BalanceChangeImport {
+		previous, _ := s.lastBalance(event.AccountID, event.Time)
+		change.Amount = event.Balance - previous
+	}
+	if s.balances == nil {
+		s.balances = make(map[int64][]types.BalanceChange)
+	}
+	s.balances[event.AccountID] = append(s.balances[event.AccountID], change)
+}
+
+// lastBalance finds the last change of accountID at or before t. Changes are
+// recorded in time order, so it is a binary search.
+func (s *Service) lastBalance(accountID int64, t time.Time) (types.Money, bool) {
+	history := s.balances[accountID]
+	i := sort.Search(len(history), func(i int) bool {
+		return history[i].Time.After(t)
+	})
+	if i == 0 {
+		return 0, false
+	}
+	return history[i-1].Balance, true
+}
+
+// BalanceAt returns the balance accountID had at t. It returns
+// ErrAccountNotFound for an account that did not exist yet. The history is
+// kept in memory; a service with an event store derives it from the stored
+// events again, so it survives restarts.
+func (s *Service) BalanceAt(accountID int64, t time.Time) (types.Money, error) {
+	balance, ok := s.lastBalance(accountID, t)
+	if !ok {
+		return 0, ErrAccountNotFound
+	}
+	return balance, nil
+}
+
+// AccountSnapshotAt returns the accounts that existed at t with the balances
+// they had then.
+func (s *Service) AccountSnapshotAt(t time.Time) []types.Account {
+	var accounts []types.Account
+	for _, account := range s.accounts {
+		balance, ok := s.lastBalance(account.ID, t)
+		if !ok {
+			continue
+		}
+		snapshot := *account
+		snapshot.Balance = balance
+		accounts = append(accounts, snapshot)
+	}
+	return accounts
+}
+
+// BalanceHistory returns the balance changes of accountID, oldest first.
+func (s *Service) BalanceHistory(accountID int64) []types.BalanceChange {
+	return append([]types.BalanceChange(nil), s.balances[accountID]...)
+}
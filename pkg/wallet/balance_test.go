@@ -0,0 +1,131 @@
+package wallet
+
+import (
+	"github.com/bdaler/wallet/pkg/types"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestService_BalanceAt(t *testing.T) {
+	s := newTestService()
+	start := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	s.now = func() time.Time { return now }
+
+	account, _ := s.AddAccountWithBalance("9127660305", 100)
+	now = start.Add(24 * time.Hour)
+	payment, _ := s.Pay(account.ID, 30, types.CategoryIt)
+	now = start.Add(48 * time.Hour)
+	_, _ = s.Refund(payment.ID, 10)
+	now = start.Add(72 * time.Hour)
+	_ = s.Reject(payment.ID)
+	_, _ = s.RegisterAccount("9127660306")
+
+	tests := []struct {
+		at   time.Time
+		want types.Money
+	}{
+		{start, 100},
+		{start.Add(36 * time.Hour), 70},
+		{start.Add(48 * time.Hour), 80},
+		{start.Add(100 * time.Hour), 100},
+	}
+	for _, tt := range tests {
+		got, err := s.BalanceAt(account.ID, tt.at)
+		if err != nil || got != tt.want {
+			t.Errorf("BalanceAt(%v) = %v, %v, want %v", tt.at, got, err, tt.want)
+		}
+	}
+
+	if _, err := s.BalanceAt(account.ID, start.Add(-time.Hour)); err != ErrAccountNotFound {
+		t.Errorf("BalanceAt() before the account error = %v, want %v", err, ErrAccountNotFound)
+	}
+
+	var reasons []types.BalanceChangeReason
+	for _, change := range s.BalanceHistory(account.ID) {
+		reasons = append(reasons, change.Reason)
+	}
+	want := []types.BalanceChangeReason{
+		types.BalanceChangeOpen, types.BalanceChangeDeposit, types.BalanceChangePayment,
+		types.BalanceChangeRefund, types.BalanceChangeReject,
+	}
+	if !reflect.DeepEqual(reasons, want) {
+		t.Errorf("BalanceHistory() reasons = %v, want %v", reasons, want)
+	}
+}
+
+func TestService_AccountSnapshotAt(t *testing.T) {
+	s := newTestService()
+	start := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	s.now = func() time.Time { return now }
+
+	account, _ := s.AddAccountWithBalance("9127660305", 100)
+	now = start.Add(time.Hour)
+	_, _ = s.AddAccountWithBalance("9127660306", 50)
+	_ = s.Deposit(account.ID, 20)
+
+	got := s.AccountSnapshotAt(start.Add(time.Minute))
+	want := []types.Account{{ID: 1, Phone: "9127660305", Balance: 100}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("AccountSnapshotAt() = %v, want %v", got, want)
+	}
+
+	got = s.AccountSnapshotAt(now)
+	want = []types.Account{{ID: 1, Phone: "9127660305", Balance: 120}, {ID: 2, Phone: "9127660306", Balance: 50}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("AccountSnapshotAt() = %v, want %v", got, want)
+	}
+}
+
+func TestService_BalanceAt_import(t *testing.T) {
+	s := newTestService()
+	account, _ := s.AddAccountWithBalance("9127660305", 100)
+	dir := t.TempDir()
+	if err := s.Export(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	imported := newTestService()
+	if err := imported.Import(dir); err != nil {
+		t.Fatal(err)
+	}
+	history := imported.BalanceHistory(account.ID)
+	if len(history) != 1 || history[0].Reason != types.BalanceChangeImport || history[0].Amount != 100 {
+		t.Errorf("BalanceHistory() after import = %+v", history)
+	}
+}
+
+func TestService_BalanceAt_eventStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	store, err := OpenFileEventStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestService()
+	start := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return start }
+	_ = s.SetEventStore(store)
+	account, _ := s.AddAccountWithBalance("9127660305", 100)
+	s.now = func() time.Time { return start.Add(time.Hour) }
+	_ = s.Deposit(account.ID, 20)
+	_ = store.Close()
+
+	store, err = OpenFileEventStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	restarted := newTestService()
+	if err = restarted.SetEventStore(store); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := restarted.BalanceAt(account.ID, start.Add(time.Minute)); err != nil || got != 100 {
+		t.Errorf("BalanceAt() after restart = %v, %v, want 100", got, err)
+	}
+	if history := restarted.BalanceHistory(account.ID); len(history) != 3 {
+		t.Errorf("BalanceHistory() after restart = %+v", history)
+	}
+}
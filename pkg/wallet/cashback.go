@@ -0,0 +1,162 @@
+package wallet
+
+import (
+	"errors"
+	"github.com/bdaler/wallet/pkg/types"
+	"github.com/google/uuid"
+	"time"
+)
+
+var ErrInvalidCashbackRule = errors.New("invalid cashback rule")
+var ErrCashbackRuleNotFound = errors.New("cashback rule not found")
+
+func (s *Service) AddCashbackRule(category types.PaymentCategory, basisPoints int64, cap types.Money, period time.Duration) (*types.CashbackRule, error) {
+	if category == "" || basisPoints <= 0 || basisPoints > 10_000 || cap < 0 || period < 0 {
+		return nil, ErrInvalidCashbackRule
+	}
+
+	if len(s.categories) > 0 {
+		if _, err := s.FindCategoryByID(category); err != nil {
+			return nil, err
+		}
+	}
+
+	rule := &types.CashbackRule{
+		ID:          uuid.New().String(),
+		Category:    category,
+		BasisPoints: basisPoints,
+		Cap:         cap,
+		Period:      period,
+	}
+	snapshot := *rule
+	err := s.emit(Event{Type: EventCashbackRuleAdded, CashbackRule: &snapshot}, func() {
+		s.cashbackRules = append(s.cashbackRules, rule)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+func (s *Service) RemoveCashbackRule(ruleID string) error {
+	for i, rule := range s.cashbackRules {
+		if rule.ID == ruleID {
+			snapshot := *rule
+			return s.emit(Event{Type: EventCashbackRuleRemoved, CashbackRule: &snapshot}, func() {
+				s.cashbackRules = append(s.cashbackRules[:i], s.cashbackRules[i+1:]...)
+			})
+		}
+	}
+	return ErrCashbackRuleNotFound
+}
+
+func (s *Service) CashbacksByAccount(accountID int64) []types.Cashback {
+	var cashbacks []types.Cashback
+	for _, cashback := range s.cashbacks {
+		if cashback.AccountID == accountID {
+			cashbacks = append(cashbacks, *cashback)
+		}
+	}
+	return cashbacks
+}
+
+// findCashbackRule picks the rule of the most specific category, so a rule
+// on a sub-category wins over a rule on its parent.
+func (s *Service) findCashbackRule(category types.PaymentCategory) *types.CashbackRule {
+	for _, id := range s.categoryPath(category) {
+		for _, rule := range s.cashbackRules {
+			if rule.Category == id {
+				return rule
+			}
+		}
+	}
+	return nil
+}
+
+// accruedCashback returns the pending cashback payment earns, or nil.
+func (s *Service) accruedCashback(payment *types.Payment) *types.Cashback {
+	rule := s.findCashbackRule(payment.Category)
+	if rule == nil {
+		return nil
+	}
+
+	now := s.clock()
+	amount := payment.Amount * types.Money(rule.BasisPoints) / 10_000
+	if rule.Cap > 0 {
+		used := types.Money(0)
+		for _, cashback := range s.cashbacks {
+			if cashback.AccountID != payment.AccountID || cashback.RuleID != rule.ID {
+				continue
+			}
+			if cashback.Status != types.CashbackStatusPending && cashback.Status != types.CashbackStatusCredited {
+				continue
+			}
+			if rule.Period > 0 && !cashback.Created.After(now.Add(-rule.Period)) {
+				continue
+			}
+			used += cashback.Amount
+		}
+		if amount > rule.Cap-used {
+			amount = rule.Cap - used
+		}
+	}
+	if amount <= 0 {
+		return nil
+	}
+
+	return &types.Cashback{
+		ID:        uuid.New().String(),
+		PaymentID: payment.ID,
+		AccountID: payment.AccountID,
+		RuleID:    rule.ID,
+		Amount:    amount,
+		Status:    types.CashbackStatusPending,
+		Created:   now,
+	}
+}
+
+// settleCashbacks returns the cashbacks of paymentID that change when the
+// payment completes, credit, or fails, and the change they make to the
+// balance of its account. Nothing changes until they are saved.
+func (s *Service) settleCashbacks(paymentID string, credit bool) ([]types.Cashback, types.Money) {
+	var settled []types.Cashback
+	change := types.Money(0)
+	for _, cashback := range s.cashbacks {
+		if cashback.PaymentID != paymentID {
+			continue
+		}
+		updated := *cashback
+		switch {
+		case credit && cashback.Status == types.CashbackStatusPending:
+			updated.Status = types.CashbackStatusCredited
+			change += cashback.Amount
+		case !credit && cashback.Status == types.CashbackStatusPending:
+			updated.Status = types.CashbackStatusCanceled
+		case !credit && cashback.Status == types.CashbackStatusCredited:
+			updated.Status = types.CashbackStatusReversed
+			change -= cashback.Amount
+		default:
+			continue
+		}
+		settled = append(settled, updated)
+	}
+	return settled, change
+}
+
+// saveCashbacks replaces the cashbacks with the IDs of cashbacks and adds the
+// new ones.
+func (s *Service) saveCashbacks(cashbacks []types.Cashback) {
+	for i := range cashbacks {
+		cashback := cashbacks[i]
+		found := false
+		for _, current := range s.cashbacks {
+			if current.ID == cashback.ID {
+				*current = cashback
+				found = true
+			}
+		}
+		if !found {
+			s.cashbacks = append(s.cashbacks, &cashback)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package wallet
+
+import (
+	"github.com/bdaler/wallet/pkg/types"
+	"testing"
+	"time"
+)
+
+func TestService_Complete_cashback(t *testing.T) {
+	s := newTestService()
+	account, _ := s.AddAccountWithBalance("9127660305", 1_000)
+	_, err := s.AddCashbackRule(types.CategoryFood, 500, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payment, err := s.Pay(account.ID, 200, types.CategoryFood)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Balance != 800 {
+		t.Errorf("balance before complete = %v, want 800", account.Balance)
+	}
+
+	if err = s.Complete(payment.ID); err != nil {
+		t.Fatal(err)
+	}
+	if account.Balance != 810 {
+		t.Errorf("balance after complete = %v, want 810", account.Balance)
+	}
+
+	if err = s.Reject(payment.ID); err != nil {
+		t.Fatal(err)
+	}
+	if account.Balance != 1_000 {
+		t.Errorf("balance after reject = %v, want 1000", account.Balance)
+	}
+
+	cashbacks := s.CashbacksByAccount(account.ID)
+	if len(cashbacks) != 1 || cashbacks[0].Status != types.CashbackStatusReversed {
+		t.Errorf("CashbacksByAccount() got = %v", cashbacks)
+	}
+}
+
+func TestService_Pay_cashbackCap(t *testing.T) {
+	now := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	s := newTestService()
+	s.now = func() time.Time { return now }
+	account, _ := s.AddAccountWithBalance("9127660305", 10_000)
+	_, _ = s.AddCashbackRule(types.CategoryFood, 1_000, 150, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		payment, _ := s.Pay(account.ID, 1_000, types.CategoryFood)
+		_ = s.Complete(payment.ID)
+	}
+	if account.Balance != 7_150 {
+		t.Errorf("balance within period = %v, want 7150", account.Balance)
+	}
+
+	now = now.Add(2 * time.Hour)
+	payment, _ := s.Pay(account.ID, 1_000, types.CategoryFood)
+	_ = s.Complete(payment.ID)
+	if account.Balance != 6_250 {
+		t.Errorf("balance in next period = %v, want 6250", account.Balance)
+	}
+}
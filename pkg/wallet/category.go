@@ -0,0 +1,152 @@
+package wallet
+
+import (
+	"context"
+	"errors"
+	"github.com/bdaler/wallet/pkg/types"
+)
+
+var ErrInvalidCategory = errors.New("invalid category")
+var ErrCategoryRegistered = errors.New("category already registered")
+var ErrCategoryNotFound = errors.New("category not found")
+var ErrCategoryInactive = errors.New("category is not active")
+
+func (s *Service) RegisterCategory(id types.PaymentCategory, name string, parent types.PaymentCategory) (*types.Category, error) {
+	if id == "" || id == parent {
+		return nil, ErrInvalidCategory
+	}
+
+	if _, err := s.FindCategoryByID(id); err == nil {
+		return nil, ErrCategoryRegistered
+	}
+
+	if parent != "" {
+		if _, err := s.FindCategoryByID(parent); err != nil {
+			return nil, err
+		}
+	}
+
+	category := &types.Category{
+		ID:     id,
+		Name:   name,
+		Parent: parent,
+		Active: true,
+	}
+	snapshot := *category
+	err := s.emit(Event{Type: EventCategoryRegistered, Category: &snapshot}, func() {
+		s.categories = append(s.categories, category)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return category, nil
+}
+
+func (s *Service) RegisterDefaultCategories() error {
+	defaults := []types.Category{
+		{ID: types.CategoryFood, Name: "Food"},
+		{ID: types.CategoryIt, Name: "IT"},
+		{ID: types.CategoryShop, Name: "Shop"},
+	}
+	for _, category := range defaults {
+		_, err := s.RegisterCategory(category.ID, category.Name, category.Parent)
+		if err != nil && err != ErrCategoryRegistered {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Service) FindCategoryByID(id types.PaymentCategory) (*types.Category, error) {
+	for _, category := range s.categories {
+		if category.ID == id {
+			return category, nil
+		}
+	}
+	return nil, ErrCategoryNotFound
+}
+
+func (s *Service) SetCategoryActive(id types.PaymentCategory, active bool) error {
+	category, err := s.FindCategoryByID(id)
+	if err != nil {
+		return err
+	}
+
+	updated := *category
+	updated.Active = active
+	return s.emit(Event{Type: EventCategoryUpdated, Category: &updated}, func() {
+		category.Active = active
+	})
+}
+
+func (s *Service) Categories() []types.Category {
+	categories := make([]types.Category, 0, len(s.categories))
+	for _, category := range s.categories {
+		categories = append(categories, *category)
+	}
+	return categories
+}
+
+// checkCategory accepts any category until the first one is registered,
+// so services that never configure the registry keep working as before.
+func (s *Service) checkCategory(id types.PaymentCategory) error {
+	if len(s.categories) == 0 {
+		return nil
+	}
+
+	category, err := s.FindCategoryByID(id)
+	if err != nil {
+		return err
+	}
+
+	for category != nil {
+		if !category.Active {
+			return ErrCategoryInactive
+		}
+		if category.Parent == "" {
+			break
+		}
+		category, err = s.FindCategoryByID(category.Parent)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// categoryPath returns the category itself followed by all of its parents.
+func (s *Service) categoryPath(id types.PaymentCategory) []types.PaymentCategory {
+	path := []types.PaymentCategory{id}
+	for {
+		category, err := s.FindCategoryByID(id)
+		if err != nil || category.Parent == "" {
+			return path
+		}
+		id = category.Parent
+		path = append(path, id)
+	}
+}
+
+func (s *Service) SumPaymentsByCategory() map[types.PaymentCategory]types.Money {
+	totals, _ := s.sumPaymentsByCategory(context.Background())
+	return totals
+}
+
+func (s *Service) sumPaymentsByCategory(ctx context.Context) (map[types.PaymentCategory]types.Money, error) {
+	totals := make(map[types.PaymentCategory]types.Money)
+	for i, payment := range s.payments {
+		if i%queryCheckEvery == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		switch payment.Status {
+		case types.PaymentStatusFail, types.PaymentStatusPending, types.PaymentStatusHeld:
+			continue
+		}
+		for _, id := range s.categoryPath(payment.Category) {
+			totals[id] += payment.Amount
+		}
+	}
+	return totals, nil
+}
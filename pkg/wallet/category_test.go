@@ -0,0 +1,59 @@
+package wallet
+
+import (
+	"github.com/bdaler/wallet/pkg/types"
+	"testing"
+)
+
+func TestService_RegisterCategory(t *testing.T) {
+	s := newTestService()
+	if err := s.RegisterDefaultCategories(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := s.RegisterCategory(types.CategoryFood, "Food", "")
+	if err != ErrCategoryRegistered {
+		t.Errorf("RegisterCategory() error = %v, want %v", err, ErrCategoryRegistered)
+	}
+
+	_, err = s.RegisterCategory("cafe", "Cafe", "unknown")
+	if err != ErrCategoryNotFound {
+		t.Errorf("RegisterCategory() error = %v, want %v", err, ErrCategoryNotFound)
+	}
+
+	category, err := s.RegisterCategory("cafe", "Cafe", types.CategoryFood)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !category.Active || category.Parent != types.CategoryFood {
+		t.Errorf("RegisterCategory() got = %v", category)
+	}
+}
+
+func TestService_Pay_category(t *testing.T) {
+	s := newTestService()
+	account, _ := s.AddAccountWithBalance("9127660305", 100)
+	_ = s.RegisterDefaultCategories()
+	_, _ = s.RegisterCategory("cafe", "Cafe", types.CategoryFood)
+
+	_, err := s.Pay(account.ID, 10, "unknown")
+	if err != ErrCategoryNotFound {
+		t.Errorf("Pay() error = %v, want %v", err, ErrCategoryNotFound)
+	}
+
+	_ = s.SetCategoryActive(types.CategoryFood, false)
+	_, err = s.Pay(account.ID, 10, "cafe")
+	if err != ErrCategoryInactive {
+		t.Errorf("Pay() error = %v, want %v", err, ErrCategoryInactive)
+	}
+
+	_ = s.SetCategoryActive(types.CategoryFood, true)
+	_, _ = s.Pay(account.ID, 10, "cafe")
+	_, _ = s.Pay(account.ID, 20, types.CategoryFood)
+	_, _ = s.Pay(account.ID, 30, types.CategoryIt)
+
+	totals := s.SumPaymentsByCategory()
+	if totals[types.CategoryFood] != 30 || totals["cafe"] != 10 || totals[types.CategoryIt] != 30 {
+		t.Errorf("SumPaymentsByCategory() got = %v", totals)
+	}
+}
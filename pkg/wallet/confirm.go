@@ -0,0 +1,312 @@
+package wallet
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/bdaler/wallet/pkg/types"
+	"math/big"
+	"time"
+)
+
+var ErrPaymentPending = errors.New("payment is pending confirmation")
+var ErrPaymentNotPending = errors.New("payment is not pending confirmation")
+var ErrConfirmationNotFound = errors.New("payment has no confirmation code")
+var ErrInvalidCode = errors.New("invalid confirmation code")
+var ErrCodeExpired = errors.New("confirmation code expired")
+var ErrTooManyAttempts = errors.New("too many confirmation attempts")
+var ErrAccountLocked = errors.New("account is locked")
+var ErrNoCodeSender = errors.New("no confirmation code sender")
+
+const (
+	defaultCodeTTL      = 5 * time.Minute
+	defaultCodeAttempts = 3
+	defaultLockout      = 15 * time.Minute
+	totpStep            = 30 * time.Second
+)
+
+// CodeSender delivers a confirmation code to the owner of accountID.
+type CodeSender interface {
+	SendCode(accountID int64, paymentID string, code string) error
+}
+
+type ConfirmationOptions struct {
+	// Threshold is the amount from which payments need confirmation. Zero
+	// turns confirmation off.
+	Threshold types.Money
+	Sender    CodeSender
+	// TTL is how long a code is valid, 5 minutes when zero.
+	TTL time.Duration
+	// MaxAttempts is the number of wrong codes that fail the payment and
+	// lock the account, 3 when zero.
+	MaxAttempts int
+	// Lockout is how long a locked account can not make or confirm payments
+	// that need confirmation, 15 minutes when zero.
+	Lockout time.Duration
+}
+
+type confirmation struct {
+	paymentID string
+	code      [sha256.Size]byte
+	totp      bool
+	expires   time.Time
+	attempts  int
+}
+
+// SetPaymentConfirmation makes Pay keep payments of at least
+// options.Threshold in PaymentStatusPending until ConfirmPayment is called
+// with the code sent to the account owner, or with a TOTP code for accounts
+// that have a TOTP secret. No money moves while the payment is pending.
+func (s *Service) SetPaymentConfirmation(options ConfirmationOptions) {
+	if options.TTL <= 0 {
+		options.TTL = defaultCodeTTL
+	}
+	if options.MaxAttempts <= 0 {
+		options.MaxAttempts = defaultCodeAttempts
+	}
+	if options.Lockout <= 0 {
+		options.Lockout = defaultLockout
+	}
+	s.confirmation = options
+}
+
+// SetTOTPSecret makes payments of accountID confirmed with TOTP codes
+// computed from secret instead of codes sent by the CodeSender.
+func (s *Service) SetTOTPSecret(accountID int64, secret []byte) error {
+	if _, err := s.FindAccountByID(accountID); err != nil {
+		return err
+	}
+	if s.totpSecrets == nil {
+		s.totpSecrets = make(map[int64][]byte)
+	}
+	s.totpSecrets[accountID] = append([]byte(nil), secret...)
+	return nil
+}
+
+// TOTP returns the six digit RFC 6238 code of secret at t, with 30 second
+// steps and HMAC-SHA1.
+func TOTP(secret []byte, t time.Time) string {
+	return totpCode(secret, totpCounter(t))
+}
+
+func totpCounter(t time.Time) int64 {
+	return t.Unix() / int64(totpStep/time.Second)
+}
+
+func totpCode(secret []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1_000_000)
+}
+
+func (s *Service) locked(accountID int64) bool {
+	until, ok := s.lockouts[accountID]
+	return ok && s.clock().Before(until)
+}
+
+// awaitConfirmation sends the confirmation code of payment and makes it
+// pending. add tells whether payment still has to be added to the service.
+func (s *Service) awaitConfirmation(account *types.Account, payment *types.Payment, add bool) (*types.Payment, error) {
+	if s.locked(account.ID) {
+		return nil, ErrAccountLocked
+	}
+
+	if err := s.sendCode(payment, 0); err != nil {
+		return nil, err
+	}
+	pending := *payment
+	pending.Status = types.PaymentStatusPending
+	err := s.emit(paymentEvent(EventPaymentPending, account, &pending, 0), func() {
+		payment.Status = pending.Status
+		if add {
+			s.payments = append(s.payments, payment)
+		}
+		s.touchPayment(payment.ID)
+	})
+	if err != nil {
+		s.removeConfirmation(payment.ID)
+		return nil, err
+	}
+	return payment, nil
+}
+
+// sendCode replaces the confirmation of payment with a new code. The wrong
+// attempts made so far carry over, so asking for new codes does not give more
+// tries.
+func (s *Service) sendCode(payment *types.Payment, attempts int) error {
+	confirmation := &confirmation{
+		paymentID: payment.ID,
+		expires:   s.clock().Add(s.confirmation.TTL),
+		attempts:  attempts,
+	}
+
+	if _, ok := s.totpSecrets[payment.AccountID]; ok {
+		confirmation.totp = true
+	} else {
+		if s.confirmation.Sender == nil {
+			return ErrNoCodeSender
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+		if err != nil {
+			return err
+		}
+		code := fmt.Sprintf("%06d", n.Int64())
+		if err = s.confirmation.Sender.SendCode(payment.AccountID, payment.ID, code); err != nil {
+			return err
+		}
+		confirmation.code = sha256.Sum256([]byte(code))
+	}
+
+	s.removeConfirmation(payment.ID)
+	s.confirmations = append(s.confirmations, confirmation)
+	return nil
+}
+
+func (s *Service) findConfirmation(paymentID string) *confirmation {
+	for _, confirmation := range s.confirmations {
+		if confirmation.paymentID == paymentID {
+			return confirmation
+		}
+	}
+	return nil
+}
+
+func (s *Service) removeConfirmation(paymentID string) {
+	for i, confirmation := range s.confirmations {
+		if confirmation.paymentID == paymentID {
+			s.confirmations = append(s.confirmations[:i], s.confirmations[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *Service) pendingPayment(paymentID string) (*types.Payment, *types.Account, error) {
+	payment, err := s.FindPaymentByID(paymentID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if payment.Status != types.PaymentStatusPending {
+		return nil, nil, ErrPaymentNotPending
+	}
+
+	account, err := s.FindAccountByID(payment.AccountID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.locked(account.ID) {
+		return nil, nil, ErrAccountLocked
+	}
+	return payment, account, nil
+}
+
+// ConfirmPayment checks code and moves the money of the pending payment, which
+// then goes on as a payment in progress. An expired code fails the payment;
+// so does the last wrong attempt, which also locks the account.
+func (s *Service) ConfirmPayment(paymentID string, code string) error {
+	payment, account, err := s.pendingPayment(paymentID)
+	if err != nil {
+		return err
+	}
+
+	confirmation := s.findConfirmation(paymentID)
+	if confirmation == nil {
+		return ErrConfirmationNotFound
+	}
+
+	now := s.clock()
+	if now.After(confirmation.expires) {
+		if err = s.cancelPayment(account, payment); err != nil {
+			return err
+		}
+		return ErrCodeExpired
+	}
+
+	if !s.checkCode(confirmation, payment.AccountID, code, now) {
+		confirmation.attempts++
+		if confirmation.attempts < s.confirmation.MaxAttempts {
+			return ErrInvalidCode
+		}
+		if s.lockouts == nil {
+			s.lockouts = make(map[int64]time.Time)
+		}
+		s.lockouts[account.ID] = now.Add(s.confirmation.Lockout)
+		if err = s.cancelPayment(account, payment); err != nil {
+			return err
+		}
+		return ErrTooManyAttempts
+	}
+
+	if account.Balance < payment.Amount+payment.Fee {
+		return ErrNotEnoughBalance
+	}
+	if err = s.debit(account, payment, false); err != nil {
+		return err
+	}
+	s.removeConfirmation(paymentID)
+	return nil
+}
+
+// checkCode accepts TOTP codes of one step before or after now. An accepted
+// TOTP code uses up its step and the ones before it for the account, so a
+// code seen by someone else can not be replayed (RFC 6238, section 5.2).
+func (s *Service) checkCode(confirmation *confirmation, accountID int64, code string, now time.Time) bool {
+	if !confirmation.totp {
+		sum := sha256.Sum256([]byte(code))
+		return subtle.ConstantTimeCompare(sum[:], confirmation.code[:]) == 1
+	}
+
+	secret := s.totpSecrets[accountID]
+	last, used := s.totpCounters[accountID]
+	current := totpCounter(now)
+	for _, step := range []int64{current, current - 1, current + 1} {
+		if used && step <= last {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			if s.totpCounters == nil {
+				s.totpCounters = make(map[int64]int64)
+			}
+			s.totpCounters[accountID] = step
+			return true
+		}
+	}
+	return false
+}
+
+// ResendPaymentCode sends a new code for the pending payment and restarts its
+// expiry. It also gives a confirmation code to pending payments that were
+// imported.
+func (s *Service) ResendPaymentCode(paymentID string) error {
+	payment, _, err := s.pendingPayment(paymentID)
+	if err != nil {
+		return err
+	}
+
+	attempts := 0
+	if confirmation := s.findConfirmation(paymentID); confirmation != nil {
+		attempts = confirmation.attempts
+	}
+	return s.sendCode(payment, attempts)
+}
+
+// cancelPayment fails a pending or held payment, which has not moved any
+// money.
+func (s *Service) cancelPayment(account *types.Account, payment *types.Payment) error {
+	canceled := *payment
+	canceled.Status = types.PaymentStatusFail
+	return s.emit(paymentEvent(EventPaymentCanceled, account, &canceled, 0), func() {
+		s.removeConfirmation(payment.ID)
+		payment.Status = canceled.Status
+		s.touchPayment(payment.ID)
+	})
+}
@@ -0,0 +1,175 @@
+package wallet
+
+import (
+	"errors"
+	"github.com/bdaler/wallet/pkg/types"
+	"testing"
+	"time"
+)
+
+type testCodeSender struct {
+	codes map[string]string
+	err   error
+}
+
+func (t *testCodeSender) SendCode(accountID int64, paymentID string, code string) error {
+	if t.err != nil {
+		return t.err
+	}
+	if t.codes == nil {
+		t.codes = make(map[string]string)
+	}
+	t.codes[paymentID] = code
+	return nil
+}
+
+func newConfirmationTest() (*testService, *testCodeSender, *types.Account, *time.Time) {
+	s := newTestService()
+	now := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	sender := &testCodeSender{}
+	s.SetPaymentConfirmation(ConfirmationOptions{Threshold: 100, Sender: sender})
+	account, _ := s.AddAccountWithBalance("9127660305", 500)
+	return s, sender, account, &now
+}
+
+func TestService_ConfirmPayment(t *testing.T) {
+	s, sender, account, _ := newConfirmationTest()
+
+	small, _ := s.Pay(account.ID, 50, types.CategoryIt)
+	if small.Status != types.PaymentStatusInProgress {
+		t.Errorf("Pay() below threshold status = %v", small.Status)
+	}
+
+	payment, err := s.Pay(account.ID, 200, types.CategoryIt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.Status != types.PaymentStatusPending || account.Balance != 450 {
+		t.Errorf("Pay() status = %v, balance = %v, want pending and 450", payment.Status, account.Balance)
+	}
+	if err = s.Complete(payment.ID); err != ErrPaymentNotInProgress {
+		t.Errorf("Complete() pending error = %v, want %v", err, ErrPaymentNotInProgress)
+	}
+
+	if err = s.ConfirmPayment(payment.ID, "wrong"); err != ErrInvalidCode {
+		t.Errorf("ConfirmPayment() wrong code error = %v, want %v", err, ErrInvalidCode)
+	}
+	if err = s.ConfirmPayment(payment.ID, sender.codes[payment.ID]); err != nil {
+		t.Fatalf("ConfirmPayment() error = %v", err)
+	}
+	if payment.Status != types.PaymentStatusInProgress || account.Balance != 250 {
+		t.Errorf("ConfirmPayment() status = %v, balance = %v, want in progress and 250", payment.Status, account.Balance)
+	}
+	if err = s.ConfirmPayment(payment.ID, sender.codes[payment.ID]); err != ErrPaymentNotPending {
+		t.Errorf("ConfirmPayment() twice error = %v, want %v", err, ErrPaymentNotPending)
+	}
+}
+
+func TestService_ConfirmPayment_expired(t *testing.T) {
+	s, sender, account, now := newConfirmationTest()
+	payment, _ := s.Pay(account.ID, 200, types.CategoryIt)
+
+	*now = now.Add(10 * time.Minute)
+	if err := s.ConfirmPayment(payment.ID, sender.codes[payment.ID]); err != ErrCodeExpired {
+		t.Errorf("ConfirmPayment() error = %v, want %v", err, ErrCodeExpired)
+	}
+	if payment.Status != types.PaymentStatusFail || account.Balance != 500 {
+		t.Errorf("ConfirmPayment() status = %v, balance = %v", payment.Status, account.Balance)
+	}
+}
+
+func TestService_ConfirmPayment_lockout(t *testing.T) {
+	s, sender, account, now := newConfirmationTest()
+	payment, _ := s.Pay(account.ID, 200, types.CategoryIt)
+
+	_ = s.ConfirmPayment(payment.ID, "1")
+	if err := s.ResendPaymentCode(payment.ID); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.ConfirmPayment(payment.ID, "2")
+	if err := s.ConfirmPayment(payment.ID, "3"); err != ErrTooManyAttempts {
+		t.Errorf("ConfirmPayment() error = %v, want %v", err, ErrTooManyAttempts)
+	}
+	if payment.Status != types.PaymentStatusFail {
+		t.Errorf("ConfirmPayment() status = %v, want %v", payment.Status, types.PaymentStatusFail)
+	}
+
+	if _, err := s.Pay(account.ID, 200, types.CategoryIt); err != ErrAccountLocked {
+		t.Errorf("Pay() locked error = %v, want %v", err, ErrAccountLocked)
+	}
+	if _, err := s.Pay(account.ID, 50, types.CategoryIt); err != nil {
+		t.Errorf("Pay() below threshold while locked error = %v", err)
+	}
+
+	*now = now.Add(time.Hour)
+	next, err := s.Pay(account.ID, 200, types.CategoryIt)
+	if err != nil {
+		t.Fatalf("Pay() after lockout error = %v", err)
+	}
+	if err = s.ConfirmPayment(next.ID, sender.codes[next.ID]); err != nil {
+		t.Errorf("ConfirmPayment() after lockout error = %v", err)
+	}
+}
+
+func TestService_ConfirmPayment_totp(t *testing.T) {
+	s, _, account, now := newConfirmationTest()
+	secret := []byte("12345678901234567890")
+	if err := s.SetTOTPSecret(account.ID, secret); err != nil {
+		t.Fatal(err)
+	}
+
+	payment, _ := s.Pay(account.ID, 200, types.CategoryIt)
+	if err := s.ConfirmPayment(payment.ID, TOTP(secret, now.Add(-time.Minute))); err != ErrInvalidCode {
+		t.Errorf("ConfirmPayment() stale code error = %v, want %v", err, ErrInvalidCode)
+	}
+	if err := s.ConfirmPayment(payment.ID, TOTP(secret, *now)); err != nil {
+		t.Errorf("ConfirmPayment() error = %v", err)
+	}
+
+	replayed, _ := s.Pay(account.ID, 200, types.CategoryIt)
+	if err := s.ConfirmPayment(replayed.ID, TOTP(secret, *now)); err != ErrInvalidCode {
+		t.Errorf("ConfirmPayment() replayed code error = %v, want %v", err, ErrInvalidCode)
+	}
+	if err := s.ConfirmPayment(replayed.ID, TOTP(secret, now.Add(-totpStep))); err != ErrInvalidCode {
+		t.Errorf("ConfirmPayment() code of an earlier step error = %v, want %v", err, ErrInvalidCode)
+	}
+	if err := s.ConfirmPayment(replayed.ID, TOTP(secret, now.Add(totpStep))); err != nil {
+		t.Errorf("ConfirmPayment() code of the next step error = %v", err)
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238 test vector for SHA1, truncated to six digits.
+	secret := []byte("12345678901234567890")
+	if got := TOTP(secret, time.Unix(59, 0)); got != "287082" {
+		t.Errorf("TOTP() = %v, want 287082", got)
+	}
+}
+
+func TestService_Reject_pending(t *testing.T) {
+	s, _, account, _ := newConfirmationTest()
+	payment, _ := s.Pay(account.ID, 200, types.CategoryIt)
+
+	if _, err := s.Refund(payment.ID, 10); err != ErrPaymentPending {
+		t.Errorf("Refund() error = %v, want %v", err, ErrPaymentPending)
+	}
+	if err := s.Reject(payment.ID); err != nil {
+		t.Fatal(err)
+	}
+	if payment.Status != types.PaymentStatusFail || account.Balance != 500 {
+		t.Errorf("Reject() status = %v, balance = %v", payment.Status, account.Balance)
+	}
+}
+
+func TestService_Pay_senderFails(t *testing.T) {
+	s, sender, account, _ := newConfirmationTest()
+	sender.err = errors.New("sms gateway down")
+
+	if _, err := s.Pay(account.ID, 200, types.CategoryIt); err != sender.err {
+		t.Errorf("Pay() error = %v, want %v", err, sender.err)
+	}
+	if len(s.payments) != 0 {
+		t.Errorf("Pay() kept %d payments", len(s.payments))
+	}
+}
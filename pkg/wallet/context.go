@@ -0,0 +1,518 @@
+package wallet
+
+import (
+	"context"
+	"github.com/bdaler/wallet/pkg/types"
+	"io"
+	"time"
+)
+
+// contextReader fails reads with ctx.Err() once ctx is done, so that any
+// parser reading from it stops at its next read.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func newContextReader(ctx context.Context, r io.Reader) io.Reader {
+	if ctx == context.Background() {
+		return r
+	}
+	return &contextReader{ctx: ctx, r: r}
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func newContextWriter(ctx context.Context, w io.Writer) io.Writer {
+	if ctx == context.Background() {
+		return w
+	}
+	return &contextWriter{ctx: ctx, w: w}
+}
+
+func (c *contextWriter) Write(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.w.Write(p)
+}
+
+// contextErr replaces err with ctx.Err() when the call failed because ctx is
+// done, whatever wrapped the error on its way up.
+func contextErr(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// The XContext methods below are the context-aware variants of the service
+// methods. Calls that only touch memory check ctx before they start and are
+// never interrupted halfway; long queries, imports and exports also check it
+// in their loops and I/O. All of them return ctx.Err() once ctx is done.
+
+func (s *Service) RegisterAccountContext(ctx context.Context, phone types.Phone) (*types.Account, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.RegisterAccount(phone)
+}
+
+func (s *Service) DepositContext(ctx context.Context, accountID int64, amount types.Money) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Deposit(accountID, amount)
+}
+
+func (s *Service) PayContext(ctx context.Context, accountID int64, amount types.Money, category types.PaymentCategory) (*types.Payment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Pay(accountID, amount, category)
+}
+
+func (s *Service) FindAccountByIDContext(ctx context.Context, accountID int64) (*types.Account, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.FindAccountByID(accountID)
+}
+
+func (s *Service) FindPaymentByIDContext(ctx context.Context, paymentID string) (*types.Payment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.FindPaymentByID(paymentID)
+}
+
+func (s *Service) RejectContext(ctx context.Context, paymentID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Reject(paymentID)
+}
+
+func (s *Service) CompleteContext(ctx context.Context, paymentID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Complete(paymentID)
+}
+
+func (s *Service) ConfirmPaymentContext(ctx context.Context, paymentID string, code string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.ConfirmPayment(paymentID, code)
+}
+
+func (s *Service) ResendPaymentCodeContext(ctx context.Context, paymentID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.ResendPaymentCode(paymentID)
+}
+
+func (s *Service) ReviewPaymentContext(ctx context.Context, paymentID string, approve bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.ReviewPayment(paymentID, approve)
+}
+
+func (s *Service) AddAccountWithBalanceContext(ctx context.Context, phone types.Phone, balance types.Money) (*types.Account, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.AddAccountWithBalance(phone, balance)
+}
+
+func (s *Service) RepeatContext(ctx context.Context, paymentID string) (*types.Payment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Repeat(paymentID)
+}
+
+func (s *Service) FavoritePaymentContext(ctx context.Context, paymentID string, name string) (*types.Favorite, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.FavoritePayment(paymentID, name)
+}
+
+func (s *Service) PayFromFavoriteContext(ctx context.Context, favoriteID string) (*types.Payment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.PayFromFavorite(favoriteID)
+}
+
+func (s *Service) FindFavoriteByIDContext(ctx context.Context, favoriteID string) (*types.Favorite, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.FindFavoriteByID(favoriteID)
+}
+
+func (s *Service) ExportToFileContext(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return contextErr(ctx, s.exportToFile(ctx, path))
+}
+
+func (s *Service) ImportFromFileContext(ctx context.Context, path string) error {
+	_, err := s.ImportFromFileWithOptionsContext(ctx, path, ImportOptions{})
+	return err
+}
+
+func (s *Service) ImportFromFileWithOptionsContext(ctx context.Context, path string, options ImportOptions) (*ImportReport, error) {
+	if err := ctx.Err(); err != nil {
+		return &ImportReport{DryRun: options.DryRun}, err
+	}
+	report, err := s.importFromFile(ctx, path, options)
+	return report, contextErr(ctx, err)
+}
+
+func (s *Service) ExportContext(ctx context.Context, dir string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return contextErr(ctx, s.export(ctx, dir))
+}
+
+func (s *Service) ExportAccountHistoryContext(ctx context.Context, accountID int64) ([]types.Payment, error) {
+	payments, err := s.SelectPayments(ctx, QueryOptions{Workers: 1}, func(payment types.Payment) bool {
+		return payment.AccountID == accountID
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(payments) <= 0 {
+		return nil, ErrAccountNotFound
+	}
+	return payments, nil
+}
+
+func (s *Service) SumPaymentsContext(ctx context.Context, goroutines int) (types.Money, error) {
+	return s.SumPaymentsWithOptions(ctx, QueryOptions{Workers: goroutines})
+}
+
+func (s *Service) FilterPaymentsContext(ctx context.Context, accountID int64, goroutines int) ([]types.Payment, error) {
+	account, err := s.FindAccountByIDContext(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.FilterPaymentsByFnContext(ctx, func(payment types.Payment) bool {
+		return payment.AccountID == account.ID
+	}, goroutines)
+}
+
+func (s *Service) FilterPaymentsByFnContext(ctx context.Context, filter func(payment types.Payment) bool, goroutines int) ([]types.Payment, error) {
+	return s.SelectPayments(ctx, QueryOptions{Workers: goroutines}, filter)
+}
+
+// SumPaymentsWithProgressContext is SumPaymentsWithProgress that stops, and
+// closes the channel, once ctx is done, even if nobody reads the updates.
+func (s *Service) SumPaymentsWithProgressContext(ctx context.Context) <-chan types.Progress {
+	ch := make(chan types.Progress)
+	go func() {
+		defer close(ch)
+		_, _ = s.SumPaymentsWithOptions(ctx, QueryOptions{
+			Progress: func(progress types.Progress) {
+				select {
+				case ch <- progress:
+				case <-ctx.Done():
+				}
+			},
+		})
+	}()
+	return ch
+}
+
+func (s *Service) ExportToContext(ctx context.Context, w io.Writer) error {
+	return contextErr(ctx, s.ExportToWithProgress(ctx, w, nil))
+}
+
+func (s *Service) ImportFromContext(ctx context.Context, r io.Reader) error {
+	_, err := s.ImportFromWithOptionsContext(ctx, r, ImportOptions{})
+	return err
+}
+
+func (s *Service) ImportFromWithOptionsContext(ctx context.Context, r io.Reader, options ImportOptions) (*ImportReport, error) {
+	return s.ImportFromWithProgress(ctx, r, options)
+}
+
+func (s *Service) ImportContext(ctx context.Context, dir string) error {
+	_, err := s.ImportWithOptionsContext(ctx, dir, ImportOptions{})
+	return err
+}
+
+func (s *Service) ImportWithOptionsContext(ctx context.Context, dir string, options ImportOptions) (*ImportReport, error) {
+	if err := ctx.Err(); err != nil {
+		return &ImportReport{DryRun: options.DryRun}, err
+	}
+	report, err := s.importDir(ctx, dir, options)
+	return report, contextErr(ctx, err)
+}
+
+func (s *Service) ImportAutoContext(ctx context.Context, path string, options ImportOptions) (*ImportReport, error) {
+	if err := ctx.Err(); err != nil {
+		return &ImportReport{DryRun: options.DryRun}, err
+	}
+	report, err := s.importAuto(ctx, path, options)
+	return report, contextErr(ctx, err)
+}
+
+func (s *Service) ExportJSONContext(ctx context.Context, w io.Writer) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return contextErr(ctx, s.ExportJSON(newContextWriter(ctx, w)))
+}
+
+func (s *Service) ImportJSONContext(ctx context.Context, r io.Reader) error {
+	_, err := s.ImportJSONWithOptionsContext(ctx, r, ImportOptions{})
+	return err
+}
+
+func (s *Service) ImportJSONWithOptionsContext(ctx context.Context, r io.Reader, options ImportOptions) (*ImportReport, error) {
+	if err := ctx.Err(); err != nil {
+		return &ImportReport{DryRun: options.DryRun}, err
+	}
+	report, err := s.importJSON(ctx, r, options)
+	return report, contextErr(ctx, err)
+}
+
+func (s *Service) ExportJSONLinesContext(ctx context.Context, w io.Writer) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return contextErr(ctx, s.ExportJSONLines(newContextWriter(ctx, w)))
+}
+
+func (s *Service) ImportJSONLinesContext(ctx context.Context, r io.Reader) error {
+	_, err := s.ImportJSONLinesWithOptionsContext(ctx, r, ImportOptions{})
+	return err
+}
+
+func (s *Service) ImportJSONLinesWithOptionsContext(ctx context.Context, r io.Reader, options ImportOptions) (*ImportReport, error) {
+	if err := ctx.Err(); err != nil {
+		return &ImportReport{DryRun: options.DryRun}, err
+	}
+	report, err := s.importJSONLines(ctx, r, options)
+	return report, contextErr(ctx, err)
+}
+
+func (s *Service) ExportAccountsCSVContext(ctx context.Context, w io.Writer, options CSVOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return contextErr(ctx, s.ExportAccountsCSV(newContextWriter(ctx, w), options))
+}
+
+func (s *Service) ExportPaymentsCSVContext(ctx context.Context, w io.Writer, options CSVOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return contextErr(ctx, s.ExportPaymentsCSV(newContextWriter(ctx, w), options))
+}
+
+func (s *Service) ExportFavoritesCSVContext(ctx context.Context, w io.Writer, options CSVOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return contextErr(ctx, s.ExportFavoritesCSV(newContextWriter(ctx, w), options))
+}
+
+func (s *Service) ExportAccountHistoryCSVContext(ctx context.Context, accountID int64, w io.Writer, options CSVOptions) error {
+	payments, err := s.ExportAccountHistoryContext(ctx, accountID)
+	if err != nil {
+		return err
+	}
+	return contextErr(ctx, WritePaymentsCSV(newContextWriter(ctx, w), payments, options))
+}
+
+func (s *Service) HistoryToCSVFilesContext(ctx context.Context, payments []types.Payment, dir string, records int, options CSVOptions) error {
+	return contextErr(ctx, s.historyToCSVFiles(ctx, payments, dir, records, options))
+}
+
+func (s *Service) ImportAccountsCSVContext(ctx context.Context, r io.Reader, options CSVOptions, importOptions ImportOptions) (*ImportReport, error) {
+	report, err := s.importCSV(ctx, r, entityAccounts, options, importOptions)
+	return report, contextErr(ctx, err)
+}
+
+func (s *Service) ImportPaymentsCSVContext(ctx context.Context, r io.Reader, options CSVOptions, importOptions ImportOptions) (*ImportReport, error) {
+	report, err := s.importCSV(ctx, r, entityPayments, options, importOptions)
+	return report, contextErr(ctx, err)
+}
+
+func (s *Service) ImportFavoritesCSVContext(ctx context.Context, r io.Reader, options CSVOptions, importOptions ImportOptions) (*ImportReport, error) {
+	report, err := s.importCSV(ctx, r, entityFavorites, options, importOptions)
+	return report, contextErr(ctx, err)
+}
+
+func (s *Service) HistoryToFilesContext(ctx context.Context, payments []types.Payment, dir string, records int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return contextErr(ctx, s.historyToFiles(ctx, payments, dir, records))
+}
+
+func (s *Service) BackupContext(ctx context.Context, w io.Writer, options BackupOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return contextErr(ctx, s.backup(ctx, w, options))
+}
+
+func (s *Service) RestoreContext(ctx context.Context, r io.Reader, options BackupOptions) (*ImportReport, error) {
+	return s.RestoreWithOptionsContext(ctx, r, options, ImportOptions{})
+}
+
+func (s *Service) RestoreWithOptionsContext(ctx context.Context, r io.Reader, options BackupOptions, importOptions ImportOptions) (*ImportReport, error) {
+	if err := ctx.Err(); err != nil {
+		return &ImportReport{DryRun: importOptions.DryRun}, err
+	}
+	report, err := s.restore(ctx, r, options, importOptions)
+	return report, contextErr(ctx, err)
+}
+
+func (s *Service) SequenceContext(ctx context.Context) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.Sequence(), nil
+}
+
+func (s *Service) ExportFullContext(ctx context.Context, dir string) (*ChainEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	entry, err := s.exportFull(ctx, dir)
+	return entry, contextErr(ctx, err)
+}
+
+func (s *Service) ExportIncrementalContext(ctx context.Context, dir string) (*ChainEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	entry, err := s.exportIncremental(ctx, dir)
+	return entry, contextErr(ctx, err)
+}
+
+func (s *Service) RestoreChainContext(ctx context.Context, dir string) (*ImportReport, error) {
+	if err := ctx.Err(); err != nil {
+		return &ImportReport{}, err
+	}
+	report, err := s.importChain(ctx, dir, ImportOptions{})
+	return report, contextErr(ctx, err)
+}
+
+func (s *Service) RegisterCategoryContext(ctx context.Context, id types.PaymentCategory, name string, parent types.PaymentCategory) (*types.Category, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.RegisterCategory(id, name, parent)
+}
+
+func (s *Service) RegisterDefaultCategoriesContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.RegisterDefaultCategories()
+}
+
+func (s *Service) FindCategoryByIDContext(ctx context.Context, id types.PaymentCategory) (*types.Category, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.FindCategoryByID(id)
+}
+
+func (s *Service) SetCategoryActiveContext(ctx context.Context, id types.PaymentCategory, active bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.SetCategoryActive(id, active)
+}
+
+func (s *Service) CategoriesContext(ctx context.Context) ([]types.Category, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Categories(), nil
+}
+
+func (s *Service) SumPaymentsByCategoryContext(ctx context.Context) (map[types.PaymentCategory]types.Money, error) {
+	return s.sumPaymentsByCategory(ctx)
+}
+
+func (s *Service) AddCashbackRuleContext(ctx context.Context, category types.PaymentCategory, basisPoints int64, cap types.Money, period time.Duration) (*types.CashbackRule, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.AddCashbackRule(category, basisPoints, cap, period)
+}
+
+func (s *Service) RemoveCashbackRuleContext(ctx context.Context, ruleID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.RemoveCashbackRule(ruleID)
+}
+
+func (s *Service) CashbacksByAccountContext(ctx context.Context, accountID int64) ([]types.Cashback, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.CashbacksByAccount(accountID), nil
+}
+
+func (s *Service) AddFeeRuleContext(ctx context.Context, rule types.FeeRule) (*types.FeeRule, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.AddFeeRule(rule)
+}
+
+func (s *Service) RemoveFeeRuleContext(ctx context.Context, ruleID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.RemoveFeeRule(ruleID)
+}
+
+func (s *Service) CalculateFeeContext(ctx context.Context, amount types.Money, category types.PaymentCategory) (types.Money, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.CalculateFee(amount, category), nil
+}
+
+func (s *Service) RefundContext(ctx context.Context, paymentID string, amount types.Money) (*types.Refund, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Refund(paymentID, amount)
+}
+
+func (s *Service) RefundsContext(ctx context.Context, paymentID string) ([]types.Refund, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Refunds(paymentID), nil
+}
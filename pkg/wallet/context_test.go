@@ -0,0 +1,102 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"github.com/bdaler/wallet/pkg/types"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestService_Context_canceled(t *testing.T) {
+	s := newExportTestService()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	dir := t.TempDir()
+	_ = s.Export(dir)
+	jsonl := bytes.Buffer{}
+	_ = s.ExportJSONLines(&jsonl)
+
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{"PayContext", func() error {
+			_, err := s.PayContext(ctx, 1, 1, types.CategoryIt)
+			return err
+		}},
+		{"RegisterAccountContext", func() error {
+			_, err := s.RegisterAccountContext(ctx, "9127660399")
+			return err
+		}},
+		{"ExportContext", func() error { return s.ExportContext(ctx, t.TempDir()) }},
+		{"ExportJSONContext", func() error { return s.ExportJSONContext(ctx, &bytes.Buffer{}) }},
+		{"BackupContext", func() error { return s.BackupContext(ctx, &bytes.Buffer{}, BackupOptions{}) }},
+		{"ImportWithOptionsContext", func() error {
+			_, err := newTestService().ImportWithOptionsContext(ctx, dir, ImportOptions{Policy: ImportBestEffort})
+			return err
+		}},
+		{"ImportAutoContext", func() error {
+			_, err := newTestService().ImportAutoContext(ctx, dir, ImportOptions{})
+			return err
+		}},
+		{"FilterPaymentsByFnContext", func() error {
+			_, err := s.FilterPaymentsByFnContext(ctx, func(payment types.Payment) bool { return true }, 2)
+			return err
+		}},
+		{"SumPaymentsByCategoryContext", func() error {
+			_, err := s.SumPaymentsByCategoryContext(ctx)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.call(); err != context.Canceled {
+				t.Errorf("%s() error = %v, want %v", tt.name, err, context.Canceled)
+			}
+		})
+	}
+
+	if len(s.accounts) != 2 || len(s.payments) != 2 {
+		t.Errorf("canceled calls changed the service: %v, %v", s.accounts, s.payments)
+	}
+}
+
+// cancelingReader cancels its context after the first read.
+type cancelingReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (c *cancelingReader) Read(p []byte) (int, error) {
+	defer c.cancel()
+	return c.r.Read(p[:16])
+}
+
+func TestService_ImportJSONLinesWithOptionsContext_midway(t *testing.T) {
+	s := newExportTestService()
+	buf := bytes.Buffer{}
+	_ = s.ExportJSONLines(&buf)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	i := newTestService()
+	_, err := i.ImportJSONLinesWithOptionsContext(ctx, &cancelingReader{r: &buf, cancel: cancel}, ImportOptions{Policy: ImportBestEffort})
+	if err != context.Canceled || len(i.accounts) != 0 {
+		t.Errorf("ImportJSONLinesWithOptionsContext() error = %v, accounts = %v", err, i.accounts)
+	}
+}
+
+func TestService_Context_deadline(t *testing.T) {
+	s := newQueryTestService(100)
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	if _, err := s.SumPaymentsContext(ctx, 4); err != context.DeadlineExceeded {
+		t.Errorf("SumPaymentsContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	for range s.SumPaymentsWithProgressContext(ctx) {
+	}
+}
@@ -0,0 +1,258 @@
+package wallet
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/bdaler/wallet/pkg/types"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+var ErrUnknownColumn = errors.New("unknown column")
+var ErrMissingColumn = errors.New("missing required column")
+
+// Column names in the order of the dump records; they are also the default
+// CSV columns.
+var AccountColumns = []string{"id", "phone", "balance"}
+var PaymentColumns = []string{"id", "account_id", "amount", "category", "status", "fee", "decision", "decision_reason"}
+var FavoriteColumns = []string{"id", "account_id", "name", "amount", "category"}
+
+// optionalColumns holds the value of the optional columns missing from a CSV
+// file.
+var optionalColumns = map[string]string{
+	"fee":             "0",
+	"decision":        "",
+	"decision_reason": "",
+}
+
+// CSVOptions configures CSV export and import. Comma defaults to ',' and
+// Columns, used by export only, defaults to every column of the entity.
+type CSVOptions struct {
+	Comma   rune
+	Columns []string
+}
+
+func (o CSVOptions) comma() rune {
+	if o.Comma == 0 {
+		return ','
+	}
+	return o.Comma
+}
+
+func (s *Service) ExportAccountsCSV(w io.Writer, options CSVOptions) error {
+	records := make([][]string, 0, len(s.accounts))
+	for _, account := range s.accounts {
+		records = append(records, accountRecord(account))
+	}
+	return writeCSV(w, AccountColumns, records, options)
+}
+
+func (s *Service) ExportPaymentsCSV(w io.Writer, options CSVOptions) error {
+	records := make([][]string, 0, len(s.payments))
+	for _, payment := range s.payments {
+		records = append(records, paymentRecord(payment))
+	}
+	return writeCSV(w, PaymentColumns, records, options)
+}
+
+func (s *Service) ExportFavoritesCSV(w io.Writer, options CSVOptions) error {
+	records := make([][]string, 0, len(s.favorites))
+	for _, favorite := range s.favorites {
+		records = append(records, favoriteRecord(favorite))
+	}
+	return writeCSV(w, FavoriteColumns, records, options)
+}
+
+func (s *Service) ExportAccountHistoryCSV(accountID int64, w io.Writer, options CSVOptions) error {
+	payments, err := s.ExportAccountHistory(accountID)
+	if err != nil {
+		return err
+	}
+	return WritePaymentsCSV(w, payments, options)
+}
+
+func WritePaymentsCSV(w io.Writer, payments []types.Payment, options CSVOptions) error {
+	records := make([][]string, 0, len(payments))
+	for i := range payments {
+		records = append(records, paymentRecord(&payments[i]))
+	}
+	return writeCSV(w, PaymentColumns, records, options)
+}
+
+// HistoryToCSVFiles splits payments into payments1.csv, payments2.csv, ...
+// with at most records rows each, every file starting with its own header.
+// Files of an earlier, longer history are removed.
+func (s *Service) HistoryToCSVFiles(payments []types.Payment, dir string, records int, options CSVOptions) error {
+	return s.historyToCSVFiles(context.Background(), payments, dir, records, options)
+}
+
+func (s *Service) historyToCSVFiles(ctx context.Context, payments []types.Payment, dir string, records int, options CSVOptions) error {
+	if records <= 0 {
+		return ErrInvalidChunkSize
+	}
+
+	chunks := chunkPayments(payments, records)
+	for i, chunk := range chunks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		path := filepath.Join(dir, "payments"+strconv.Itoa(i+1)+".csv")
+		err := writeCSVFile(path, chunk, options)
+		if err != nil {
+			return err
+		}
+	}
+	return removeStaleChunks(dir, ".csv", len(chunks))
+}
+
+func writeCSVFile(path string, payments []types.Payment, options CSVOptions) (err error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := file.Close(); closeErr != nil {
+			log.Print(closeErr)
+			if err == nil {
+				err = closeErr
+			}
+		}
+	}()
+	return WritePaymentsCSV(file, payments, options)
+}
+
+func writeCSV(w io.Writer, columns []string, records [][]string, options CSVOptions) error {
+	selected := options.Columns
+	if len(selected) == 0 {
+		selected = columns
+	}
+	indexes, err := columnIndexes(columns, selected)
+	if err != nil {
+		return err
+	}
+
+	writer := csv.NewWriter(w)
+	writer.Comma = options.comma()
+	writer.UseCRLF = true
+
+	if err = writer.Write(selected); err != nil {
+		return err
+	}
+	row := make([]string, len(indexes))
+	for _, record := range records {
+		for i, index := range indexes {
+			row[i] = record[index]
+		}
+		if err = writer.Write(row); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func columnIndexes(columns []string, selected []string) ([]int, error) {
+	indexes := make([]int, 0, len(selected))
+	for _, name := range selected {
+		index := -1
+		for i, column := range columns {
+			if column == name {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownColumn, name)
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes, nil
+}
+
+func (s *Service) ImportAccountsCSV(r io.Reader, options CSVOptions, importOptions ImportOptions) (*ImportReport, error) {
+	return s.importCSV(context.Background(), r, entityAccounts, options, importOptions)
+}
+
+func (s *Service) ImportPaymentsCSV(r io.Reader, options CSVOptions, importOptions ImportOptions) (*ImportReport, error) {
+	return s.importCSV(context.Background(), r, entityPayments, options, importOptions)
+}
+
+func (s *Service) ImportFavoritesCSV(r io.Reader, options CSVOptions, importOptions ImportOptions) (*ImportReport, error) {
+	return s.importCSV(context.Background(), r, entityFavorites, options, importOptions)
+}
+
+// importCSV maps the header of r onto the dump record layout so the records
+// go through the same parsing and validation as dump files. Only the fee and
+// decision columns of payments are optional.
+func (s *Service) importCSV(ctx context.Context, r io.Reader, entity string, options CSVOptions, importOptions ImportOptions) (*ImportReport, error) {
+	report := &ImportReport{DryRun: importOptions.DryRun}
+
+	columns := AccountColumns
+	switch entity {
+	case entityPayments:
+		columns = PaymentColumns
+	case entityFavorites:
+		columns = FavoriteColumns
+	}
+
+	reader := csv.NewReader(newContextReader(ctx, r))
+	reader.Comma = options.comma()
+
+	header, err := reader.Read()
+	if err != nil {
+		return report, err
+	}
+	positions := make([]int, len(columns))
+	for i, column := range columns {
+		positions[i] = -1
+		for j, name := range header {
+			if name == column {
+				positions[i] = j
+			}
+		}
+		if _, optional := optionalColumns[column]; positions[i] < 0 && !optional {
+			return report, fmt.Errorf("%w: %q", ErrMissingColumn, column)
+		}
+	}
+
+	batch := s.newImportBatch(ctx, importOptions)
+	defer batch.rollback()
+	for line := 2; ; line++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		// A malformed row can be skipped, but any other error means the
+		// reader can not go on.
+		var parseErr *csv.ParseError
+		if err != nil && !errors.As(err, &parseErr) {
+			return report, report.fail(&ImportError{File: entity, Line: line, Err: err})
+		}
+
+		if err == nil {
+			item := make([]string, len(columns))
+			for i, position := range positions {
+				item[i] = optionalColumns[columns[i]]
+				if position >= 0 {
+					item[i] = row[position]
+				}
+			}
+			err = batch.add(entity, item, DumpVersion, report)
+		}
+		if err != nil {
+			if err = report.record(importOptions.Policy, &ImportError{File: entity, Line: line, Err: err}); err != nil {
+				return report, err
+			}
+		}
+		if err = batch.observe(entity, line-1, 0); err != nil {
+			return report, err
+		}
+	}
+
+	return report, batch.commit()
+}
@@ -0,0 +1,98 @@
+package wallet
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestService_ExportPaymentsCSV_columns(t *testing.T) {
+	s := newExportTestService()
+	buf := bytes.Buffer{}
+	err := s.ExportPaymentsCSV(&buf, CSVOptions{Comma: ';', Columns: []string{"amount", "status"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "amount;status\r\n10;INPROGRESS\r\n20;INPROGRESS\r\n"
+	if buf.String() != want {
+		t.Errorf("ExportPaymentsCSV() got = %q, want %q", buf.String(), want)
+	}
+
+	err = s.ExportPaymentsCSV(&buf, CSVOptions{Columns: []string{"unknown"}})
+	if !errors.Is(err, ErrUnknownColumn) {
+		t.Errorf("ExportPaymentsCSV() error = %v, want %v", err, ErrUnknownColumn)
+	}
+}
+
+func TestService_ImportCSV_roundTrip(t *testing.T) {
+	s := newExportTestService()
+	accounts, payments, favorites := bytes.Buffer{}, bytes.Buffer{}, bytes.Buffer{}
+	options := CSVOptions{Comma: '\t'}
+	_ = s.ExportAccountsCSV(&accounts, options)
+	_ = s.ExportPaymentsCSV(&payments, options)
+	_ = s.ExportFavoritesCSV(&favorites, options)
+
+	i := newTestService()
+	if _, err := i.ImportAccountsCSV(&accounts, options, ImportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.ImportPaymentsCSV(&payments, options, ImportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.ImportFavoritesCSV(&favorites, options, ImportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(s.accounts, i.accounts) ||
+		!reflect.DeepEqual(s.payments, i.payments) ||
+		!reflect.DeepEqual(s.favorites, i.favorites) {
+		t.Error("imported and exported entities doesn't match")
+	}
+
+	_, err := i.ImportAccountsCSV(strings.NewReader("id,balance\r\n1,10\r\n"), CSVOptions{}, ImportOptions{})
+	if !errors.Is(err, ErrMissingColumn) {
+		t.Errorf("ImportAccountsCSV() error = %v, want %v", err, ErrMissingColumn)
+	}
+}
+
+func TestService_ImportAccountsCSV_readError(t *testing.T) {
+	errDisk := errors.New("disk error")
+	reader := &failingReader{data: "id,phone,balance\n1,9127660305,10\n\"2,x\n", err: errDisk}
+
+	s := newTestService()
+	report, err := s.ImportAccountsCSV(reader, CSVOptions{}, ImportOptions{Policy: ImportBestEffort})
+	if !errors.Is(err, errDisk) {
+		t.Fatalf("ImportAccountsCSV() error = %v, want %v", err, errDisk)
+	}
+	if len(report.Errors) != 1 || len(s.accounts) != 0 {
+		t.Errorf("ImportAccountsCSV() errors = %v, accounts = %v", report.Errors, s.accounts)
+	}
+}
+
+func TestService_HistoryToCSVFiles(t *testing.T) {
+	dir := t.TempDir()
+	s := newExportTestService()
+	_, _ = s.Pay(1, 5, "it")
+	payments, err := s.ExportAccountHistory(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.HistoryToCSVFiles(payments, dir, 1, CSVOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 2 {
+		t.Errorf("HistoryToCSVFiles() wrote %d files, want 2", len(files))
+	}
+
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "payments2.csv"))
+	if !strings.HasPrefix(string(data), "id,account_id,amount,category,status,fee,decision,decision_reason\r\n") {
+		t.Errorf("payments2.csv = %q", data)
+	}
+}
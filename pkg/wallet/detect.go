@@ -0,0 +1,303 @@
+package wallet
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrUnknownFormat = errors.New("unknown import format")
+
+type Format string
+
+const (
+	// FormatLegacy is the single file written by ExportToFile.
+	FormatLegacy Format = "legacy"
+	// FormatDumpDir is a directory of .dump files written by Export.
+	FormatDumpDir Format = "dump-dir"
+	// FormatChain is a directory written by ExportFull and ExportIncremental.
+	FormatChain Format = "chain"
+	// FormatHistory is a directory written by HistoryToFiles.
+	FormatHistory   Format = "history"
+	FormatDump      Format = "dump"
+	FormatJSON      Format = "json"
+	FormatJSONLines Format = "jsonl"
+	FormatCSV       Format = "csv"
+	FormatBackup    Format = "backup"
+)
+
+const detectPeekSize = 512
+
+// detectedFormat carries what a CSV or a compressed import needs besides the
+// format.
+type detectedFormat struct {
+	format      Format
+	entity      string
+	comma       rune
+	compression Compression
+}
+
+// DetectFormat tells which of the export formats of the service path uses.
+func DetectFormat(path string) (Format, error) {
+	detected, err := detectFormat(path)
+	if err != nil {
+		return "", err
+	}
+	return detected.format, nil
+}
+
+func detectFormat(path string) (*detectedFormat, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return detectDirFormat(path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if closeErr := file.Close(); closeErr != nil {
+			log.Print(closeErr)
+		}
+	}()
+
+	reader := bufio.NewReaderSize(file, detectPeekSize)
+	head, err := reader.Peek(detectPeekSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	compression := compressionOf(head)
+	if compression == "" {
+		return detectStreamFormat(filepath.Base(path), head)
+	}
+
+	// A backup is a compressed tar archive; anything else compressed is
+	// told by what it holds.
+	decompressor, err := newDecompressor(reader, compression)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrUnknownFormat, path, err)
+	}
+	defer func() {
+		if closeErr := decompressor.Close(); closeErr != nil {
+			log.Print(closeErr)
+		}
+	}()
+	head = make([]byte, detectPeekSize)
+	n, err := io.ReadFull(decompressor, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("%w: %s: %v", ErrUnknownFormat, path, err)
+	}
+	if isTarHeader(head[:n]) {
+		return &detectedFormat{format: FormatBackup, compression: compression}, nil
+	}
+	detected, err := detectStreamFormat(filepath.Base(path), head[:n])
+	if err != nil {
+		return nil, err
+	}
+	if detected.format == FormatBackup {
+		return nil, fmt.Errorf("%w: %s is compressed twice", ErrUnknownFormat, path)
+	}
+	detected.compression = compression
+	return detected, nil
+}
+
+// isTarHeader reports whether head starts with a ustar or GNU tar header.
+func isTarHeader(head []byte) bool {
+	const magicOffset = 257
+	return len(head) >= magicOffset+5 && bytes.Equal(head[magicOffset:magicOffset+5], []byte("ustar"))
+}
+
+func detectDirFormat(dir string) (*detectedFormat, error) {
+	if _, err := os.Stat(filepath.Join(dir, chainManifestName)); err == nil {
+		return &detectedFormat{format: FormatChain}, nil
+	}
+	if _, err := os.Stat(filepath.Join(dir, historyManifestName)); err == nil {
+		return &detectedFormat{format: FormatHistory}, nil
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if _, ok := dumpEntities[file.Name()]; ok && !file.IsDir() {
+			return &detectedFormat{format: FormatDumpDir}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownFormat, dir)
+}
+
+func detectStreamFormat(name string, head []byte) (*detectedFormat, error) {
+	if bytes.HasPrefix(head, []byte(backupMagic)) || compressionOf(head) != "" {
+		return &detectedFormat{format: FormatBackup}, nil
+	}
+	if bytes.HasPrefix(head, []byte(dumpMagic)) {
+		return &detectedFormat{format: FormatDump}, nil
+	}
+
+	trimmed := bytes.TrimSpace(head)
+	if len(trimmed) == 0 {
+		return &detectedFormat{format: FormatLegacy}, nil
+	}
+
+	firstLine := string(trimmed)
+	if end := strings.IndexByte(firstLine, '\n'); end >= 0 {
+		firstLine = firstLine[:end]
+	}
+	firstLine = strings.TrimSuffix(firstLine, "\r")
+
+	if trimmed[0] == '{' {
+		line := jsonLine{}
+		if json.Unmarshal([]byte(firstLine), &line) == nil && line.Type == jsonLineHeader {
+			return &detectedFormat{format: FormatJSONLines}, nil
+		}
+		return &detectedFormat{format: FormatJSON}, nil
+	}
+	if strings.Contains(firstLine, "|") {
+		return &detectedFormat{format: FormatLegacy}, nil
+	}
+
+	for _, comma := range []rune{',', ';', '\t'} {
+		if entity := csvEntity(strings.Split(firstLine, string(comma))); entity != "" {
+			return &detectedFormat{format: FormatCSV, entity: entity, comma: comma}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownFormat, name)
+}
+
+// csvEntity returns the entity whose columns include every column of header
+// and whose required columns are all present.
+func csvEntity(header []string) string {
+	entities := []struct {
+		name    string
+		columns []string
+	}{
+		{entityAccounts, AccountColumns},
+		{entityPayments, PaymentColumns},
+		{entityFavorites, FavoriteColumns},
+	}
+	for _, entity := range entities {
+		present := make(map[string]bool, len(header))
+		for _, name := range header {
+			present[name] = true
+		}
+		matched := 0
+		for _, column := range entity.columns {
+			if present[column] {
+				matched++
+			} else if _, optional := optionalColumns[column]; !optional {
+				matched = -1
+				break
+			}
+		}
+		if matched == len(header) {
+			return entity.name
+		}
+	}
+	return ""
+}
+
+// ImportAuto imports path in whichever format DetectFormat finds, merging it
+// with the service according to options.Conflict. Encrypted backups need
+// RestoreWithOptions and a passphrase.
+func (s *Service) ImportAuto(path string, options ImportOptions) (*ImportReport, error) {
+	return s.importAuto(context.Background(), path, options)
+}
+
+func (s *Service) importAuto(ctx context.Context, path string, options ImportOptions) (*ImportReport, error) {
+	detected, err := detectFormat(path)
+	if err != nil {
+		return &ImportReport{DryRun: options.DryRun}, err
+	}
+	log.Print("importing ", path, " as ", detected.format)
+
+	var report *ImportReport
+	switch detected.format {
+	case FormatDumpDir:
+		report, err = s.importDir(ctx, path, options)
+	case FormatChain:
+		report, err = s.importChain(ctx, path, options)
+	case FormatHistory:
+		report, err = s.importHistory(ctx, path, options)
+	default:
+		report, err = s.importFile(ctx, path, detected, options)
+	}
+	if report != nil {
+		report.Format = detected.format
+	}
+	return report, err
+}
+
+func (s *Service) importFile(ctx context.Context, path string, detected *detectedFormat, options ImportOptions) (*ImportReport, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return &ImportReport{DryRun: options.DryRun}, err
+	}
+	defer func() {
+		if closeErr := file.Close(); closeErr != nil {
+			log.Print(closeErr)
+		}
+	}()
+
+	if detected.format == FormatBackup {
+		return s.restore(ctx, file, BackupOptions{}, options)
+	}
+
+	var r io.Reader = file
+	if detected.compression != "" {
+		decompressor, err := newDecompressor(file, detected.compression)
+		if err != nil {
+			return &ImportReport{DryRun: options.DryRun}, err
+		}
+		defer func() {
+			if closeErr := decompressor.Close(); closeErr != nil {
+				log.Print(closeErr)
+			}
+		}()
+		r = decompressor
+	}
+
+	switch detected.format {
+	case FormatDump:
+		return s.ImportFromWithProgress(ctx, r, options)
+	case FormatJSON:
+		return s.importJSON(ctx, r, options)
+	case FormatJSONLines:
+		return s.importJSONLines(ctx, r, options)
+	case FormatCSV:
+		return s.importCSV(ctx, r, detected.entity, CSVOptions{Comma: detected.comma}, options)
+	}
+	return s.importLegacyFrom(ctx, r, filepath.Base(path), options)
+}
+
+func (s *Service) importHistory(ctx context.Context, dir string, options ImportOptions) (*ImportReport, error) {
+	report := &ImportReport{DryRun: options.DryRun}
+	payments, err := HistoryFromFiles(dir)
+	if err != nil {
+		return report, err
+	}
+
+	batch := s.newImportBatch(ctx, options)
+	defer batch.rollback()
+	for i := range payments {
+		if err = batch.addPayment(&payments[i], report); err != nil {
+			if err = report.record(options.Policy, &ImportError{File: historyManifestName, Line: i + 1, Err: err}); err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, batch.commit()
+}
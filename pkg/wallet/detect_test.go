@@ -0,0 +1,203 @@
+package wallet
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestService_ImportAuto(t *testing.T) {
+	tests := []struct {
+		name   string
+		format Format
+		export func(s *Service, path string) error
+	}{
+		{
+			name:   "accounts.txt",
+			format: FormatLegacy,
+			export: func(s *Service, path string) error { return s.ExportToFile(path) },
+		},
+		{
+			name:   "dir",
+			format: FormatDumpDir,
+			export: func(s *Service, path string) error { return s.Export(path) },
+		},
+		{
+			name:   "chain",
+			format: FormatChain,
+			export: func(s *Service, path string) error {
+				_, err := s.ExportFull(path)
+				return err
+			},
+		},
+		{
+			name:   "wallet.dump",
+			format: FormatDump,
+			export: func(s *Service, path string) error { return writeExport(path, s.ExportTo) },
+		},
+		{
+			name:   "wallet.json",
+			format: FormatJSON,
+			export: func(s *Service, path string) error { return writeExport(path, s.ExportJSON) },
+		},
+		{
+			name:   "wallet.jsonl",
+			format: FormatJSONLines,
+			export: func(s *Service, path string) error { return writeExport(path, s.ExportJSONLines) },
+		},
+		{
+			name:   "wallet.dump.gz",
+			format: FormatDump,
+			export: func(s *Service, path string) error {
+				return writeCompressedExport(path, CompressionGzip, s.ExportTo)
+			},
+		},
+		{
+			name:   "wallet.json.zst",
+			format: FormatJSON,
+			export: func(s *Service, path string) error {
+				return writeCompressedExport(path, CompressionZstd, s.ExportJSON)
+			},
+		},
+		{
+			name:   "accounts.csv",
+			format: FormatCSV,
+			export: func(s *Service, path string) error {
+				buf := bytes.Buffer{}
+				if err := s.ExportAccountsCSV(&buf, CSVOptions{Comma: ';'}); err != nil {
+					return err
+				}
+				return ioutil.WriteFile(path, buf.Bytes(), 0600)
+			},
+		},
+		{
+			name:   "wallet.bak",
+			format: FormatBackup,
+			export: func(s *Service, path string) error {
+				buf := bytes.Buffer{}
+				if err := s.Backup(&buf, BackupOptions{}); err != nil {
+					return err
+				}
+				return ioutil.WriteFile(path, buf.Bytes(), 0600)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newExportTestService()
+			path := filepath.Join(t.TempDir(), tt.name)
+			if tt.format == FormatDumpDir || tt.format == FormatChain {
+				path = filepath.Dir(path)
+			}
+			if err := tt.export(s.Service, path); err != nil {
+				t.Fatal(err)
+			}
+
+			i := newTestService()
+			report, err := i.ImportAuto(path, ImportOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Format != tt.format {
+				t.Errorf("ImportAuto() format = %s, want %s", report.Format, tt.format)
+			}
+			if len(i.accounts) != len(s.accounts) || report.Added == 0 {
+				t.Errorf("ImportAuto() accounts = %v, report = %+v", i.accounts, report)
+			}
+		})
+	}
+}
+
+func writeExport(path string, export func(w io.Writer) error) error {
+	buf := bytes.Buffer{}
+	if err := export(&buf); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0600)
+}
+
+func writeCompressedExport(path string, compression Compression, export func(w io.Writer) error) error {
+	buf := bytes.Buffer{}
+	compressor, err := newCompressor(&buf, compression)
+	if err != nil {
+		return err
+	}
+	if err = export(compressor); err != nil {
+		return err
+	}
+	if err = compressor.Close(); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0600)
+}
+
+func TestService_ImportFromFile_legacy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.txt")
+	writeDumpFixture(t, filepath.Dir(path), "accounts.txt", "1;9127660305;10||3;9127660306;30|\n")
+
+	s := newTestService()
+	if err := s.ImportFromFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.accounts) != 2 || s.accounts[1].Balance != 30 {
+		t.Errorf("ImportFromFile() accounts = %v", s.accounts)
+	}
+	account, _ := s.RegisterAccount("9127660307")
+	if account.ID != 4 {
+		t.Errorf("RegisterAccount() after import got ID %d, want 4", account.ID)
+	}
+
+	err := s.ImportFromFile(path)
+	if err != nil || len(s.accounts) != 3 {
+		t.Errorf("ImportFromFile() again error = %v, accounts = %v", err, s.accounts)
+	}
+
+	writeDumpFixture(t, filepath.Dir(path), "accounts.txt", "9;9127660305;10|")
+	_, err = s.ImportFromFileWithOptions(path, ImportOptions{Conflict: ConflictSkip})
+	if err != nil || len(s.accounts) != 3 {
+		t.Errorf("ImportFromFileWithOptions() skip error = %v, accounts = %v", err, s.accounts)
+	}
+	if err = s.ImportFromFile(path); !errors.Is(err, ErrImportConflict) {
+		t.Errorf("ImportFromFile() error = %v, want %v", err, ErrImportConflict)
+	}
+}
+
+func TestDetectFormat_unknown(t *testing.T) {
+	dir := t.TempDir()
+	writeDumpFixture(t, dir, "notes.txt", "hello\n")
+
+	for _, path := range []string{dir, filepath.Join(dir, "notes.txt")} {
+		if _, err := DetectFormat(path); !errors.Is(err, ErrUnknownFormat) {
+			t.Errorf("DetectFormat(%s) error = %v, want %v", path, err, ErrUnknownFormat)
+		}
+	}
+}
+
+func TestService_ImportAuto_paymentsCSV(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"payments.csv", "id,account_id,amount,category,status\np1,1,10,it,INPROGRESS\n"},
+		{"payments_fee.csv", "id,account_id,amount,category,status,fee\np1,1,10,it,INPROGRESS,1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeDumpFixture(t, dir, tt.name, tt.data)
+			path := filepath.Join(dir, tt.name)
+			if format, err := DetectFormat(path); err != nil || format != FormatCSV {
+				t.Fatalf("DetectFormat() = %v, %v, want %v", format, err, FormatCSV)
+			}
+
+			s := newTestService()
+			_, _ = s.RegisterAccount("9127660305")
+			if report, err := s.ImportAuto(path, ImportOptions{}); err != nil || report.Payments != 1 {
+				t.Errorf("ImportAuto() = %+v, %v", report, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,418 @@
+package wallet
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bdaler/wallet/pkg/types"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DumpVersion is the schema version written by Export. Version 1 is the
+// original headerless format with unquoted fields; version 3 adds the risk
+// decision and its reason to payments.
+const DumpVersion = 3
+
+const dumpMagic = "#wallet-dump"
+
+const (
+	entityAccounts  = "accounts"
+	entityPayments  = "payments"
+	entityFavorites = "favorites"
+)
+
+var ErrUnsupportedDumpVersion = errors.New("unsupported dump version")
+var ErrInvalidDumpHeader = errors.New("invalid dump header")
+var ErrDumpRecordCount = errors.New("dump record count does not match header")
+var ErrMissingDumpHeader = errors.New("dump stream has no header")
+var ErrMixedDumps = errors.New("dump files do not belong to one export")
+
+const dumpManifestName = "dumps.manifest.json"
+
+// DumpManifest lists the dumps written by the last Export to a directory.
+// It is replaced after the dumps, so Import can tell an export that was
+// interrupted halfway from a complete one.
+type DumpManifest struct {
+	Version int            `json:"version"`
+	Created time.Time      `json:"created"`
+	Files   []ManifestFile `json:"files"`
+}
+
+func (m *DumpManifest) file(name string) *ManifestFile {
+	for i := range m.Files {
+		if m.Files[i].Name == name {
+			return &m.Files[i]
+		}
+	}
+	return nil
+}
+
+// readDumpManifest returns the manifest of dir, or nil for directories
+// written before Export had one.
+func readDumpManifest(dir string) (*DumpManifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, dumpManifestName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &DumpManifest{}
+	if err = json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMixedDumps, err)
+	}
+	if manifest.Version < 1 || manifest.Version > DumpVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedDumpVersion, manifest.Version)
+	}
+	return manifest, nil
+}
+
+type dumpHeader struct {
+	Version int
+	Entity  string
+	Records int
+	Created time.Time
+}
+
+func (h dumpHeader) record() []string {
+	return []string{
+		dumpMagic,
+		"version=" + strconv.Itoa(h.Version),
+		"entity=" + h.Entity,
+		"records=" + strconv.Itoa(h.Records),
+		"created=" + h.Created.UTC().Format(time.RFC3339Nano),
+	}
+}
+
+func parseDumpHeader(record []string) (dumpHeader, error) {
+	header := dumpHeader{}
+	for _, field := range record[1:] {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return header, fmt.Errorf("%w: %q", ErrInvalidDumpHeader, field)
+		}
+
+		var err error
+		switch parts[0] {
+		case "version":
+			header.Version, err = strconv.Atoi(parts[1])
+		case "entity":
+			header.Entity = parts[1]
+		case "records":
+			header.Records, err = strconv.Atoi(parts[1])
+		case "created":
+			header.Created, err = time.Parse(time.RFC3339Nano, parts[1])
+		}
+		if err != nil {
+			return header, fmt.Errorf("%w: %q", ErrInvalidDumpHeader, field)
+		}
+	}
+
+	if header.Version < 1 || header.Version > DumpVersion {
+		return header, fmt.Errorf("%w: %d", ErrUnsupportedDumpVersion, header.Version)
+	}
+	return header, nil
+}
+
+func writeDump(w io.Writer, entity string, created time.Time, records [][]string) error {
+	writer := newDumpWriter(w)
+	if err := writeDumpHeader(writer, entity, created, len(records)); err != nil {
+		return err
+	}
+	if err := writer.WriteAll(records); err != nil {
+		return err
+	}
+	return writer.Error()
+}
+
+func newDumpWriter(w io.Writer) *csv.Writer {
+	writer := csv.NewWriter(w)
+	writer.Comma = ';'
+	return writer
+}
+
+func writeDumpHeader(writer *csv.Writer, entity string, created time.Time, records int) error {
+	header := dumpHeader{
+		Version: DumpVersion,
+		Entity:  entity,
+		Records: records,
+		Created: created,
+	}
+	return writer.Write(header.record())
+}
+
+type dumpFile struct {
+	name    string
+	entity  string
+	records [][]string
+}
+
+// snapshotDumps encodes the current state before any I/O starts, so the
+// written files always describe a single point in time.
+func (s *Service) snapshotDumps() []dumpFile {
+	return s.changedDumps(-1)
+}
+
+// writeDumpFiles writes every dump to a temporary file next to its target and
+// renames them into place only after all of them were written and synced, so
+// a failed write leaves the previous dumps untouched. A failure between the
+// renames can still leave old and new dumps side by side; callers list the
+// returned files in a manifest written afterwards to detect that.
+func writeDumpFiles(ctx context.Context, dir string, created time.Time, dumps []dumpFile) (files []ManifestFile, err error) {
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	temps := make([]string, 0, len(dumps))
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, temp := range temps {
+			if removeErr := os.Remove(temp); removeErr != nil && !os.IsNotExist(removeErr) {
+				log.Print(removeErr)
+			}
+		}
+	}()
+
+	for _, dump := range dumps {
+		temp, file, err := writeTempDump(ctx, dir, dump, created)
+		if temp != "" {
+			temps = append(temps, temp)
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	for i, dump := range dumps {
+		err = os.Rename(temps[i], filepath.Join(dir, dump.name))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, syncDir(dir)
+}
+
+func writeTempDump(ctx context.Context, dir string, dump dumpFile, created time.Time) (string, ManifestFile, error) {
+	manifest := ManifestFile{Name: dump.name, Records: len(dump.records)}
+	file, err := ioutil.TempFile(dir, "."+dump.name+".*.tmp")
+	if err != nil {
+		return "", manifest, err
+	}
+
+	checksum := newChecksumWriter()
+	writer := bufio.NewWriter(newContextWriter(ctx, io.MultiWriter(file, checksum)))
+	err = writeDump(writer, dump.entity, created, dump.records)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	manifest.Size, manifest.SHA256 = checksum.size, checksum.sum()
+	return file.Name(), manifest, err
+}
+
+// ManifestFile identifies a file listed in an export, backup or history
+// manifest.
+type ManifestFile struct {
+	Name    string `json:"name"`
+	Records int    `json:"records"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"`
+}
+
+func (f ManifestFile) verify(content []byte) bool {
+	sum := sha256.Sum256(content)
+	return int64(len(content)) == f.Size && hex.EncodeToString(sum[:]) == f.SHA256
+}
+
+func (f ManifestFile) matches(checksum *checksumWriter) bool {
+	return checksum.size == f.Size && checksum.sum() == f.SHA256
+}
+
+type checksumWriter struct {
+	hash hash.Hash
+	size int64
+}
+
+func newChecksumWriter() *checksumWriter {
+	return &checksumWriter{hash: sha256.New()}
+}
+
+func (w *checksumWriter) Write(p []byte) (int, error) {
+	w.size += int64(len(p))
+	return w.hash.Write(p)
+}
+
+func (w *checksumWriter) sum() string {
+	return hex.EncodeToString(w.hash.Sum(nil))
+}
+
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := file.Close(); closeErr != nil {
+			log.Print(closeErr)
+		}
+	}()
+	// Not every platform supports syncing a directory; the rename itself has
+	// already happened at this point.
+	if err = file.Sync(); err != nil {
+		log.Print(err)
+	}
+	return nil
+}
+
+// dumpReader reads records of any supported dump version. A stream may hold
+// several sections, each started by its own header; records before the first
+// header are treated as version 1.
+type dumpReader struct {
+	reader *bufio.Reader
+	header dumpHeader
+	count  int
+	line   int
+	next   int
+}
+
+func newDumpReader(r io.Reader) *dumpReader {
+	return &dumpReader{
+		reader: bufio.NewReader(r),
+		header: dumpHeader{Version: 1},
+		next:   1,
+	}
+}
+
+func (d *dumpReader) Read() ([]string, error) {
+	for {
+		line, err := d.readLine()
+		if err == io.EOF {
+			return nil, d.checkCount(err)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if line == dumpMagic || strings.HasPrefix(line, dumpMagic+";") {
+			if err = d.checkCount(nil); err != nil {
+				return nil, err
+			}
+			header, err := parseDumpHeader(strings.Split(line, ";"))
+			if err != nil {
+				return nil, err
+			}
+			d.header = header
+			d.count = 0
+			continue
+		}
+
+		d.count++
+		if d.header.Version == 1 {
+			return strings.Split(line, ";"), nil
+		}
+
+		reader := csv.NewReader(strings.NewReader(line))
+		reader.Comma = ';'
+		reader.FieldsPerRecord = -1
+		return reader.Read()
+	}
+}
+
+func (d *dumpReader) checkCount(err error) error {
+	if d.header.Version > 1 && d.header.Records != d.count {
+		return fmt.Errorf("%w: %s header has %d, read %d", ErrDumpRecordCount, d.header.Entity, d.header.Records, d.count)
+	}
+	return err
+}
+
+// readLine returns the next non-empty logical line. For quoted formats a line
+// continues while it has an unbalanced quote, so values may contain newlines.
+// The quote balance is kept per physical line, which keeps long quoted values
+// linear to read.
+func (d *dumpReader) readLine() (string, error) {
+	line := strings.Builder{}
+	quoted := false
+	d.line = d.next
+	for {
+		chunk, err := d.reader.ReadString('\n')
+		if chunk != "" {
+			d.next++
+		}
+		line.WriteString(chunk)
+		if d.header.Version > 1 && strings.Count(chunk, `"`)%2 == 1 {
+			quoted = !quoted
+		}
+		if err == io.EOF && removeEndLine(line.String()) != "" {
+			return removeEndLine(line.String()), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if quoted {
+			continue
+		}
+		if removeEndLine(line.String()) == "" {
+			line.Reset()
+			d.line = d.next
+			continue
+		}
+		return removeEndLine(line.String()), nil
+	}
+}
+
+func accountRecord(account *types.Account) []string {
+	return []string{
+		strconv.FormatInt(account.ID, 10),
+		string(account.Phone),
+		strconv.FormatInt(int64(account.Balance), 10),
+	}
+}
+
+func paymentRecord(payment *types.Payment) []string {
+	return []string{
+		payment.ID,
+		strconv.FormatInt(payment.AccountID, 10),
+		strconv.FormatInt(int64(payment.Amount), 10),
+		string(payment.Category),
+		string(payment.Status),
+		strconv.FormatInt(int64(payment.Fee), 10),
+		string(payment.Decision),
+		payment.DecisionReason,
+	}
+}
+
+func favoriteRecord(favorite *types.Favorite) []string {
+	return []string{
+		favorite.ID,
+		strconv.FormatInt(favorite.AccountID, 10),
+		favorite.Name,
+		strconv.FormatInt(int64(favorite.Amount), 10),
+		string(favorite.Category),
+	}
+}
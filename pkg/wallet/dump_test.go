@@ -0,0 +1,147 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bdaler/wallet/pkg/types"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestService_Export_escaping(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestService()
+	account, _ := s.AddAccountWithBalance("9127660305", 100)
+	payment, _ := s.Pay(account.ID, 10, types.CategoryIt)
+	_, _ = s.FavoritePayment(payment.ID, "rent; \"home\"\nflat")
+
+	if err := s.Export(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	i := newTestService()
+	if err := i.Import(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(s.favorites, i.favorites) {
+		t.Errorf("imported favorites = %v, want %v", i.favorites[0], s.favorites[0])
+	}
+}
+
+func TestService_Import_versions(t *testing.T) {
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "accounts.dump"), []byte("1;9127660305;10\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := "e1dceb29-6cc4-48c5-acd4-455530f9d50a;1;10;it;INPROGRESS\n"
+	err = ioutil.WriteFile(filepath.Join(dir, "payments.dump"), []byte(legacy), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestService()
+	if err = s.Import(dir); err != nil {
+		t.Fatal(err)
+	}
+	want := &types.Payment{
+		ID:        "e1dceb29-6cc4-48c5-acd4-455530f9d50a",
+		AccountID: 1,
+		Amount:    10,
+		Category:  types.CategoryIt,
+		Status:    types.PaymentStatusInProgress,
+	}
+	if len(s.payments) != 1 || !reflect.DeepEqual(s.payments[0], want) {
+		t.Errorf("Import() payments = %v, want %v", s.payments, want)
+	}
+
+	future := "#wallet-dump;version=99;entity=payments;records=0;created=2020-11-01T00:00:00Z\n"
+	err = ioutil.WriteFile(filepath.Join(dir, "payments.dump"), []byte(future), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = newTestService().Import(dir)
+	if !errors.Is(err, ErrUnsupportedDumpVersion) {
+		t.Errorf("Import() error = %v, want %v", err, ErrUnsupportedDumpVersion)
+	}
+}
+
+func TestService_ImportFrom_decisionVersion(t *testing.T) {
+	const accounts = "#wallet-dump;version=%d;entity=accounts;records=1;created=2020-11-01T00:00:00Z\n1;9127660305;10\n"
+	const payments = "#wallet-dump;version=%d;entity=payments;records=1;created=2020-11-01T00:00:00Z\n" +
+		"e1dceb29-6cc4-48c5-acd4-455530f9d50a;1;10;it;HELD;0;HOLD;amount\n"
+
+	for _, version := range []int{2, 3} {
+		s := newTestService()
+		dump := fmt.Sprintf(accounts+payments, version, version)
+		err := s.ImportFrom(strings.NewReader(dump))
+		if version == 2 && !errors.Is(err, ErrInvalidRecord) {
+			t.Errorf("ImportFrom() version 2 error = %v, want %v", err, ErrInvalidRecord)
+		}
+		if version == 3 && (err != nil || len(s.payments) != 1 || s.payments[0].Decision != types.DecisionHold) {
+			t.Errorf("ImportFrom() version 3 = %v, payments %v", err, s.payments)
+		}
+	}
+}
+
+func TestService_Export_snapshot(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestService()
+	_, _ = s.AddAccountWithBalance("9127660305", 10)
+	_, _ = s.AddAccountWithBalance("9127660306", 11)
+
+	for i := 0; i < 2; i++ {
+		if err := s.Export(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 4 {
+		t.Errorf("Export() left %d files, want 4", len(files))
+	}
+
+	i := newTestService()
+	if err = i.Import(dir); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.accounts, i.accounts) {
+		t.Errorf("imported accounts = %v, want %v", i.accounts, s.accounts)
+	}
+}
+
+func TestService_Import_mixedExports(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestService()
+	account, _ := s.AddAccountWithBalance("9127660305", 100)
+	if err := s.Export(dir); err != nil {
+		t.Fatal(err)
+	}
+	old, err := ioutil.ReadFile(filepath.Join(dir, "accounts.dump"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = s.Pay(account.ID, 10, types.CategoryIt)
+	if err = s.Export(dir); err != nil {
+		t.Fatal(err)
+	}
+	// An export interrupted between its renames leaves the old accounts next
+	// to the new payments.
+	writeDumpFixture(t, dir, "accounts.dump", string(old))
+
+	i := newTestService()
+	if err = i.Import(dir); !errors.Is(err, ErrMixedDumps) {
+		t.Errorf("Import() error = %v, want %v", err, ErrMixedDumps)
+	}
+	if len(i.accounts) != 0 {
+		t.Errorf("Import() accounts = %v, want none", i.accounts)
+	}
+}
@@ -0,0 +1,301 @@
+package wallet
+
+import (
+	"github.com/bdaler/wallet/pkg/types"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventAccountRegistered EventType = "AccountRegistered"
+	EventDeposited         EventType = "Deposited"
+	EventPaymentCreated    EventType = "PaymentCreated"
+	EventPaymentRejected   EventType = "PaymentRejected"
+	EventPaymentCompleted  EventType = "PaymentCompleted"
+	EventPaymentRefunded   EventType = "PaymentRefunded"
+	EventFavoriteCreated   EventType = "FavoriteCreated"
+	EventPaymentPending    EventType = "PaymentPending"
+	EventPaymentCanceled   EventType = "PaymentCanceled"
+	EventPaymentHeld       EventType = "PaymentHeld"
+	EventPaymentDenied     EventType = "PaymentDenied"
+
+	// The imported events carry the records merged by an import.
+	EventAccountImported  EventType = "AccountImported"
+	EventPaymentImported  EventType = "PaymentImported"
+	EventFavoriteImported EventType = "FavoriteImported"
+
+	// The configuration events belong to no account.
+	EventCategoryRegistered  EventType = "CategoryRegistered"
+	EventCategoryUpdated     EventType = "CategoryUpdated"
+	EventFeeRuleAdded        EventType = "FeeRuleAdded"
+	EventFeeRuleRemoved      EventType = "FeeRuleRemoved"
+	EventCashbackRuleAdded   EventType = "CashbackRuleAdded"
+	EventCashbackRuleRemoved EventType = "CashbackRuleRemoved"
+)
+
+// Event describes one mutation of the service. Account, Payment, Favorite and
+// the other records are copies taken when the event was published; Cashbacks
+// holds the cashbacks of Payment the mutation created or settled. Amount is
+// the change of the account balance and Balance the balance after the
+// mutation.
+type Event struct {
+	Seq          int64               `json:"seq"`
+	Type         EventType           `json:"type"`
+	Time         time.Time           `json:"time"`
+	AccountID    int64               `json:"account_id"`
+	Amount       types.Money         `json:"amount,omitempty"`
+	Balance      types.Money         `json:"balance"`
+	Account      *types.Account      `json:"account,omitempty"`
+	Payment      *types.Payment      `json:"payment,omitempty"`
+	Favorite     *types.Favorite     `json:"favorite,omitempty"`
+	Refund       *types.Refund       `json:"refund,omitempty"`
+	Cashbacks    []types.Cashback    `json:"cashbacks,omitempty"`
+	Category     *types.Category     `json:"category,omitempty"`
+	FeeRule      *types.FeeRule      `json:"fee_rule,omitempty"`
+	CashbackRule *types.CashbackRule `json:"cashback_rule,omitempty"`
+}
+
+// BackpressurePolicy decides what happens when the buffer of a subscriber is
+// full.
+type BackpressurePolicy int
+
+const (
+	// BackpressureBlock makes the mutation wait until the subscriber reads.
+	BackpressureBlock BackpressurePolicy = iota
+	// BackpressureDrop drops the event for that subscriber and counts it.
+	BackpressureDrop
+	// BackpressureDisconnect unsubscribes the subscriber and closes its
+	// channel.
+	BackpressureDisconnect
+)
+
+const defaultEventBuffer = 64
+
+type SubscribeOptions struct {
+	// Buffer is the channel capacity, 64 when zero.
+	Buffer int
+	Policy BackpressurePolicy
+	// AccountID, when not zero, limits the subscription to one account.
+	AccountID int64
+	// Types, when not empty, limits the subscription to these events.
+	Types []EventType
+}
+
+// Subscription delivers events on C in the order the mutations happened, so
+// the events of an account always arrive in order. C is closed by
+// Unsubscribe or when BackpressureDisconnect drops the subscriber.
+type Subscription struct {
+	C <-chan Event
+
+	ch      chan Event
+	done    chan struct{}
+	once    sync.Once
+	mu      sync.Mutex
+	closed  bool
+	options SubscribeOptions
+	dropped int64
+}
+
+// Dropped returns the number of events lost to BackpressureDrop.
+func (s *Subscription) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// send delivers event according to the policy of the subscription and
+// reports whether the subscriber has to be disconnected.
+func (s *Subscription) send(event Event) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+
+	select {
+	case s.ch <- event:
+		return false
+	default:
+	}
+
+	switch s.options.Policy {
+	case BackpressureBlock:
+		select {
+		case s.ch <- event:
+		case <-s.done:
+		}
+	case BackpressureDrop:
+		atomic.AddInt64(&s.dropped, 1)
+	case BackpressureDisconnect:
+		return true
+	}
+	return false
+}
+
+// close closes C once no event is being sent on it.
+func (s *Subscription) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.ch)
+	}
+}
+
+func (s *Subscription) wants(event Event) bool {
+	if s.options.AccountID != 0 && s.options.AccountID != event.AccountID {
+		return false
+	}
+	if len(s.options.Types) == 0 {
+		return true
+	}
+	for _, eventType := range s.options.Types {
+		if eventType == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+type eventBus struct {
+	mu            sync.Mutex
+	seq           int64
+	subscriptions []*Subscription
+	store         EventStore
+}
+
+func (s *Service) bus() *eventBus {
+	if s.events == nil {
+		s.events = &eventBus{}
+	}
+	return s.events
+}
+
+func (s *Service) Subscribe(options SubscribeOptions) *Subscription {
+	if options.Buffer <= 0 {
+		options.Buffer = defaultEventBuffer
+	}
+	ch := make(chan Event, options.Buffer)
+	subscription := &Subscription{C: ch, ch: ch, done: make(chan struct{}), options: options}
+
+	bus := s.bus()
+	bus.mu.Lock()
+	bus.subscriptions = append(bus.subscriptions, subscription)
+	bus.mu.Unlock()
+	return subscription
+}
+
+// Unsubscribe stops the subscription and closes its channel. It also releases
+// a mutation blocked on the subscription.
+func (s *Service) Unsubscribe(subscription *Subscription) {
+	subscription.once.Do(func() {
+		close(subscription.done)
+	})
+
+	bus := s.bus()
+	bus.mu.Lock()
+	bus.remove(subscription)
+	bus.mu.Unlock()
+	subscription.close()
+}
+
+func (b *eventBus) remove(subscription *Subscription) {
+	for i, current := range b.subscriptions {
+		if current == subscription {
+			b.subscriptions = append(b.subscriptions[:i], b.subscriptions[i+1:]...)
+			return
+		}
+	}
+}
+
+// emit numbers event and appends it to the event store before apply makes
+// the change it describes, so a command whose event can not be stored fails
+// without changing anything. The event is then published.
+func (s *Service) emit(event Event, apply func()) error {
+	return s.emitAll([]Event{event}, apply)
+}
+
+// emitAll is emit for the events of one change, which are stored together.
+func (s *Service) emitAll(events []Event, apply func()) error {
+	bus := s.bus()
+	bus.mu.Lock()
+	now := s.clock()
+	for i := range events {
+		events[i].Seq = bus.seq + int64(i) + 1
+		events[i].Time = now
+	}
+	if bus.store != nil && len(events) > 0 {
+		if err := bus.store.Append(events...); err != nil {
+			bus.mu.Unlock()
+			return err
+		}
+	}
+	bus.seq += int64(len(events))
+	bus.mu.Unlock()
+
+	apply()
+	for _, event := range events {
+		s.publish(event)
+	}
+	return nil
+}
+
+// publish records the balance change event carries and hands it to every
+// interested subscriber. Events are delivered one at a time without holding
+// the bus, so a blocked subscriber never holds up Subscribe or Unsubscribe;
+// mutations are not concurrent, which keeps them in order.
+func (s *Service) publish(event Event) {
+	s.recordBalance(event)
+
+	bus := s.bus()
+	bus.mu.Lock()
+	subscriptions := append([]*Subscription(nil), bus.subscriptions...)
+	bus.mu.Unlock()
+
+	for _, subscription := range subscriptions {
+		if subscription.wants(event) && subscription.send(event) {
+			s.Unsubscribe(subscription)
+		}
+	}
+}
+
+func accountEvent(eventType EventType, account *types.Account, change types.Money) Event {
+	snapshot := *account
+	return Event{
+		Type:      eventType,
+		AccountID: account.ID,
+		Amount:    change,
+		Balance:   account.Balance,
+		Account:   &snapshot,
+	}
+}
+
+// paymentEvent and favoriteEvent accept a nil account, which leaves Balance
+// at zero.
+func paymentEvent(eventType EventType, account *types.Account, payment *types.Payment, change types.Money) Event {
+	snapshot := *payment
+	event := Event{
+		Type:      eventType,
+		AccountID: payment.AccountID,
+		Amount:    change,
+		Payment:   &snapshot,
+	}
+	if account != nil {
+		event.Balance = account.Balance
+	}
+	return event
+}
+
+func favoriteEvent(eventType EventType, account *types.Account, favorite *types.Favorite) Event {
+	snapshot := *favorite
+	event := Event{
+		Type:      eventType,
+		AccountID: favorite.AccountID,
+		Favorite:  &snapshot,
+	}
+	if account != nil {
+		event.Balance = account.Balance
+	}
+	return event
+}
@@ -0,0 +1,114 @@
+package wallet
+
+import (
+	"github.com/bdaler/wallet/pkg/types"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func receiveEvents(t *testing.T, subscription *Subscription, count int) []Event {
+	t.Helper()
+	var events []Event
+	for len(events) < count {
+		select {
+		case event, ok := <-subscription.C:
+			if !ok {
+				t.Fatalf("subscription closed after %d events", len(events))
+			}
+			events = append(events, event)
+		case <-time.After(time.Second):
+			t.Fatalf("got %d events, want %d", len(events), count)
+		}
+	}
+	return events
+}
+
+func TestService_Subscribe(t *testing.T) {
+	s := newTestService()
+	all := s.Subscribe(SubscribeOptions{})
+	second := s.Subscribe(SubscribeOptions{AccountID: 2, Types: []EventType{EventDeposited, EventPaymentCreated}})
+
+	account1, _ := s.AddAccountWithBalance("9127660305", 100)
+	account2, _ := s.AddAccountWithBalance("9127660306", 50)
+	payment, _ := s.Pay(account1.ID, 30, types.CategoryIt)
+	_, _ = s.Pay(account2.ID, 20, types.CategoryIt)
+	_, _ = s.FavoritePayment(payment.ID, "internet")
+	_ = s.Reject(payment.ID)
+
+	var got []EventType
+	for i, event := range receiveEvents(t, all, 8) {
+		got = append(got, event.Type)
+		if event.Seq != int64(i+1) {
+			t.Errorf("Subscribe() event %d has seq %d", i, event.Seq)
+		}
+	}
+	want := []EventType{
+		EventAccountRegistered, EventDeposited,
+		EventAccountRegistered, EventDeposited,
+		EventPaymentCreated, EventPaymentCreated,
+		EventFavoriteCreated, EventPaymentRejected,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Subscribe() got = %v, want %v", got, want)
+	}
+
+	events := receiveEvents(t, second, 2)
+	if events[0].Amount != 50 || events[1].Amount != -20 || events[1].Balance != 30 || events[1].Payment.Status != types.PaymentStatusInProgress {
+		t.Errorf("Subscribe() filtered events = %+v", events)
+	}
+
+	s.Unsubscribe(all)
+	s.Unsubscribe(second)
+	if _, ok := <-all.C; ok {
+		t.Error("Unsubscribe() did not close the channel")
+	}
+}
+
+func TestService_Subscribe_backpressure(t *testing.T) {
+	s := newTestService()
+	dropping := s.Subscribe(SubscribeOptions{Buffer: 1, Policy: BackpressureDrop})
+	disconnected := s.Subscribe(SubscribeOptions{Buffer: 1, Policy: BackpressureDisconnect})
+
+	account, _ := s.RegisterAccount("9127660305")
+	_ = s.Deposit(account.ID, 10)
+	_ = s.Deposit(account.ID, 20)
+
+	if dropping.Dropped() != 2 {
+		t.Errorf("Dropped() got = %d, want 2", dropping.Dropped())
+	}
+	if event := <-dropping.C; event.Type != EventAccountRegistered {
+		t.Errorf("BackpressureDrop kept %v, want the first event", event.Type)
+	}
+	<-disconnected.C
+	if _, ok := <-disconnected.C; ok {
+		t.Error("BackpressureDisconnect did not close the channel")
+	}
+	s.Unsubscribe(disconnected)
+
+	blocking := s.Subscribe(SubscribeOptions{Buffer: 1})
+	done := make(chan struct{})
+	go func() {
+		_ = s.Deposit(account.ID, 1)
+		_ = s.Deposit(account.ID, 2)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("BackpressureBlock did not block the mutation")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	subscribed := make(chan *Subscription)
+	go func() {
+		subscribed <- s.Subscribe(SubscribeOptions{})
+	}()
+	select {
+	case other := <-subscribed:
+		s.Unsubscribe(other)
+	case <-time.After(time.Second):
+		t.Fatal("Subscribe() waited for a blocked subscriber")
+	}
+	s.Unsubscribe(blocking)
+	<-done
+}
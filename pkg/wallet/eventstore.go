@@ -0,0 +1,341 @@
+package wallet
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/bdaler/wallet/pkg/types"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrNoEventStore = errors.New("no event store")
+
+// EventStore keeps every event published by the service, in sequence order.
+// Append stores either all of events or none of them.
+type EventStore interface {
+	Append(events ...Event) error
+	Events() ([]Event, error)
+}
+
+// Projection is the state of the service rebuilt from its events. Seq is the
+// sequence number of the last event applied.
+type Projection struct {
+	Seq           int64
+	Accounts      []types.Account
+	Payments      []types.Payment
+	Favorites     []types.Favorite
+	Categories    []types.Category
+	FeeRules      []types.FeeRule
+	CashbackRules []types.CashbackRule
+	Cashbacks     []types.Cashback
+	Refunds       []types.Refund
+}
+
+// SetEventStore makes the service append the events of every command to store
+// before the command changes anything. A command whose events the store can
+// not append fails with the error of the store. Events keep numbering after
+// the last event already in the store.
+func (s *Service) SetEventStore(store EventStore) error {
+	bus := s.bus()
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	bus.store = store
+	if store == nil {
+		return nil
+	}
+
+	events, err := store.Events()
+	if err != nil {
+		bus.store = nil
+		return err
+	}
+	if len(events) > 0 && events[len(events)-1].Seq > bus.seq {
+		bus.seq = events[len(events)-1].Seq
+	}
+
+	// The balance history is derived from the stored events, followed by
+	// the changes the service recorded before it had the store.
+	recorded := s.balances
+	s.balances = nil
+	for _, event := range events {
+		s.recordBalance(event)
+	}
+	for accountID, changes := range recorded {
+		if s.balances == nil {
+			s.balances = make(map[int64][]types.BalanceChange)
+		}
+		s.balances[accountID] = append(s.balances[accountID], changes...)
+	}
+	return nil
+}
+
+// NewEventSourcedService returns a service whose state is rebuilt from the
+// events in store and which appends its new events to store.
+func NewEventSourcedService(store EventStore) (*Service, error) {
+	s := &Service{}
+	if err := s.SetEventStore(store); err != nil {
+		return nil, err
+	}
+	if err := s.Rebuild(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Project rebuilds the current state from the event store.
+func (s *Service) Project() (*Projection, error) {
+	return s.project(func(event Event) bool {
+		return true
+	})
+}
+
+// ProjectAt rebuilds the state as it was at t.
+func (s *Service) ProjectAt(t time.Time) (*Projection, error) {
+	return s.project(func(event Event) bool {
+		return !event.Time.After(t)
+	})
+}
+
+// ProjectUntil rebuilds the state as it was after the event with sequence
+// number seq.
+func (s *Service) ProjectUntil(seq int64) (*Projection, error) {
+	return s.project(func(event Event) bool {
+		return event.Seq <= seq
+	})
+}
+
+// Rebuild replaces the accounts, payments, favorites, categories, fee and
+// cashback rules, cashbacks, refunds and balance history of the service with
+// the projection of all stored events.
+func (s *Service) Rebuild() error {
+	store := s.eventStore()
+	if store == nil {
+		return ErrNoEventStore
+	}
+
+	events, err := store.Events()
+	if err != nil {
+		return err
+	}
+
+	p := newProjector()
+	s.balances = nil
+	for _, event := range events {
+		p.apply(event)
+		s.recordBalance(event)
+	}
+	projection := p.projection
+
+	s.accounts = make([]*types.Account, 0, len(projection.Accounts))
+	s.nextAccountID = 0
+	for i := range projection.Accounts {
+		account := projection.Accounts[i]
+		s.accounts = append(s.accounts, &account)
+		if account.ID > s.nextAccountID {
+			s.nextAccountID = account.ID
+		}
+	}
+	s.payments = pointers(projection.Payments)
+	s.favorites = pointers(projection.Favorites)
+	s.categories = pointers(projection.Categories)
+	s.feeRules = pointers(projection.FeeRules)
+	s.cashbackRules = pointers(projection.CashbackRules)
+	s.cashbacks = pointers(projection.Cashbacks)
+	s.refunds = pointers(projection.Refunds)
+	return nil
+}
+
+// pointers returns pointers to copies of items.
+func pointers[T any](items []T) []*T {
+	copies := make([]*T, 0, len(items))
+	for i := range items {
+		item := items[i]
+		copies = append(copies, &item)
+	}
+	return copies
+}
+
+func (s *Service) project(include func(event Event) bool) (*Projection, error) {
+	store := s.eventStore()
+	if store == nil {
+		return nil, ErrNoEventStore
+	}
+
+	events, err := store.Events()
+	if err != nil {
+		return nil, err
+	}
+
+	p := newProjector()
+	for _, event := range events {
+		if include(event) {
+			p.apply(event)
+		}
+	}
+	return p.projection, nil
+}
+
+func (s *Service) eventStore() EventStore {
+	bus := s.bus()
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	return bus.store
+}
+
+type projector struct {
+	projection    *Projection
+	accounts      map[int64]int
+	payments      map[string]int
+	favorites     map[string]int
+	categories    map[types.PaymentCategory]int
+	feeRules      map[string]int
+	cashbackRules map[string]int
+	cashbacks     map[string]int
+}
+
+func newProjector() *projector {
+	return &projector{
+		projection:    &Projection{},
+		accounts:      make(map[int64]int),
+		payments:      make(map[string]int),
+		favorites:     make(map[string]int),
+		categories:    make(map[types.PaymentCategory]int),
+		feeRules:      make(map[string]int),
+		cashbackRules: make(map[string]int),
+		cashbacks:     make(map[string]int),
+	}
+}
+
+// apply upserts the snapshots carried by event, or removes the rule of a
+// removal event. Every account event but an import one also sets the balance
+// its account has after the event.
+func (p *projector) apply(event Event) {
+	projection := p.projection
+	if event.Account != nil {
+		projection.Accounts = upsert(projection.Accounts, p.accounts, event.Account.ID, *event.Account)
+	}
+	if event.Payment != nil {
+		projection.Payments = upsert(projection.Payments, p.payments, event.Payment.ID, *event.Payment)
+	}
+	if event.Favorite != nil {
+		projection.Favorites = upsert(projection.Favorites, p.favorites, event.Favorite.ID, *event.Favorite)
+	}
+	if event.Refund != nil {
+		projection.Refunds = append(projection.Refunds, *event.Refund)
+	}
+	for _, cashback := range event.Cashbacks {
+		projection.Cashbacks = upsert(projection.Cashbacks, p.cashbacks, cashback.ID, cashback)
+	}
+	if event.Category != nil {
+		projection.Categories = upsert(projection.Categories, p.categories, event.Category.ID, *event.Category)
+	}
+
+	switch event.Type {
+	case EventFeeRuleAdded:
+		projection.FeeRules = upsert(projection.FeeRules, p.feeRules, event.FeeRule.ID, *event.FeeRule)
+	case EventFeeRuleRemoved:
+		projection.FeeRules = remove(projection.FeeRules, p.feeRules, event.FeeRule.ID)
+	case EventCashbackRuleAdded:
+		projection.CashbackRules = upsert(projection.CashbackRules, p.cashbackRules, event.CashbackRule.ID, *event.CashbackRule)
+	case EventCashbackRuleRemoved:
+		projection.CashbackRules = remove(projection.CashbackRules, p.cashbackRules, event.CashbackRule.ID)
+	case EventAccountImported, EventPaymentImported, EventFavoriteImported:
+	default:
+		if i, ok := p.accounts[event.AccountID]; ok {
+			projection.Accounts[i].Balance = event.Balance
+		}
+	}
+	projection.Seq = event.Seq
+}
+
+// upsert replaces the item of items with key, found through index, or
+// appends item.
+func upsert[K comparable, T any](items []T, index map[K]int, key K, item T) []T {
+	if i, ok := index[key]; ok {
+		items[i] = item
+		return items
+	}
+	index[key] = len(items)
+	return append(items, item)
+}
+
+func remove[K comparable, T any](items []T, index map[K]int, key K) []T {
+	i, ok := index[key]
+	if !ok {
+		return items
+	}
+	delete(index, key)
+	for other, j := range index {
+		if j > i {
+			index[other] = j - 1
+		}
+	}
+	return append(items[:i], items[i+1:]...)
+}
+
+type MemoryEventStore struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (m *MemoryEventStore) Append(events ...Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, events...)
+	return nil
+}
+
+func (m *MemoryEventStore) Events() ([]Event, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Event(nil), m.events...), nil
+}
+
+// FileEventStore keeps the events in a JSON Lines file, one event per line,
+// each synced to disk before Append returns.
+type FileEventStore struct {
+	mu     sync.Mutex
+	memory MemoryEventStore
+	file   *os.File
+}
+
+func OpenFileEventStore(path string) (*FileEventStore, error) {
+	store := &FileEventStore{}
+	file, err := openLogFile(path, "event store", func(line []byte) error {
+		event := Event{}
+		if err := json.Unmarshal(line, &event); err != nil {
+			return err
+		}
+		store.memory.events = append(store.memory.events, event)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	store.file = file
+	return store, nil
+}
+
+func (f *FileEventStore) Append(events ...Event) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	lines := make([]interface{}, 0, len(events))
+	for _, event := range events {
+		lines = append(lines, event)
+	}
+	if err := appendLogLines(f.file, lines...); err != nil {
+		return err
+	}
+	return f.memory.Append(events...)
+}
+
+func (f *FileEventStore) Events() ([]Event, error) {
+	return f.memory.Events()
+}
+
+func (f *FileEventStore) Close() error {
+	return f.file.Close()
+}
@@ -0,0 +1,231 @@
+package wallet
+
+import (
+	"errors"
+	"github.com/bdaler/wallet/pkg/types"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestService_Rebuild(t *testing.T) {
+	s := newTestService()
+	store := &MemoryEventStore{}
+	if err := s.SetEventStore(store); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	account, _ := s.AddAccountWithBalance("9127660305", 100)
+	payment, _ := s.Pay(account.ID, 30, types.CategoryIt)
+	_, _ = s.FavoritePayment(payment.ID, "internet")
+	seq := s.bus().seq
+	now = now.Add(time.Hour)
+	_ = s.Reject(payment.ID)
+	_, _ = s.RegisterAccount("9127660306")
+
+	rebuilt, err := NewEventSourcedService(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rebuilt.accounts, s.accounts) || !reflect.DeepEqual(rebuilt.payments, s.payments) || !reflect.DeepEqual(rebuilt.favorites, s.favorites) {
+		t.Errorf("Rebuild() state differs from the service")
+	}
+	if !reflect.DeepEqual(rebuilt.BalanceHistory(account.ID), s.BalanceHistory(account.ID)) {
+		t.Errorf("Rebuild() balance history differs from the service")
+	}
+	if next, _ := rebuilt.RegisterAccount("9127660307"); next.ID != 3 {
+		t.Errorf("Rebuild() next account ID = %d, want 3", next.ID)
+	}
+
+	projection, err := s.ProjectUntil(seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if projection.Seq != seq || len(projection.Accounts) != 1 || projection.Accounts[0].Balance != 70 || projection.Payments[0].Status != types.PaymentStatusInProgress || len(projection.Favorites) != 1 {
+		t.Errorf("ProjectUntil() = %+v", projection)
+	}
+
+	projection, err = s.ProjectAt(now.Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if projection.Seq != seq {
+		t.Errorf("ProjectAt() seq = %d, want %d", projection.Seq, seq)
+	}
+}
+
+func TestService_Rebuild_import(t *testing.T) {
+	s := newTestService()
+	account, _ := s.AddAccountWithBalance("9127660305", 100)
+	payment, _ := s.Pay(account.ID, 30, types.CategoryIt)
+	_, _ = s.FavoritePayment(payment.ID, "internet")
+	dir := t.TempDir()
+	if err := s.Export(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	imported := newTestService()
+	store := &MemoryEventStore{}
+	_ = imported.SetEventStore(store)
+	if err := imported.Import(dir); err != nil {
+		t.Fatal(err)
+	}
+	_ = imported.Reject(payment.ID)
+
+	rebuilt, err := NewEventSourcedService(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rebuilt.accounts, imported.accounts) || !reflect.DeepEqual(rebuilt.payments, imported.payments) || !reflect.DeepEqual(rebuilt.favorites, imported.favorites) {
+		t.Errorf("Rebuild() after import differs from the service")
+	}
+}
+
+func TestService_Rebuild_configuration(t *testing.T) {
+	s := newTestService()
+	store := &MemoryEventStore{}
+	_ = s.SetEventStore(store)
+	_ = s.RegisterDefaultCategories()
+	_ = s.SetCategoryActive(types.CategoryShop, false)
+	removed, _ := s.AddFeeRule(types.FeeRule{Fixed: 5})
+	_, _ = s.AddFeeRule(types.FeeRule{Category: types.CategoryIt, Fixed: 1})
+	_ = s.RemoveFeeRule(removed.ID)
+	_, _ = s.AddCashbackRule(types.CategoryIt, 1_000, 0, 0)
+
+	account, _ := s.AddAccountWithBalance("9127660305", 100)
+	payment, _ := s.Pay(account.ID, 50, types.CategoryIt)
+	_ = s.Complete(payment.ID)
+	_, _ = s.Refund(payment.ID, 20)
+
+	rebuilt, err := NewEventSourcedService(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rebuilt.categories, s.categories) || !reflect.DeepEqual(rebuilt.feeRules, s.feeRules) || !reflect.DeepEqual(rebuilt.cashbackRules, s.cashbackRules) {
+		t.Errorf("Rebuild() configuration differs from the service")
+	}
+	if !reflect.DeepEqual(rebuilt.cashbacks, s.cashbacks) || !reflect.DeepEqual(rebuilt.refunds, s.refunds) || !reflect.DeepEqual(rebuilt.accounts, s.accounts) {
+		t.Errorf("Rebuild() cashbacks = %v, refunds = %v", rebuilt.cashbacks, rebuilt.refunds)
+	}
+	if len(s.feeRules) != 1 || len(s.cashbacks) != 1 || len(s.refunds) != 1 {
+		t.Errorf("fee rules = %v, cashbacks = %v, refunds = %v", s.feeRules, s.cashbacks, s.refunds)
+	}
+}
+
+type failingEventStore struct {
+	MemoryEventStore
+	err error
+}
+
+func (f *failingEventStore) Append(events ...Event) error {
+	return f.err
+}
+
+func TestService_SetEventStore_appendError(t *testing.T) {
+	s := newTestService()
+	account, _ := s.AddAccountWithBalance("9127660305", 100)
+	subscription := s.Subscribe(SubscribeOptions{})
+	errDisk := errors.New("disk error")
+	_ = s.SetEventStore(&failingEventStore{err: errDisk})
+
+	if err := s.Deposit(account.ID, 10); err != errDisk {
+		t.Errorf("Deposit() error = %v, want %v", err, errDisk)
+	}
+	if _, err := s.Pay(account.ID, 10, types.CategoryIt); err != errDisk {
+		t.Errorf("Pay() error = %v, want %v", err, errDisk)
+	}
+	if _, err := s.RegisterAccount("9127660306"); err != errDisk {
+		t.Errorf("RegisterAccount() error = %v, want %v", err, errDisk)
+	}
+	if account.Balance != 100 || len(s.payments) != 0 || len(s.accounts) != 1 || s.nextAccountID != 1 {
+		t.Errorf("failed commands changed the service: balance = %d, payments = %v, accounts = %v", account.Balance, s.payments, s.accounts)
+	}
+	if len(subscription.C) != 0 {
+		t.Errorf("failed commands published %d events", len(subscription.C))
+	}
+}
+
+func TestFileEventStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	store, err := OpenFileEventStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestService()
+	_ = s.SetEventStore(store)
+	account, _ := s.AddAccountWithBalance("9127660305", 100)
+	_, _ = s.Pay(account.ID, 30, types.CategoryIt)
+	_ = store.Close()
+
+	store, err = OpenFileEventStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	rebuilt, err := NewEventSourcedService(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rebuilt.accounts) != 1 || rebuilt.accounts[0].Balance != 70 || len(rebuilt.payments) != 1 {
+		t.Errorf("NewEventSourcedService() accounts = %v, payments = %v", rebuilt.accounts, rebuilt.payments)
+	}
+
+	_ = rebuilt.Deposit(account.ID, 5)
+	events, _ := store.Events()
+	if len(events) != 4 || events[3].Seq != 4 {
+		t.Errorf("Events() = %+v", events)
+	}
+}
+
+func TestFileEventStore_tornLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	store, err := OpenFileEventStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestService()
+	_ = s.SetEventStore(store)
+	account, _ := s.AddAccountWithBalance("9127660305", 100)
+	_ = store.Close()
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = file.WriteString(`{"seq":3,"type":"Depos`)
+	_ = file.Close()
+
+	store, err = OpenFileEventStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rebuilt, err := NewEventSourcedService(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rebuilt.Deposit(account.ID, 5); err != nil {
+		t.Fatal(err)
+	}
+	_ = store.Close()
+
+	store, err = OpenFileEventStore(path)
+	if err != nil {
+		t.Fatalf("OpenFileEventStore() after torn line error = %v", err)
+	}
+	defer store.Close()
+	events, _ := store.Events()
+	if len(events) != 3 || events[2].Type != EventDeposited || events[2].Amount != 5 {
+		t.Errorf("Events() = %+v", events)
+	}
+}
+
+func TestService_Project_noStore(t *testing.T) {
+	s := newTestService()
+	if _, err := s.Project(); err != ErrNoEventStore {
+		t.Errorf("Project() error = %v, want %v", err, ErrNoEventStore)
+	}
+}
@@ -0,0 +1,219 @@
+package wallet
+
+import (
+	"errors"
+	"github.com/bdaler/wallet/pkg/types"
+	"github.com/google/uuid"
+	"sort"
+)
+
+var ErrInvalidFeeRule = errors.New("invalid fee rule")
+var ErrFeeRuleNotFound = errors.New("fee rule not found")
+var ErrRefundExceedsPayment = errors.New("refund exceeds payment amount")
+
+func (s *Service) AddFeeRule(rule types.FeeRule) (*types.FeeRule, error) {
+	if rule.Fixed < 0 || rule.BasisPoints < 0 || rule.Min < 0 || rule.Max < 0 {
+		return nil, ErrInvalidFeeRule
+	}
+	if rule.Max > 0 && rule.Max < rule.Min {
+		return nil, ErrInvalidFeeRule
+	}
+	for _, tier := range rule.Tiers {
+		if tier.From < 0 || tier.Fixed < 0 || tier.BasisPoints < 0 {
+			return nil, ErrInvalidFeeRule
+		}
+	}
+
+	if rule.Category != "" && len(s.categories) > 0 {
+		if _, err := s.FindCategoryByID(rule.Category); err != nil {
+			return nil, err
+		}
+	}
+
+	tiers := append([]types.FeeTier(nil), rule.Tiers...)
+	sort.Slice(tiers, func(i, j int) bool {
+		return tiers[i].From < tiers[j].From
+	})
+
+	rule.ID = uuid.New().String()
+	rule.Tiers = tiers
+	snapshot := rule
+	err := s.emit(Event{Type: EventFeeRuleAdded, FeeRule: &snapshot}, func() {
+		s.feeRules = append(s.feeRules, &rule)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+func (s *Service) RemoveFeeRule(ruleID string) error {
+	for i, rule := range s.feeRules {
+		if rule.ID == ruleID {
+			snapshot := *rule
+			return s.emit(Event{Type: EventFeeRuleRemoved, FeeRule: &snapshot}, func() {
+				s.feeRules = append(s.feeRules[:i], s.feeRules[i+1:]...)
+			})
+		}
+	}
+	return ErrFeeRuleNotFound
+}
+
+// findFeeRule picks the rule of the most specific category and falls back
+// to a rule without category.
+func (s *Service) findFeeRule(category types.PaymentCategory) *types.FeeRule {
+	for _, id := range append(s.categoryPath(category), "") {
+		for _, rule := range s.feeRules {
+			if rule.Category == id {
+				return rule
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Service) CalculateFee(amount types.Money, category types.PaymentCategory) types.Money {
+	rule := s.findFeeRule(category)
+	if rule == nil {
+		return 0
+	}
+
+	fixed, basisPoints := rule.Fixed, rule.BasisPoints
+	for _, tier := range rule.Tiers {
+		if amount < tier.From {
+			break
+		}
+		fixed, basisPoints = tier.Fixed, tier.BasisPoints
+	}
+
+	fee := fixed + amount*types.Money(basisPoints)/10_000
+	if fee < rule.Min {
+		fee = rule.Min
+	}
+	if rule.Max > 0 && fee > rule.Max {
+		fee = rule.Max
+	}
+	return fee
+}
+
+func (s *Service) Refund(paymentID string, amount types.Money) (*types.Refund, error) {
+	if amount <= 0 {
+		return nil, ErrAmountMustBePositive
+	}
+
+	payment, err := s.FindPaymentByID(paymentID)
+	if err != nil {
+		return nil, err
+	}
+
+	if payment.Status == types.PaymentStatusFail {
+		return nil, ErrPaymentAlreadyRejected
+	}
+	if payment.Status == types.PaymentStatusPending {
+		return nil, ErrPaymentPending
+	}
+	if payment.Status == types.PaymentStatusHeld {
+		return nil, ErrPaymentHeld
+	}
+
+	remaining := payment.Amount - s.refundedAmount(payment.ID)
+	if amount > remaining {
+		return nil, ErrRefundExceedsPayment
+	}
+
+	account, err := s.FindAccountByID(payment.AccountID)
+	if err != nil {
+		return nil, err
+	}
+
+	refunded := *payment
+	if amount < remaining {
+		return s.emitRefund(EventPaymentRefunded, account, payment, refunded, amount)
+	}
+
+	refunded.Status = types.PaymentStatusFail
+	var refund *types.Refund
+	err = s.withOutbox(EventPaymentRefunded, refunded, func() error {
+		refund, err = s.emitRefund(EventPaymentRefunded, account, payment, refunded, amount)
+		return err
+	})
+	return refund, err
+}
+
+func (s *Service) Refunds(paymentID string) []types.Refund {
+	var refunds []types.Refund
+	for _, refund := range s.refunds {
+		if refund.PaymentID == paymentID {
+			refunds = append(refunds, *refund)
+		}
+	}
+	return refunds
+}
+
+func (s *Service) refundedAmount(paymentID string) types.Money {
+	refunded := types.Money(0)
+	for _, refund := range s.refunds {
+		if refund.PaymentID == paymentID {
+			refunded += refund.Amount
+		}
+	}
+	return refunded
+}
+
+// newRefund returns a refund of amount and the proportional part of the
+// payment fee, or nil for nothing to refund. The fee share is computed on
+// cumulative totals so that rounding never loses money once the payment is
+// refunded in full.
+func (s *Service) newRefund(payment *types.Payment, amount types.Money) *types.Refund {
+	if amount <= 0 {
+		return nil
+	}
+
+	refunded := s.refundedAmount(payment.ID)
+	fee := payment.Fee*(refunded+amount)/payment.Amount - payment.Fee*refunded/payment.Amount
+
+	return &types.Refund{
+		ID:        uuid.New().String(),
+		PaymentID: payment.ID,
+		AccountID: payment.AccountID,
+		Amount:    amount,
+		Fee:       fee,
+	}
+}
+
+// emitRefund gives amount of payment back to account, after which the payment
+// becomes updated. A payment that fails also settles its cashbacks.
+func (s *Service) emitRefund(eventType EventType, account *types.Account, payment *types.Payment, updated types.Payment, amount types.Money) (*types.Refund, error) {
+	refunded := *account
+	refund := s.newRefund(payment, amount)
+	if refund != nil {
+		refunded.Balance += refund.Amount + refund.Fee
+	}
+	var cashbacks []types.Cashback
+	if updated.Status == types.PaymentStatusFail {
+		var change types.Money
+		cashbacks, change = s.settleCashbacks(payment.ID, false)
+		refunded.Balance += change
+	}
+
+	event := paymentEvent(eventType, &refunded, &updated, refunded.Balance-account.Balance)
+	event.Cashbacks = cashbacks
+	if refund != nil {
+		snapshot := *refund
+		event.Refund = &snapshot
+	}
+	err := s.emit(event, func() {
+		account.Balance = refunded.Balance
+		*payment = updated
+		if refund != nil {
+			s.refunds = append(s.refunds, refund)
+		}
+		s.saveCashbacks(cashbacks)
+		s.touchAccount(account.ID)
+		s.touchPayment(payment.ID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return refund, nil
+}
@@ -0,0 +1,78 @@
+package wallet
+
+import (
+	"github.com/bdaler/wallet/pkg/types"
+	"testing"
+)
+
+func TestService_CalculateFee(t *testing.T) {
+	s := newTestService()
+	_, _ = s.AddFeeRule(types.FeeRule{Fixed: 5, BasisPoints: 100, Max: 50})
+	_, _ = s.AddFeeRule(types.FeeRule{
+		Category: types.CategoryIt,
+		Tiers: []types.FeeTier{
+			{From: 1_000, BasisPoints: 50},
+			{From: 0, Fixed: 10},
+		},
+	})
+	_, _ = s.AddFeeRule(types.FeeRule{Category: types.CategoryShop, BasisPoints: 10, Min: 3})
+
+	tests := []struct {
+		name     string
+		amount   types.Money
+		category types.PaymentCategory
+		want     types.Money
+	}{
+		{name: "fixed and percentage", amount: 1_000, category: types.CategoryFood, want: 15},
+		{name: "capped by max", amount: 10_000, category: types.CategoryFood, want: 50},
+		{name: "lower tier", amount: 500, category: types.CategoryIt, want: 10},
+		{name: "upper tier", amount: 2_000, category: types.CategoryIt, want: 10},
+		{name: "raised to min", amount: 100, category: types.CategoryShop, want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.CalculateFee(tt.amount, tt.category); got != tt.want {
+				t.Errorf("CalculateFee() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestService_Refund_fee(t *testing.T) {
+	s := newTestService()
+	account, _ := s.AddAccountWithBalance("9127660305", 1_000)
+	_, _ = s.AddFeeRule(types.FeeRule{Fixed: 10})
+
+	_, err := s.Pay(account.ID, 995, types.CategoryFood)
+	if err != ErrNotEnoughBalance {
+		t.Errorf("Pay() error = %v, want %v", err, ErrNotEnoughBalance)
+	}
+
+	payment, err := s.Pay(account.ID, 300, types.CategoryFood)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.Fee != 10 || account.Balance != 690 {
+		t.Errorf("Pay() fee = %v, balance = %v", payment.Fee, account.Balance)
+	}
+
+	refund, err := s.Refund(payment.ID, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refund.Fee != 3 || account.Balance != 793 {
+		t.Errorf("Refund() fee = %v, balance = %v", refund.Fee, account.Balance)
+	}
+
+	if err = s.Reject(payment.ID); err != nil {
+		t.Fatal(err)
+	}
+	if account.Balance != 1_000 {
+		t.Errorf("balance after reject = %v, want 1000", account.Balance)
+	}
+
+	_, err = s.Refund(payment.ID, 1)
+	if err != ErrPaymentAlreadyRejected {
+		t.Errorf("Refund() error = %v, want %v", err, ErrPaymentAlreadyRejected)
+	}
+}
@@ -0,0 +1,160 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bdaler/wallet/pkg/types"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidChunkSize = errors.New("records per file must be greater than zero")
+var ErrHistoryChecksum = errors.New("history chunk checksum mismatch")
+
+const historyManifestName = "payments.manifest.json"
+
+type HistoryManifest struct {
+	Version int            `json:"version"`
+	Created time.Time      `json:"created"`
+	Records int            `json:"records"`
+	Files   []ManifestFile `json:"files"`
+}
+
+// HistoryToFiles writes payments to payments1.dump, payments2.dump, ... with
+// at most records payments per file and lists the chunks in
+// payments.manifest.json. Chunks are replaced atomically and the manifest is
+// written last, so readers never see a partially written history. Chunks of
+// an earlier, longer history are removed afterwards.
+func (s *Service) HistoryToFiles(payments []types.Payment, dir string, records int) error {
+	return s.historyToFiles(context.Background(), payments, dir, records)
+}
+
+func (s *Service) historyToFiles(ctx context.Context, payments []types.Payment, dir string, records int) error {
+	if records <= 0 {
+		return ErrInvalidChunkSize
+	}
+
+	chunks := chunkPayments(payments, records)
+	dumps := make([]dumpFile, 0, len(chunks))
+	for i, chunk := range chunks {
+		dump := dumpFile{
+			name:   "payments" + strconv.Itoa(i+1) + ".dump",
+			entity: entityPayments,
+		}
+		for j := range chunk {
+			dump.records = append(dump.records, paymentRecord(&chunk[j]))
+		}
+		dumps = append(dumps, dump)
+	}
+
+	created := s.clock()
+	files, err := writeDumpFiles(ctx, dir, created, dumps)
+	if err != nil {
+		return err
+	}
+
+	manifest := HistoryManifest{
+		Version: DumpVersion,
+		Created: created.UTC(),
+		Records: len(payments),
+		Files:   files,
+	}
+	if err = writeManifest(dir, historyManifestName, manifest); err != nil {
+		return err
+	}
+	return removeStaleChunks(dir, ".dump", len(dumps))
+}
+
+// removeStaleChunks deletes the chunks past the first count left in dir by
+// an earlier, longer history with the extension ext.
+func removeStaleChunks(dir string, ext string, count int) error {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		number := strings.TrimSuffix(strings.TrimPrefix(file.Name(), "payments"), ext)
+		n, err := strconv.Atoi(number)
+		if err != nil || n <= count || file.Name() != "payments"+strconv.Itoa(n)+ext || file.IsDir() {
+			continue
+		}
+		if err = os.Remove(filepath.Join(dir, file.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HistoryFromFiles reads the history written by HistoryToFiles back in its
+// original order, verifying every chunk against the manifest.
+func HistoryFromFiles(dir string) ([]types.Payment, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, historyManifestName))
+	if err != nil {
+		return nil, err
+	}
+	manifest := HistoryManifest{}
+	if err = json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Version < 1 || manifest.Version > DumpVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedDumpVersion, manifest.Version)
+	}
+
+	payments := make([]types.Payment, 0, manifest.Records)
+	for _, file := range manifest.Files {
+		content, err := ioutil.ReadFile(filepath.Join(dir, file.Name))
+		if err != nil {
+			return nil, err
+		}
+		if !file.verify(content) {
+			return nil, fmt.Errorf("%w: %s", ErrHistoryChecksum, file.Name)
+		}
+
+		reader := newDumpReader(bytes.NewReader(content))
+		for {
+			item, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err == nil {
+				var payment *types.Payment
+				payment, err = parsePayment(item, manifest.Version)
+				if err == nil {
+					payments = append(payments, *payment)
+				}
+			}
+			if err != nil {
+				return nil, &ImportError{File: file.Name, Line: reader.line, Err: err}
+			}
+		}
+	}
+
+	if len(payments) != manifest.Records {
+		return nil, fmt.Errorf("%w: manifest has %d, read %d", ErrDumpRecordCount, manifest.Records, len(payments))
+	}
+	return payments, nil
+}
+
+func chunkPayments(payments []types.Payment, records int) [][]types.Payment {
+	var chunks [][]types.Payment
+	for start := 0; start < len(payments); start += records {
+		end := start + records
+		if end > len(payments) {
+			end = len(payments)
+		}
+		chunks = append(chunks, payments[start:end])
+	}
+	return chunks
+}
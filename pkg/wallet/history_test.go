@@ -0,0 +1,90 @@
+package wallet
+
+import (
+	"errors"
+	"github.com/bdaler/wallet/pkg/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestService_HistoryFromFiles_roundTrip(t *testing.T) {
+	s := newExportTestService()
+	payments := make([]types.Payment, 0, 5)
+	for i := 0; i < 5; i++ {
+		payments = append(payments, *s.payments[i%len(s.payments)])
+	}
+
+	dir := t.TempDir()
+	if err := s.HistoryToFiles(payments, dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"payments1.dump", "payments2.dump", "payments3.dump", historyManifestName} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("HistoryToFiles() did not write %s: %v", name, err)
+		}
+	}
+
+	got, err := HistoryFromFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, payments) {
+		t.Errorf("HistoryFromFiles() got = %v, want %v", got, payments)
+	}
+}
+
+func TestService_HistoryToFiles_staleChunks(t *testing.T) {
+	s := newExportTestService()
+	payments := []types.Payment{*s.payments[0], *s.payments[1], *s.payments[0]}
+	dir := t.TempDir()
+	if err := s.HistoryToFiles(payments, dir, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.HistoryToCSVFiles(payments, dir, 1, CSVOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.HistoryToFiles(payments[:1], dir, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.HistoryToCSVFiles(payments[:1], dir, 1, CSVOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"payments2.dump", "payments3.dump", "payments2.csv", "payments3.csv"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("HistoryToFiles() left %s: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "payments1.csv")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestService_HistoryFromFiles_checksum(t *testing.T) {
+	s := newExportTestService()
+	dir := t.TempDir()
+	if err := s.HistoryToFiles([]types.Payment{*s.payments[0]}, dir, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "payments1.dump")
+	content, _ := ioutil.ReadFile(path)
+	content[len(content)-2] ^= 1
+	_ = ioutil.WriteFile(path, content, 0600)
+
+	_, err := HistoryFromFiles(dir)
+	if !errors.Is(err, ErrHistoryChecksum) {
+		t.Errorf("HistoryFromFiles() error = %v, want %v", err, ErrHistoryChecksum)
+	}
+}
+
+func TestService_HistoryToFiles_invalidChunkSize(t *testing.T) {
+	s := newExportTestService()
+	err := s.HistoryToFiles(nil, t.TempDir(), 0)
+	if err != ErrInvalidChunkSize {
+		t.Errorf("HistoryToFiles() error = %v, want %v", err, ErrInvalidChunkSize)
+	}
+}
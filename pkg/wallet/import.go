@@ -0,0 +1,791 @@
+package wallet
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/bdaler/wallet/pkg/types"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+var ErrInvalidRecord = errors.New("invalid record")
+var ErrImportConflict = errors.New("import conflicts with existing record")
+
+type ImportPolicy int
+
+const (
+	// ImportStrict stops at the first invalid record.
+	ImportStrict ImportPolicy = iota
+	// ImportBestEffort skips invalid records and reports them.
+	ImportBestEffort
+)
+
+// ConflictPolicy decides what happens to an imported record whose ID, or
+// phone for accounts, is already taken in the service.
+type ConflictPolicy int
+
+const (
+	// ConflictOverwrite replaces the existing record with the same ID. A
+	// phone owned by another account can not be overwritten without
+	// orphaning that account's records, so it fails like ConflictFail.
+	ConflictOverwrite ConflictPolicy = iota
+	// ConflictSkip keeps the existing record and drops the imported one
+	// along with the imported payments and favorites of a dropped account.
+	ConflictSkip
+	// ConflictFail aborts the import before anything is merged.
+	ConflictFail
+)
+
+type ImportOptions struct {
+	DryRun   bool
+	Policy   ImportPolicy
+	Conflict ConflictPolicy
+	// Progress, when set, receives an update per entity, or per section of
+	// a dump, every few records: Part is the entity order, Processed and
+	// Total count its records, zero Total when the input does not tell it
+	// up front, and Result is the amount of the payments read so far.
+	Progress ProgressFunc
+}
+
+// ImportConflict describes a record that collided with the service state on
+// Field: "id", "phone", or "account_id" for records of a skipped account.
+type ImportConflict struct {
+	Entity  string
+	ID      string
+	Field   string
+	Skipped bool
+}
+
+type ImportError struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (e *ImportError) Error() string {
+	return fmt.Sprintf("%s:%d: %v", e.File, e.Line, e.Err)
+}
+
+func (e *ImportError) Unwrap() error {
+	return e.Err
+}
+
+type ImportReport struct {
+	// Format is set by ImportAuto.
+	Format    Format
+	DryRun    bool
+	Accounts  int
+	Payments  int
+	Favorites int
+	Skipped   []string
+	Errors    []*ImportError
+	// Added and Updated count the records merged into the service, or that
+	// would be merged on a dry run.
+	Added     int
+	Updated   int
+	Conflicts []ImportConflict
+}
+
+// record adds err to the report and returns it when the policy requires the
+// import to stop. A done context always stops it, and so does a conflict the
+// conflict policy fails on, which is reported in Conflicts instead.
+func (r *ImportReport) record(policy ImportPolicy, err *ImportError) error {
+	if errors.Is(err, ErrImportConflict) {
+		return err
+	}
+	r.Errors = append(r.Errors, err)
+	if policy == ImportStrict || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return nil
+}
+
+var dumpEntities = map[string]string{
+	"accounts.dump":  entityAccounts,
+	"payments.dump":  entityPayments,
+	"favorites.dump": entityFavorites,
+}
+
+// importBatch merges the records of an import into the service as they are
+// read, so an import holds no copy of the records it adds, only an index of
+// their IDs. Nothing is published before commit, and rollback puts the service
+// back as it was by dropping the added records and restoring the previous
+// value of the replaced ones.
+type importBatch struct {
+	service  *Service
+	options  ImportOptions
+	ctx      context.Context
+	progress ProgressFunc
+	amount   types.Money
+	records  int
+	closed   bool
+
+	accountIDs  *mergeIndex
+	paymentIDs  *mergeIndex
+	favoriteIDs *mergeIndex
+	accounts    map[int64]*types.Account
+	payments    map[string]*types.Payment
+	favorites   map[string]*types.Favorite
+	phones      map[types.Phone]int64
+
+	nextAccountID     int64
+	accountCount      int
+	paymentCount      int
+	favoriteCount     int
+	replacedAccounts  []types.Account
+	replacedPayments  []types.Payment
+	replacedFavorites []types.Favorite
+}
+
+func (s *Service) newImportBatch(ctx context.Context, options ImportOptions) *importBatch {
+	batch := &importBatch{
+		service:       s,
+		options:       options,
+		ctx:           ctx,
+		progress:      options.Progress,
+		accountIDs:    newMergeIndex(len(s.accounts)),
+		paymentIDs:    newMergeIndex(len(s.payments)),
+		favoriteIDs:   newMergeIndex(len(s.favorites)),
+		accounts:      make(map[int64]*types.Account, len(s.accounts)),
+		payments:      make(map[string]*types.Payment, len(s.payments)),
+		favorites:     make(map[string]*types.Favorite, len(s.favorites)),
+		phones:        make(map[types.Phone]int64, len(s.accounts)),
+		nextAccountID: s.nextAccountID,
+		accountCount:  len(s.accounts),
+		paymentCount:  len(s.payments),
+		favoriteCount: len(s.favorites),
+	}
+	for _, account := range s.accounts {
+		batch.accountIDs.existing[strconv.FormatInt(account.ID, 10)] = true
+		batch.accounts[account.ID] = account
+		batch.phones[account.Phone] = account.ID
+	}
+	for _, payment := range s.payments {
+		batch.paymentIDs.existing[payment.ID] = true
+		batch.payments[payment.ID] = payment
+	}
+	for _, favorite := range s.favorites {
+		batch.favoriteIDs.existing[favorite.ID] = true
+		batch.favorites[favorite.ID] = favorite
+	}
+	return batch
+}
+
+func (s *Service) Import(dir string) error {
+	_, err := s.ImportWithOptions(dir, ImportOptions{})
+	return err
+}
+
+func (s *Service) ImportWithOptions(dir string, options ImportOptions) (*ImportReport, error) {
+	return s.importDir(context.Background(), dir, options)
+}
+
+func (s *Service) importDir(ctx context.Context, dir string, options ImportOptions) (*ImportReport, error) {
+	log.Print("account count in the start of import method: ", len(s.accounts))
+	log.Print("Start Import method with param: " + dir)
+	report := &ImportReport{DryRun: options.DryRun}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Print(err)
+		return report, err
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		return dumpOrder(files[i].Name()) < dumpOrder(files[j].Name())
+	})
+
+	manifest, err := readDumpManifest(dir)
+	if err != nil {
+		log.Print(err)
+		return report, err
+	}
+
+	batch := s.newImportBatch(ctx, options)
+	defer batch.rollback()
+	read := 0
+	for _, file := range files {
+		entity, ok := dumpEntities[file.Name()]
+		if file.Name() == dumpManifestName && manifest != nil {
+			continue
+		}
+		if !ok || file.IsDir() {
+			report.Skipped = append(report.Skipped, file.Name())
+			continue
+		}
+
+		var listed *ManifestFile
+		if manifest != nil {
+			if listed = manifest.file(file.Name()); listed == nil {
+				err = fmt.Errorf("%w: %s is not in %s", ErrMixedDumps, file.Name(), dumpManifestName)
+				log.Print(err)
+				return report, err
+			}
+		}
+		err = s.readDumpFile(filepath.Join(dir, file.Name()), entity, options.Policy, batch, report, listed)
+		if err != nil {
+			log.Print(err)
+			return report, err
+		}
+		read++
+	}
+	if manifest != nil && read != len(manifest.Files) {
+		err = fmt.Errorf("%w: %s lists files that are missing", ErrMixedDumps, dumpManifestName)
+		log.Print(err)
+		return report, err
+	}
+
+	if err = batch.commit(); err != nil {
+		log.Print(err)
+		return report, err
+	}
+	log.Print("account count in the end of import method: ", len(s.accounts))
+	return report, nil
+}
+
+// dumpOrder makes accounts load before the entities that refer to them.
+func dumpOrder(name string) int {
+	return entityOrder(dumpEntities[name])
+}
+
+func entityOrder(entity string) int {
+	switch entity {
+	case entityAccounts:
+		return 0
+	case entityPayments:
+		return 1
+	case entityFavorites:
+		return 2
+	}
+	return 3
+}
+
+// readDumpFile merges the records of the dump at path into batch. With listed, the file
+// must also match its manifest entry.
+func (s *Service) readDumpFile(path string, entity string, policy ImportPolicy, batch *importBatch, report *ImportReport, listed *ManifestFile) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := file.Close(); closeErr != nil {
+			log.Print(closeErr)
+		}
+	}()
+
+	checksum := newChecksumWriter()
+	_, err = readDump(io.TeeReader(file, checksum), filepath.Base(path), entity, policy, batch, report)
+	if err == nil && listed != nil && !listed.matches(checksum) {
+		err = fmt.Errorf("%w: %s does not match %s", ErrMixedDumps, filepath.Base(path), dumpManifestName)
+	}
+	return err
+}
+
+// readDump merges the records of r into batch and returns how many records
+// it read, invalid ones included. Sections with a header use the entity named
+// there; headerless records fall back to entity.
+func readDump(r io.Reader, name string, entity string, policy ImportPolicy, batch *importBatch, report *ImportReport) (int, error) {
+	reader := newDumpReader(newContextReader(batch.ctx, r))
+	for records := 0; ; records++ {
+		item, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err == nil && reader.header.Entity == "" && entity == "" {
+			err = ErrMissingDumpHeader
+		}
+
+		// Only a malformed record can be skipped; after any other error the
+		// rest of the stream can not be read, whatever the policy.
+		var parseErr *csv.ParseError
+		if err != nil && !errors.As(err, &parseErr) {
+			return records, report.fail(&ImportError{File: name, Line: reader.line, Err: err})
+		}
+
+		sectionEntity := entity
+		if reader.header.Entity != "" {
+			sectionEntity = reader.header.Entity
+		}
+		if err == nil {
+			err = batch.add(sectionEntity, item, reader.header.Version, report)
+		}
+		if err != nil {
+			if err = report.record(policy, &ImportError{File: name, Line: reader.line, Err: err}); err != nil {
+				return records, err
+			}
+		}
+		if err = batch.observe(sectionEntity, reader.count, reader.header.Records); err != nil {
+			return records, err
+		}
+	}
+}
+
+// observe checks the context of the import and reports its progress after
+// the processed-th record of entity was read out of total, zero if unknown.
+func (b *importBatch) observe(entity string, processed int, total int) error {
+	if processed%queryCheckEvery == 0 {
+		if err := b.ctx.Err(); err != nil {
+			return err
+		}
+	}
+	if b.progress != nil && (processed%progressEvery == 0 || processed == total) {
+		b.progress(types.Progress{
+			Part:      entityOrder(entity),
+			Processed: processed,
+			Total:     total,
+			Result:    b.amount,
+		})
+	}
+	return nil
+}
+
+// add merges item, a record of entity in a dump of version, into the batch.
+func (b *importBatch) add(entity string, item []string, version int, report *ImportReport) error {
+	switch entity {
+	case entityAccounts:
+		account, err := parseAccount(item)
+		if err != nil {
+			return err
+		}
+		return b.addAccount(account, report)
+	case entityPayments:
+		payment, err := parsePayment(item, version)
+		if err != nil {
+			return err
+		}
+		return b.addPayment(payment, report)
+	case entityFavorites:
+		favorite, err := parseFavorite(item)
+		if err != nil {
+			return err
+		}
+		return b.addFavorite(favorite, report)
+	}
+	return fmt.Errorf("%w: unknown entity %q", ErrInvalidRecord, entity)
+}
+
+func (b *importBatch) addAccount(account *types.Account, report *ImportReport) error {
+	if err := b.checkContext(); err != nil {
+		return err
+	}
+	if account == nil {
+		return fmt.Errorf("%w: null account", ErrInvalidRecord)
+	}
+	if account.ID <= 0 {
+		return fmt.Errorf("%w: bad account id %d", ErrInvalidRecord, account.ID)
+	}
+	if account.Phone == "" {
+		return fmt.Errorf("%w: empty phone", ErrInvalidRecord)
+	}
+	report.Accounts++
+
+	ID := strconv.FormatInt(account.ID, 10)
+	if b.accountIDs.ignored[ID] {
+		return nil
+	}
+	if owner, ok := b.phones[account.Phone]; ok && owner != account.ID {
+		b.accountIDs.ignored[ID] = true
+		_, err := report.conflict(b.options.Conflict, entityAccounts, ID, "phone")
+		return err
+	}
+	replacing := b.accountIDs.existing[ID] && !b.accountIDs.staged[ID]
+	ok, err := b.accountIDs.admit(b.options.Conflict, report, entityAccounts, ID, true)
+	if err != nil || !ok {
+		return err
+	}
+
+	s := b.service
+	if current, ok := b.accounts[account.ID]; ok {
+		if replacing {
+			b.replacedAccounts = append(b.replacedAccounts, *current)
+		}
+		if b.phones[current.Phone] == current.ID {
+			delete(b.phones, current.Phone)
+		}
+		*current = *account
+	} else {
+		b.accounts[account.ID] = account
+		s.accounts = append(s.accounts, account)
+	}
+	b.phones[account.Phone] = account.ID
+	if account.ID > s.nextAccountID {
+		s.nextAccountID = account.ID
+	}
+	return nil
+}
+
+func (b *importBatch) addPayment(payment *types.Payment, report *ImportReport) error {
+	if err := b.checkContext(); err != nil {
+		return err
+	}
+	if payment == nil {
+		return fmt.Errorf("%w: null payment", ErrInvalidRecord)
+	}
+	if payment.ID == "" {
+		return fmt.Errorf("%w: empty payment id", ErrInvalidRecord)
+	}
+	if payment.Amount <= 0 {
+		return fmt.Errorf("%w: %v", ErrInvalidRecord, ErrAmountMustBePositive)
+	}
+	if payment.Fee < 0 {
+		return fmt.Errorf("%w: negative fee", ErrInvalidRecord)
+	}
+	switch payment.Status {
+	case types.PaymentStatusOK, types.PaymentStatusFail, types.PaymentStatusInProgress, types.PaymentStatusPending, types.PaymentStatusHeld:
+	default:
+		return fmt.Errorf("%w: unknown payment status %q", ErrInvalidRecord, payment.Status)
+	}
+	switch payment.Decision {
+	case "", types.DecisionAllow, types.DecisionHold, types.DecisionDeny:
+	default:
+		return fmt.Errorf("%w: unknown payment decision %q", ErrInvalidRecord, payment.Decision)
+	}
+	if err := b.checkAccount(payment.AccountID); err != nil {
+		return err
+	}
+	b.amount += payment.Amount
+	report.Payments++
+
+	replacing := b.paymentIDs.existing[payment.ID] && !b.paymentIDs.staged[payment.ID]
+	ok, err := b.paymentIDs.admit(b.options.Conflict, report, entityPayments, payment.ID, b.known(payment.AccountID))
+	if err != nil || !ok {
+		return err
+	}
+
+	if current, ok := b.payments[payment.ID]; ok {
+		if replacing {
+			b.replacedPayments = append(b.replacedPayments, *current)
+		}
+		*current = *payment
+	} else {
+		b.payments[payment.ID] = payment
+		b.service.payments = append(b.service.payments, payment)
+	}
+	return nil
+}
+
+func (b *importBatch) addFavorite(favorite *types.Favorite, report *ImportReport) error {
+	if err := b.checkContext(); err != nil {
+		return err
+	}
+	if favorite == nil {
+		return fmt.Errorf("%w: null favorite", ErrInvalidRecord)
+	}
+	if favorite.ID == "" {
+		return fmt.Errorf("%w: empty favorite id", ErrInvalidRecord)
+	}
+	if favorite.Amount <= 0 {
+		return fmt.Errorf("%w: %v", ErrInvalidRecord, ErrAmountMustBePositive)
+	}
+	if err := b.checkAccount(favorite.AccountID); err != nil {
+		return err
+	}
+	report.Favorites++
+
+	replacing := b.favoriteIDs.existing[favorite.ID] && !b.favoriteIDs.staged[favorite.ID]
+	ok, err := b.favoriteIDs.admit(b.options.Conflict, report, entityFavorites, favorite.ID, b.known(favorite.AccountID))
+	if err != nil || !ok {
+		return err
+	}
+
+	if current, ok := b.favorites[favorite.ID]; ok {
+		if replacing {
+			b.replacedFavorites = append(b.replacedFavorites, *current)
+		}
+		*current = *favorite
+	} else {
+		b.favorites[favorite.ID] = favorite
+		b.service.favorites = append(b.service.favorites, favorite)
+	}
+	return nil
+}
+
+// checkContext returns ctx.Err() once the context of the import is done. It
+// only looks at the context every few records.
+func (b *importBatch) checkContext() error {
+	b.records++
+	if (b.records-1)%queryCheckEvery == 0 {
+		return b.ctx.Err()
+	}
+	return nil
+}
+
+// checkAccount fails for records of an account that is neither in the
+// service nor read earlier in the import.
+func (b *importBatch) checkAccount(accountID int64) error {
+	if b.accounts[accountID] == nil && !b.accountIDs.ignored[strconv.FormatInt(accountID, 10)] {
+		return fmt.Errorf("%w: %v: %d", ErrInvalidRecord, ErrAccountNotFound, accountID)
+	}
+	return nil
+}
+
+// known reports whether the records of accountID can be merged.
+func (b *importBatch) known(accountID int64) bool {
+	ID := strconv.FormatInt(accountID, 10)
+	return !b.accountIDs.ignored[ID] && (b.accountIDs.existing[ID] || b.accountIDs.staged[ID])
+}
+
+// commit keeps the merged records and publishes them, unless this is a dry
+// run, which is rolled back instead. An import whose events can not be stored
+// is rolled back too.
+func (b *importBatch) commit() error {
+	if err := b.ctx.Err(); err != nil {
+		return err
+	}
+	if b.options.DryRun {
+		b.rollback()
+		return nil
+	}
+
+	s := b.service
+	var events []Event
+	for _, previous := range b.replacedAccounts {
+		events = append(events, accountEvent(EventAccountImported, b.accounts[previous.ID], 0))
+	}
+	for _, account := range s.accounts[b.accountCount:] {
+		events = append(events, accountEvent(EventAccountImported, account, 0))
+	}
+	for _, previous := range b.replacedPayments {
+		events = append(events, b.paymentEvent(b.payments[previous.ID]))
+	}
+	for _, payment := range s.payments[b.paymentCount:] {
+		events = append(events, b.paymentEvent(payment))
+	}
+	for _, previous := range b.replacedFavorites {
+		events = append(events, b.favoriteEvent(b.favorites[previous.ID]))
+	}
+	for _, favorite := range s.favorites[b.favoriteCount:] {
+		events = append(events, b.favoriteEvent(favorite))
+	}
+
+	err := s.emitAll(events, func() {
+		b.closed = true
+		for _, event := range events {
+			switch {
+			case event.Account != nil:
+				s.touchAccount(event.Account.ID)
+			case event.Payment != nil:
+				s.touchPayment(event.Payment.ID)
+			case event.Favorite != nil:
+				s.touchFavorite(event.Favorite.ID)
+			}
+		}
+	})
+	if err != nil {
+		b.rollback()
+	}
+	return err
+}
+
+func (b *importBatch) paymentEvent(payment *types.Payment) Event {
+	return paymentEvent(EventPaymentImported, b.accounts[payment.AccountID], payment, 0)
+}
+
+func (b *importBatch) favoriteEvent(favorite *types.Favorite) Event {
+	return favoriteEvent(EventFavoriteImported, b.accounts[favorite.AccountID], favorite)
+}
+
+// rollback undoes everything merged by an import that was not committed.
+func (b *importBatch) rollback() {
+	if b.closed {
+		return
+	}
+	b.closed = true
+
+	s := b.service
+	for _, previous := range b.replacedAccounts {
+		*b.accounts[previous.ID] = previous
+	}
+	for _, previous := range b.replacedPayments {
+		*b.payments[previous.ID] = previous
+	}
+	for _, previous := range b.replacedFavorites {
+		*b.favorites[previous.ID] = previous
+	}
+	for i := b.accountCount; i < len(s.accounts); i++ {
+		s.accounts[i] = nil
+	}
+	for i := b.paymentCount; i < len(s.payments); i++ {
+		s.payments[i] = nil
+	}
+	for i := b.favoriteCount; i < len(s.favorites); i++ {
+		s.favorites[i] = nil
+	}
+	s.accounts = s.accounts[:b.accountCount]
+	s.payments = s.payments[:b.paymentCount]
+	s.favorites = s.favorites[:b.favoriteCount]
+	s.nextAccountID = b.nextAccountID
+}
+
+// fail adds err to the report and returns it whatever the policy. It is for
+// errors after which the rest of the input can not be read.
+func (r *ImportReport) fail(err *ImportError) error {
+	r.Errors = append(r.Errors, err)
+	return err
+}
+
+// conflict records a collision and reports whether the imported record still
+// replaces the existing one.
+func (r *ImportReport) conflict(policy ConflictPolicy, entity string, ID string, field string) (bool, error) {
+	fail := policy == ConflictFail || policy == ConflictOverwrite && field == "phone"
+	skip := !fail && (policy == ConflictSkip || field != "id")
+	r.Conflicts = append(r.Conflicts, ImportConflict{Entity: entity, ID: ID, Field: field, Skipped: skip})
+	if fail {
+		return false, fmt.Errorf("%w: %s %s: %s", ErrImportConflict, entity, ID, field)
+	}
+	return !skip, nil
+}
+
+// mergeIndex tracks the IDs of one entity while a batch is merged. Records
+// repeated within a batch are updates of the same record, not conflicts.
+type mergeIndex struct {
+	existing map[string]bool
+	staged   map[string]bool
+	ignored  map[string]bool
+}
+
+func newMergeIndex(size int) *mergeIndex {
+	return &mergeIndex{
+		existing: make(map[string]bool, size),
+		staged:   make(map[string]bool),
+		ignored:  make(map[string]bool),
+	}
+}
+
+func (m *mergeIndex) admit(policy ConflictPolicy, report *ImportReport, entity string, ID string, known bool) (bool, error) {
+	if m.ignored[ID] {
+		return false, nil
+	}
+
+	field := ""
+	if !known {
+		field = "account_id"
+	} else if m.existing[ID] && !m.staged[ID] {
+		field = "id"
+	}
+	if field != "" {
+		ok, err := report.conflict(policy, entity, ID, field)
+		if err != nil || !ok {
+			m.ignored[ID] = true
+			return false, err
+		}
+	}
+
+	if !m.staged[ID] {
+		m.staged[ID] = true
+		if m.existing[ID] {
+			report.Updated++
+		} else {
+			report.Added++
+		}
+	}
+	return true, nil
+}
+
+func parseAccount(item []string) (*types.Account, error) {
+	if len(item) != 3 {
+		return nil, fmt.Errorf("%w: account has %d fields, want 3", ErrInvalidRecord, len(item))
+	}
+
+	ID, err := parseID(item[0])
+	if err != nil {
+		return nil, err
+	}
+	balance, err := parseMoney("balance", item[2])
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.Account{
+		ID:      ID,
+		Phone:   types.Phone(item[1]),
+		Balance: balance,
+	}, nil
+}
+
+// parsePayment reads a payment record of a dump of version. The decision
+// fields only exist from version 3 on.
+func parsePayment(item []string, version int) (*types.Payment, error) {
+	if version < 3 && len(item) != 5 && len(item) != 6 {
+		return nil, fmt.Errorf("%w: payment has %d fields, want 5 or 6", ErrInvalidRecord, len(item))
+	}
+	if len(item) != 5 && len(item) != 6 && len(item) != 8 {
+		return nil, fmt.Errorf("%w: payment has %d fields, want 5, 6 or 8", ErrInvalidRecord, len(item))
+	}
+
+	accountID, err := parseID(item[1])
+	if err != nil {
+		return nil, err
+	}
+	amount, err := parseMoney("amount", item[2])
+	if err != nil {
+		return nil, err
+	}
+	fee := types.Money(0)
+	if len(item) >= 6 {
+		fee, err = parseMoney("fee", item[5])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	payment := &types.Payment{
+		ID:        item[0],
+		AccountID: accountID,
+		Amount:    amount,
+		Fee:       fee,
+		Category:  types.PaymentCategory(item[3]),
+		Status:    types.PaymentStatus(item[4]),
+	}
+	if len(item) == 8 {
+		payment.Decision = types.PaymentDecision(item[6])
+		payment.DecisionReason = item[7]
+	}
+	return payment, nil
+}
+
+func parseFavorite(item []string) (*types.Favorite, error) {
+	if len(item) != 5 {
+		return nil, fmt.Errorf("%w: favorite has %d fields, want 5", ErrInvalidRecord, len(item))
+	}
+
+	accountID, err := parseID(item[1])
+	if err != nil {
+		return nil, err
+	}
+	amount, err := parseMoney("amount", item[3])
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.Favorite{
+		ID:        item[0],
+		AccountID: accountID,
+		Name:      item[2],
+		Amount:    amount,
+		Category:  types.PaymentCategory(item[4]),
+	}, nil
+}
+
+func parseID(value string) (int64, error) {
+	ID, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: bad account id %q", ErrInvalidRecord, value)
+	}
+	return ID, nil
+}
+
+func parseMoney(field string, value string) (types.Money, error) {
+	amount, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: bad %s %q", ErrInvalidRecord, field, value)
+	}
+	return types.Money(amount), nil
+}
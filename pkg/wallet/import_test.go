@@ -0,0 +1,196 @@
+package wallet
+
+import (
+	"errors"
+	"github.com/bdaler/wallet/pkg/types"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeDumpFixture(t *testing.T, dir string, name string, content string) {
+	err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestService_ImportWithOptions(t *testing.T) {
+	dir := t.TempDir()
+	writeDumpFixture(t, dir, "accounts.dump", "1;9127660305;10\nx;9127660306;11\n3;9127660307\n4;9127660308;12\n")
+	writeDumpFixture(t, dir, "notes.txt", "hello\n")
+
+	tests := []struct {
+		name     string
+		options  ImportOptions
+		wantErr  bool
+		errors   int
+		accounts int
+	}{
+		{name: "strict", options: ImportOptions{}, wantErr: true, errors: 1, accounts: 0},
+		{name: "dry run", options: ImportOptions{DryRun: true, Policy: ImportBestEffort}, errors: 2, accounts: 0},
+		{name: "best effort", options: ImportOptions{Policy: ImportBestEffort}, errors: 2, accounts: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService()
+			report, err := s.ImportWithOptions(dir, tt.options)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ImportWithOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidRecord) {
+				t.Errorf("ImportWithOptions() error = %v, want %v", err, ErrInvalidRecord)
+			}
+			if len(report.Errors) != tt.errors {
+				t.Errorf("ImportWithOptions() errors = %v, want %d", report.Errors, tt.errors)
+			}
+			if len(s.accounts) != tt.accounts {
+				t.Errorf("ImportWithOptions() accounts = %d, want %d", len(s.accounts), tt.accounts)
+			}
+			if err == nil && (len(report.Skipped) != 1 || report.Skipped[0] != "notes.txt") {
+				t.Errorf("ImportWithOptions() skipped = %v", report.Skipped)
+			}
+		})
+	}
+
+	s := newTestService()
+	report, _ := s.ImportWithOptions(dir, ImportOptions{Policy: ImportBestEffort})
+	if report.Errors[0].Line != 2 || report.Errors[1].Line != 3 {
+		t.Errorf("ImportWithOptions() error lines = %v", report.Errors)
+	}
+}
+
+// failingReader returns data and then fails every read with err.
+type failingReader struct {
+	data string
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestService_ImportFromWithOptions_readError(t *testing.T) {
+	errDisk := errors.New("disk error")
+	reader := &failingReader{
+		data: "#wallet-dump;version=2;entity=accounts;records=2;created=2020-11-01T00:00:00Z\n1;9127660305;10\n",
+		err:  errDisk,
+	}
+
+	s := newTestService()
+	report, err := s.ImportFromWithOptions(reader, ImportOptions{Policy: ImportBestEffort})
+	if !errors.Is(err, errDisk) {
+		t.Fatalf("ImportFromWithOptions() error = %v, want %v", err, errDisk)
+	}
+	if len(report.Errors) != 1 || len(s.accounts) != 0 {
+		t.Errorf("ImportFromWithOptions() errors = %v, accounts = %v", report.Errors, s.accounts)
+	}
+}
+
+func TestService_Import_transactional(t *testing.T) {
+	dir := t.TempDir()
+	writeDumpFixture(t, dir, "accounts.dump", "5;9127660305;10\n7;9127660307;10\n")
+	writeDumpFixture(t, dir, "payments.dump", "e1dceb29-6cc4-48c5-acd4-455530f9d50a;5;1;it;OK\n5f7834e5-1c1e-42ff-bd78-9fd7f1b5da28;9;1;it;OK\n")
+
+	s := newTestService()
+	_, _ = s.RegisterAccount("9127660301")
+	err := s.Import(dir)
+	if !errors.Is(err, ErrInvalidRecord) {
+		t.Fatalf("Import() error = %v, want %v", err, ErrInvalidRecord)
+	}
+	if len(s.accounts) != 1 || len(s.payments) != 0 {
+		t.Errorf("Import() changed service: accounts = %d, payments = %d", len(s.accounts), len(s.payments))
+	}
+
+	writeDumpFixture(t, dir, "payments.dump", "e1dceb29-6cc4-48c5-acd4-455530f9d50a;5;1;it;OK\n")
+	if err = s.Import(dir); err != nil {
+		t.Fatal(err)
+	}
+	account, err := s.RegisterAccount("9127660308")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.ID != 8 {
+		t.Errorf("RegisterAccount() after import got id %d, want 8", account.ID)
+	}
+}
+
+func TestService_ImportJSON_conflicts(t *testing.T) {
+	const snapshot = `{"version":2,
+		"accounts":[{"id":1,"phone":"9127660305","balance":500},{"id":7,"phone":"9127660306","balance":70}],
+		"payments":[{"id":"p7","account_id":7,"amount":5,"category":"it","status":"OK"}]}`
+
+	tests := []struct {
+		name      string
+		conflict  ConflictPolicy
+		wantErr   bool
+		balance   types.Money
+		accounts  int
+		conflicts int
+	}{
+		{name: "overwrite", conflict: ConflictOverwrite, wantErr: true, balance: 10, accounts: 2, conflicts: 2},
+		{name: "skip", conflict: ConflictSkip, balance: 10, accounts: 2, conflicts: 3},
+		{name: "fail", conflict: ConflictFail, wantErr: true, balance: 10, accounts: 2, conflicts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService()
+			_, _ = s.AddAccountWithBalance("9127660305", 10)
+			_, _ = s.AddAccountWithBalance("9127660306", 20)
+
+			report, err := s.ImportJSONWithOptions(strings.NewReader(snapshot), ImportOptions{Conflict: tt.conflict})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ImportJSONWithOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrImportConflict) {
+				t.Errorf("ImportJSONWithOptions() error = %v, want %v", err, ErrImportConflict)
+			}
+			if s.accounts[0].Balance != tt.balance || len(s.accounts) != tt.accounts || len(s.payments) != 0 {
+				t.Errorf("ImportJSONWithOptions() merged accounts = %v, payments = %v", s.accounts, s.payments)
+			}
+			if len(report.Conflicts) != tt.conflicts {
+				t.Errorf("ImportJSONWithOptions() conflicts = %v, want %d", report.Conflicts, tt.conflicts)
+			}
+		})
+	}
+
+	s := newTestService()
+	_, _ = s.AddAccountWithBalance("9127660305", 10)
+	report, err := s.ImportJSONWithOptions(strings.NewReader(snapshot), ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Added != 2 || report.Updated != 1 || s.accounts[0].Balance != 500 {
+		t.Errorf("ImportJSONWithOptions() added = %d, updated = %d, balance = %d", report.Added, report.Updated, s.accounts[0].Balance)
+	}
+	account, _ := s.RegisterAccount("9127660307")
+	if account.ID != 8 {
+		t.Errorf("RegisterAccount() after import got ID %d, want 8", account.ID)
+	}
+}
+
+func TestService_ImportJSON_skippedAccountPayments(t *testing.T) {
+	const snapshot = `{"version":2,
+		"accounts":[{"id":1,"phone":"9127660305","balance":500}],
+		"payments":[{"id":"p1","account_id":1,"amount":5,"category":"it","status":"OK"}]}`
+
+	s := newTestService()
+	_, _ = s.AddAccountWithBalance("9127660305", 10)
+	report, err := s.ImportJSONWithOptions(strings.NewReader(snapshot), ImportOptions{Conflict: ConflictSkip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.payments) != 0 || s.accounts[0].Balance != 10 {
+		t.Errorf("ImportJSONWithOptions() merged accounts = %v, payments = %v", s.accounts, s.payments)
+	}
+	want := ImportConflict{Entity: entityPayments, ID: "p1", Field: "account_id", Skipped: true}
+	if len(report.Conflicts) != 2 || report.Conflicts[1] != want {
+		t.Errorf("ImportJSONWithOptions() conflicts = %v, want %v", report.Conflicts, want)
+	}
+}
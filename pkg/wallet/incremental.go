@@ -0,0 +1,247 @@
+package wallet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+var ErrNoFullExport = errors.New("no full export to continue from")
+var ErrCheckpointAhead = errors.New("checkpoint is ahead of the service sequence")
+var ErrBrokenChain = errors.New("export chain is broken")
+
+const (
+	ChainFull        = "full"
+	ChainIncremental = "incremental"
+)
+
+const chainManifestName = "manifest.json"
+
+type ChainManifest struct {
+	Version int          `json:"version"`
+	Dumps   []ChainEntry `json:"dumps"`
+}
+
+// ChainEntry describes one dump of a chain. It holds the records changed
+// after sequence From up to and including sequence To.
+type ChainEntry struct {
+	Name    string    `json:"name"`
+	Kind    string    `json:"kind"`
+	From    int64     `json:"from"`
+	To      int64     `json:"to"`
+	Created time.Time `json:"created"`
+}
+
+// Sequence returns the number of the last change made to the service.
+func (s *Service) Sequence() int64 {
+	return s.seq
+}
+
+func (s *Service) touch(key string) {
+	if s.changes == nil {
+		s.changes = make(map[string]int64)
+	}
+	s.seq++
+	s.changes[key] = s.seq
+}
+
+func (s *Service) touchAccount(accountID int64) {
+	s.touch("account:" + strconv.FormatInt(accountID, 10))
+}
+
+func (s *Service) touchPayment(paymentID string) {
+	s.touch("payment:" + paymentID)
+}
+
+func (s *Service) touchFavorite(favoriteID string) {
+	s.touch("favorite:" + favoriteID)
+}
+
+// changedDumps returns dumps holding only the records changed after since.
+func (s *Service) changedDumps(since int64) []dumpFile {
+	dumps := []dumpFile{
+		{name: "accounts.dump", entity: entityAccounts},
+		{name: "payments.dump", entity: entityPayments},
+		{name: "favorites.dump", entity: entityFavorites},
+	}
+	for _, account := range s.accounts {
+		if s.changes["account:"+strconv.FormatInt(account.ID, 10)] > since {
+			dumps[0].records = append(dumps[0].records, accountRecord(account))
+		}
+	}
+	for _, payment := range s.payments {
+		if s.changes["payment:"+payment.ID] > since {
+			dumps[1].records = append(dumps[1].records, paymentRecord(payment))
+		}
+	}
+	for _, favorite := range s.favorites {
+		if s.changes["favorite:"+favorite.ID] > since {
+			dumps[2].records = append(dumps[2].records, favoriteRecord(favorite))
+		}
+	}
+	return dumps
+}
+
+// ExportFull starts a new chain in dir with a dump of every record.
+func (s *Service) ExportFull(dir string) (*ChainEntry, error) {
+	return s.exportFull(context.Background(), dir)
+}
+
+func (s *Service) exportFull(ctx context.Context, dir string) (*ChainEntry, error) {
+	manifest := &ChainManifest{Version: DumpVersion}
+	return s.exportChain(ctx, dir, manifest, ChainFull, s.snapshotDumps())
+}
+
+// ExportIncremental appends a dump of the records changed since the last
+// dump of the chain in dir.
+func (s *Service) ExportIncremental(dir string) (*ChainEntry, error) {
+	return s.exportIncremental(context.Background(), dir)
+}
+
+func (s *Service) exportIncremental(ctx context.Context, dir string) (*ChainEntry, error) {
+	manifest, err := readChainManifest(dir)
+	if os.IsNotExist(err) || err == nil && len(manifest.Dumps) == 0 {
+		return nil, ErrNoFullExport
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoint := manifest.Dumps[len(manifest.Dumps)-1].To
+	if checkpoint > s.seq {
+		return nil, fmt.Errorf("%w: %d > %d", ErrCheckpointAhead, checkpoint, s.seq)
+	}
+	return s.exportChain(ctx, dir, manifest, ChainIncremental, s.changedDumps(checkpoint))
+}
+
+func (s *Service) exportChain(ctx context.Context, dir string, manifest *ChainManifest, kind string, dumps []dumpFile) (*ChainEntry, error) {
+	from := int64(0)
+	if len(manifest.Dumps) > 0 {
+		from = manifest.Dumps[len(manifest.Dumps)-1].To
+	}
+	created := s.clock()
+	entry := ChainEntry{
+		Name:    fmt.Sprintf("%06d-%s", len(manifest.Dumps)+1, kind),
+		Kind:    kind,
+		From:    from,
+		To:      s.seq,
+		Created: created.UTC(),
+	}
+
+	_, err := writeDumpFiles(ctx, filepath.Join(dir, entry.Name), created, dumps)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest.Dumps = append(manifest.Dumps, entry)
+	if err = writeManifest(dir, chainManifestName, manifest); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// RestoreChain replays the full dump and every incremental dump of the chain
+// in dir as a single import. Afterwards the service continues the chain: the
+// next incremental export contains the changes made after the restore and
+// the ones made before it that the chain does not have.
+func (s *Service) RestoreChain(dir string) (*ImportReport, error) {
+	return s.importChain(context.Background(), dir, ImportOptions{})
+}
+
+func (s *Service) importChain(ctx context.Context, dir string, options ImportOptions) (*ImportReport, error) {
+	report := &ImportReport{DryRun: options.DryRun}
+	manifest, err := readChainManifest(dir)
+	if err != nil {
+		return report, err
+	}
+
+	last := int64(0)
+	batch := s.newImportBatch(ctx, options)
+	defer batch.rollback()
+	for i, entry := range manifest.Dumps {
+		if i == 0 && entry.Kind != ChainFull || i > 0 && entry.Kind != ChainIncremental || entry.From != last {
+			return report, fmt.Errorf("%w: unexpected %s dump %s", ErrBrokenChain, entry.Kind, entry.Name)
+		}
+		last = entry.To
+
+		for _, name := range []string{"accounts.dump", "payments.dump", "favorites.dump"} {
+			err = s.readDumpFile(filepath.Join(dir, entry.Name, name), dumpEntities[name], ImportStrict, batch, report, nil)
+			if err != nil {
+				return report, err
+			}
+		}
+	}
+
+	before := s.seq
+	if err = batch.commit(); err != nil || options.DryRun {
+		return report, err
+	}
+
+	// The restored records are in the chain already, unlike the changes made
+	// in the service before the restore. Those stay changes and move after
+	// the last dump, whether the chain or the service was ahead.
+	var local []string
+	for key, seq := range s.changes {
+		if seq > before {
+			delete(s.changes, key)
+		} else {
+			local = append(local, key)
+		}
+	}
+	if last > s.seq {
+		s.seq = last
+	}
+	for _, key := range local {
+		s.touch(key)
+	}
+	return report, nil
+}
+
+func readChainManifest(dir string) (*ChainManifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, chainManifestName))
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &ChainManifest{}
+	if err = json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBrokenChain, err)
+	}
+	if manifest.Version < 1 || manifest.Version > DumpVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedDumpVersion, manifest.Version)
+	}
+	return manifest, nil
+}
+
+// writeManifest atomically replaces the JSON manifest name in dir.
+func writeManifest(dir string, name string, manifest interface{}) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(dir, "."+name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filepath.Join(dir, name))
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+	}
+	return err
+}
@@ -0,0 +1,126 @@
+package wallet
+
+import (
+	"errors"
+	"github.com/bdaler/wallet/pkg/types"
+	"reflect"
+	"testing"
+)
+
+func TestService_ExportIncremental(t *testing.T) {
+	dir := t.TempDir()
+	s := newExportTestService()
+
+	if _, err := s.ExportIncremental(dir); err != ErrNoFullExport {
+		t.Errorf("ExportIncremental() error = %v, want %v", err, ErrNoFullExport)
+	}
+
+	full, err := s.ExportFull(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account, _ := s.AddAccountWithBalance("9127660307", 30)
+	payment, _ := s.Pay(account.ID, 5, types.CategoryShop)
+	incremental, err := s.ExportIncremental(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if incremental.From != full.To || incremental.To != s.Sequence() {
+		t.Errorf("ExportIncremental() entry = %+v, full = %+v", incremental, full)
+	}
+
+	_ = s.Reject(payment.ID)
+	if _, err = s.ExportIncremental(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	i := newTestService()
+	report, err := i.RestoreChain(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Accounts != 4 || report.Payments != 4 {
+		t.Errorf("RestoreChain() report = %+v", report)
+	}
+	if !reflect.DeepEqual(s.accounts, i.accounts) || !reflect.DeepEqual(s.payments, i.payments) {
+		t.Error("restored and exported entities doesn't match")
+	}
+
+	if _, err = i.ExportIncremental(dir); err != nil {
+		t.Fatal(err)
+	}
+	s = newTestService()
+	if _, err = s.ExportIncremental(dir); !errors.Is(err, ErrCheckpointAhead) {
+		t.Errorf("ExportIncremental() error = %v, want %v", err, ErrCheckpointAhead)
+	}
+}
+
+func TestService_RestoreChain_localChanges(t *testing.T) {
+	dir := t.TempDir()
+	s := newExportTestService()
+	if _, err := s.ExportFull(dir); err != nil {
+		t.Fatal(err)
+	}
+	last := s.Sequence()
+
+	i := newTestService()
+	i.nextAccountID = 4
+	local, _ := i.AddAccountWithBalance("9127660309", 10)
+	if _, err := i.RestoreChain(dir); err != nil {
+		t.Fatal(err)
+	}
+	if i.Sequence() < last {
+		t.Errorf("RestoreChain() sequence = %d, want at least %d", i.Sequence(), last)
+	}
+
+	incremental, err := i.ExportIncremental(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := newTestService()
+	if _, err = chain.RestoreChain(dir); err != nil {
+		t.Fatal(err)
+	}
+	if account, err := chain.FindAccountByID(local.ID); err != nil || account.Phone != "9127660309" {
+		t.Errorf("ExportIncremental() %s lost the local account: %v, %v", incremental.Name, account, err)
+	}
+}
+
+func TestService_RestoreChain_localAhead(t *testing.T) {
+	dir := t.TempDir()
+	s := newExportTestService()
+	if _, err := s.ExportFull(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	i := newTestService()
+	i.nextAccountID = 10
+	var local []*types.Account
+	for _, phone := range []types.Phone{"9127660310", "9127660311", "9127660312", "9127660313"} {
+		account, _ := i.AddAccountWithBalance(phone, 10)
+		for j := 0; j < 5; j++ {
+			_ = i.Deposit(account.ID, 1)
+		}
+		local = append(local, account)
+	}
+	if i.Sequence() <= s.Sequence() {
+		t.Fatalf("local sequence %d is not ahead of the chain %d", i.Sequence(), s.Sequence())
+	}
+	if _, err := i.RestoreChain(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.ExportIncremental(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	chain := newTestService()
+	if _, err := chain.RestoreChain(dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, account := range local {
+		if restored, err := chain.FindAccountByID(account.ID); err != nil || restored.Balance != 15 {
+			t.Errorf("ExportIncremental() lost local account %d: %v, %v", account.ID, restored, err)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package wallet
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bdaler/wallet/pkg/types"
+	"io"
+	"time"
+)
+
+const (
+	jsonLineHeader   = "header"
+	jsonLineAccount  = "account"
+	jsonLinePayment  = "payment"
+	jsonLineFavorite = "favorite"
+)
+
+type jsonSnapshot struct {
+	Version   int               `json:"version"`
+	Created   time.Time         `json:"created"`
+	Accounts  []*types.Account  `json:"accounts"`
+	Payments  []*types.Payment  `json:"payments"`
+	Favorites []*types.Favorite `json:"favorites"`
+}
+
+type jsonHeader struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+type jsonLine struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+func (s *Service) ExportJSON(w io.Writer) error {
+	snapshot := jsonSnapshot{
+		Version:   DumpVersion,
+		Created:   s.clock().UTC(),
+		Accounts:  s.accounts,
+		Payments:  s.payments,
+		Favorites: s.favorites,
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(snapshot)
+}
+
+func (s *Service) ImportJSON(r io.Reader) error {
+	_, err := s.ImportJSONWithOptions(r, ImportOptions{})
+	return err
+}
+
+func (s *Service) ImportJSONWithOptions(r io.Reader, options ImportOptions) (*ImportReport, error) {
+	return s.importJSON(context.Background(), r, options)
+}
+
+func (s *Service) importJSON(ctx context.Context, r io.Reader, options ImportOptions) (*ImportReport, error) {
+	report := &ImportReport{DryRun: options.DryRun}
+
+	snapshot := jsonSnapshot{}
+	err := json.NewDecoder(newContextReader(ctx, r)).Decode(&snapshot)
+	if err != nil {
+		return report, err
+	}
+	if snapshot.Version < 1 || snapshot.Version > DumpVersion {
+		return report, fmt.Errorf("%w: %d", ErrUnsupportedDumpVersion, snapshot.Version)
+	}
+
+	batch := s.newImportBatch(ctx, options)
+	defer batch.rollback()
+	for i, account := range snapshot.Accounts {
+		if err = batch.addAccount(account, report); err != nil {
+			if err = report.record(options.Policy, &ImportError{File: entityAccounts, Line: i + 1, Err: err}); err != nil {
+				return report, err
+			}
+		}
+		if err = batch.observe(entityAccounts, i+1, len(snapshot.Accounts)); err != nil {
+			return report, err
+		}
+	}
+	for i, payment := range snapshot.Payments {
+		if err = batch.addPayment(payment, report); err != nil {
+			if err = report.record(options.Policy, &ImportError{File: entityPayments, Line: i + 1, Err: err}); err != nil {
+				return report, err
+			}
+		}
+		if err = batch.observe(entityPayments, i+1, len(snapshot.Payments)); err != nil {
+			return report, err
+		}
+	}
+	for i, favorite := range snapshot.Favorites {
+		if err = batch.addFavorite(favorite, report); err != nil {
+			if err = report.record(options.Policy, &ImportError{File: entityFavorites, Line: i + 1, Err: err}); err != nil {
+				return report, err
+			}
+		}
+		if err = batch.observe(entityFavorites, i+1, len(snapshot.Favorites)); err != nil {
+			return report, err
+		}
+	}
+
+	return report, batch.commit()
+}
+
+// ExportJSONLines writes a header line followed by one JSON object per
+// account, payment and favorite.
+func (s *Service) ExportJSONLines(w io.Writer) error {
+	writer := bufio.NewWriter(w)
+	encoder := json.NewEncoder(writer)
+
+	err := encodeJSONLine(encoder, jsonLineHeader, jsonHeader{Version: DumpVersion, Created: s.clock().UTC()})
+	if err != nil {
+		return err
+	}
+	for _, account := range s.accounts {
+		if err = encodeJSONLine(encoder, jsonLineAccount, account); err != nil {
+			return err
+		}
+	}
+	for _, payment := range s.payments {
+		if err = encodeJSONLine(encoder, jsonLinePayment, payment); err != nil {
+			return err
+		}
+	}
+	for _, favorite := range s.favorites {
+		if err = encodeJSONLine(encoder, jsonLineFavorite, favorite); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+func encodeJSONLine(encoder *json.Encoder, lineType string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return encoder.Encode(jsonLine{Type: lineType, Data: data})
+}
+
+func (s *Service) ImportJSONLines(r io.Reader) error {
+	_, err := s.ImportJSONLinesWithOptions(r, ImportOptions{})
+	return err
+}
+
+func (s *Service) ImportJSONLinesWithOptions(r io.Reader, options ImportOptions) (*ImportReport, error) {
+	return s.importJSONLines(context.Background(), r, options)
+}
+
+func (s *Service) importJSONLines(ctx context.Context, r io.Reader, options ImportOptions) (*ImportReport, error) {
+	report := &ImportReport{DryRun: options.DryRun}
+	batch := s.newImportBatch(ctx, options)
+	defer batch.rollback()
+	reader := bufio.NewReader(newContextReader(ctx, r))
+	counts := make(map[string]int)
+
+	for number := 1; ; number++ {
+		data, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return report, err
+		}
+		if removeEndLine(string(data)) != "" {
+			entity, lineErr := s.addJSONLine(batch, data, report)
+			if lineErr != nil {
+				importErr := &ImportError{File: "jsonl", Line: number, Err: lineErr}
+				if errors.Is(lineErr, ErrUnsupportedDumpVersion) {
+					return report, report.fail(importErr)
+				}
+				if lineErr = report.record(options.Policy, importErr); lineErr != nil {
+					return report, lineErr
+				}
+			}
+			if entity != "" {
+				counts[entity]++
+				if lineErr = batch.observe(entity, counts[entity], 0); lineErr != nil {
+					return report, lineErr
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	return report, batch.commit()
+}
+
+// addJSONLine merges one line of a JSON lines import and returns the entity
+// of its record, empty for a header or an unreadable line.
+func (s *Service) addJSONLine(batch *importBatch, data []byte, report *ImportReport) (string, error) {
+	line := jsonLine{}
+	if err := json.Unmarshal(data, &line); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+	}
+
+	switch line.Type {
+	case jsonLineHeader:
+		header := jsonHeader{}
+		if err := json.Unmarshal(line.Data, &header); err != nil {
+			return "", fmt.Errorf("%w: %v", ErrInvalidDumpHeader, err)
+		}
+		if header.Version < 1 || header.Version > DumpVersion {
+			return "", fmt.Errorf("%w: %d", ErrUnsupportedDumpVersion, header.Version)
+		}
+		return "", nil
+	case jsonLineAccount:
+		var account *types.Account
+		if err := json.Unmarshal(line.Data, &account); err != nil {
+			return entityAccounts, fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+		}
+		return entityAccounts, batch.addAccount(account, report)
+	case jsonLinePayment:
+		var payment *types.Payment
+		if err := json.Unmarshal(line.Data, &payment); err != nil {
+			return entityPayments, fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+		}
+		return entityPayments, batch.addPayment(payment, report)
+	case jsonLineFavorite:
+		var favorite *types.Favorite
+		if err := json.Unmarshal(line.Data, &favorite); err != nil {
+			return entityFavorites, fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+		}
+		return entityFavorites, batch.addFavorite(favorite, report)
+	}
+	return "", fmt.Errorf("%w: unknown line type %q", ErrInvalidRecord, line.Type)
+}
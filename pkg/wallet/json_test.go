@@ -0,0 +1,109 @@
+package wallet
+
+import (
+	"bytes"
+	"errors"
+	"github.com/bdaler/wallet/pkg/types"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newExportTestService() *testService {
+	s := newTestService()
+	s.now = func() time.Time { return time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC) }
+	account1, _ := s.AddAccountWithBalance("9127660305", 100)
+	payment, _ := s.Pay(account1.ID, 10, types.CategoryIt)
+	_, _ = s.FavoritePayment(payment.ID, "internet; \"home\"")
+	account2, _ := s.AddAccountWithBalance("9127660306", 50)
+	_, _ = s.Pay(account2.ID, 20, types.CategoryFood)
+	return s
+}
+
+func TestService_ExportJSON_roundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		export func(s *Service, buf *bytes.Buffer) error
+		load   func(s *Service, buf *bytes.Buffer) error
+	}{
+		{
+			name:   "snapshot",
+			export: func(s *Service, buf *bytes.Buffer) error { return s.ExportJSON(buf) },
+			load:   func(s *Service, buf *bytes.Buffer) error { return s.ImportJSON(buf) },
+		},
+		{
+			name:   "lines",
+			export: func(s *Service, buf *bytes.Buffer) error { return s.ExportJSONLines(buf) },
+			load:   func(s *Service, buf *bytes.Buffer) error { return s.ImportJSONLines(buf) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newExportTestService()
+			buf := bytes.Buffer{}
+			if err := tt.export(s.Service, &buf); err != nil {
+				t.Fatal(err)
+			}
+
+			i := newTestService()
+			i.now = s.now
+			if err := tt.load(i.Service, &buf); err != nil {
+				t.Fatal(err)
+			}
+
+			want, got := bytes.Buffer{}, bytes.Buffer{}
+			_ = s.ExportTo(&want)
+			_ = i.ExportTo(&got)
+			if want.String() != got.String() {
+				t.Errorf("dump after JSON import = %q, want %q", got.String(), want.String())
+			}
+		})
+	}
+}
+
+func TestService_ImportJSONLines_errors(t *testing.T) {
+	input := `{"type":"header","data":{"version":2}}
+{"type":"account","data":{"id":1,"phone":"9127660305","balance":10}}
+{"type":"payment","data":{"id":"p1","account_id":7,"amount":10,"status":"OK"}}
+{"type":"unknown","data":{}}
+`
+	s := newTestService()
+	report, err := s.ImportJSONLinesWithOptions(strings.NewReader(input), ImportOptions{Policy: ImportBestEffort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Accounts != 1 || len(report.Errors) != 2 || report.Errors[0].Line != 3 {
+		t.Errorf("ImportJSONLinesWithOptions() report = %+v", report)
+	}
+
+	err = s.ImportJSONLines(strings.NewReader(`{"type":"header","data":{"version":9}}` + "\n"))
+	if !errors.Is(err, ErrUnsupportedDumpVersion) {
+		t.Errorf("ImportJSONLines() error = %v, want %v", err, ErrUnsupportedDumpVersion)
+	}
+}
+
+func TestService_ImportJSON_null(t *testing.T) {
+	inputs := []struct {
+		name string
+		run  func(s *Service) (*ImportReport, error)
+	}{
+		{name: "snapshot", run: func(s *Service) (*ImportReport, error) {
+			return s.ImportJSONWithOptions(strings.NewReader(`{"version":2,"accounts":[null],"payments":[null],"favorites":[null]}`), ImportOptions{Policy: ImportBestEffort})
+		}},
+		{name: "lines", run: func(s *Service) (*ImportReport, error) {
+			input := "{\"type\":\"account\",\"data\":null}\n{\"type\":\"payment\",\"data\":null}\n{\"type\":\"favorite\",\"data\":null}\n"
+			return s.ImportJSONLinesWithOptions(strings.NewReader(input), ImportOptions{Policy: ImportBestEffort})
+		}},
+	}
+	for _, tt := range inputs {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := tt.run(newTestService().Service)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(report.Errors) != 3 || !errors.Is(report.Errors[0], ErrInvalidRecord) {
+				t.Errorf("import errors = %v, want 3 %v", report.Errors, ErrInvalidRecord)
+			}
+		})
+	}
+}
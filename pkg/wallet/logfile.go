@@ -0,0 +1,78 @@
+package wallet
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+)
+
+// openLogFile opens the append-only JSON Lines file at path and passes every
+// complete line to fn. A last line without newline is a write cut short by a
+// crash; it is cut off, so the next append starts on a line of its own.
+func openLogFile(path string, name string, fn func(line []byte) error) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(file)
+	var complete int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			_ = file.Close()
+			return nil, err
+		}
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			if fnErr := fn(line); fnErr != nil {
+				_ = file.Close()
+				return nil, fnErr
+			}
+			complete += int64(len(line))
+		} else if len(line) > 0 {
+			log.Print(name, ": cutting off incomplete last line of ", path)
+			if truncateErr := file.Truncate(complete); truncateErr != nil {
+				_ = file.Close()
+				return nil, truncateErr
+			}
+		}
+		if err == io.EOF {
+			return file, nil
+		}
+	}
+}
+
+// appendLogLine writes v as one line and syncs it to disk.
+func appendLogLine(file *os.File, v interface{}) error {
+	return appendLogLines(file, v)
+}
+
+// appendLogLines writes every value as one line with a single write and syncs
+// them to disk. A failed write is cut off again, so either all lines are
+// appended or none.
+func appendLogLines(file *os.File, values ...interface{}) error {
+	var data []byte
+	for _, v := range values {
+		line, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		if truncateErr := file.Truncate(info.Size()); truncateErr != nil {
+			log.Print(truncateErr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,256 @@
+package wallet
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/bdaler/wallet/pkg/types"
+	"github.com/google/uuid"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrOutboxEntryNotFound = errors.New("outbox entry not found")
+
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliveryDelivered DeliveryStatus = "delivered"
+	DeliveryDead      DeliveryStatus = "dead"
+
+	deliveryRemoved DeliveryStatus = "removed"
+)
+
+// OutboxMessage announces a payment status change. Payment is the payment as
+// it is once the change is applied.
+type OutboxMessage struct {
+	ID      string        `json:"id"`
+	Seq     int64         `json:"seq"`
+	Type    EventType     `json:"type"`
+	Payment types.Payment `json:"payment"`
+	Created time.Time     `json:"created"`
+}
+
+// OutboxEntry is a message together with the state of its delivery.
+type OutboxEntry struct {
+	Message     OutboxMessage  `json:"message"`
+	Status      DeliveryStatus `json:"status"`
+	Attempts    int            `json:"attempts"`
+	NextAttempt time.Time      `json:"next_attempt"`
+	LastError   string         `json:"last_error,omitempty"`
+}
+
+// OutboxStore keeps outbox entries. Append must not return before the entry
+// is stored: the payment change it describes is only applied afterwards.
+// Remove takes back the entry of a change that failed after it was appended.
+type OutboxStore interface {
+	Append(entry OutboxEntry) error
+	Update(entry OutboxEntry) error
+	Remove(ID string) error
+	// Entries returns all entries ordered by message sequence.
+	Entries() ([]OutboxEntry, error)
+}
+
+// SetOutbox makes Pay, Reject and Complete write a message to store before
+// they change the payment. A change whose message cannot be written fails
+// without touching the service, and the message of a change that fails
+// afterwards, because its event cannot be stored, is removed again.
+func (s *Service) SetOutbox(store OutboxStore) error {
+	s.outbox = store
+	s.outboxSeq = 0
+	if store == nil {
+		return nil
+	}
+
+	entries, err := store.Entries()
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		s.outboxSeq = entries[len(entries)-1].Message.Seq
+	}
+	return nil
+}
+
+// withOutbox writes the message for payment as it is after the change, then
+// makes the change.
+func (s *Service) withOutbox(eventType EventType, payment types.Payment, change func() error) error {
+	ID, err := s.writeOutbox(eventType, payment)
+	if err != nil {
+		return err
+	}
+	if err = change(); err != nil && ID != "" {
+		if removeErr := s.outbox.Remove(ID); removeErr != nil {
+			log.Print(removeErr)
+		}
+	}
+	return err
+}
+
+// writeOutbox stores the message for payment and returns its ID, empty
+// without an outbox.
+func (s *Service) writeOutbox(eventType EventType, payment types.Payment) (string, error) {
+	if s.outbox == nil {
+		return "", nil
+	}
+
+	now := s.clock()
+	entry := OutboxEntry{
+		Message: OutboxMessage{
+			ID:      uuid.New().String(),
+			Seq:     s.outboxSeq + 1,
+			Type:    eventType,
+			Payment: payment,
+			Created: now,
+		},
+		Status:      DeliveryPending,
+		NextAttempt: now,
+	}
+	if err := s.outbox.Append(entry); err != nil {
+		return "", err
+	}
+	s.outboxSeq++
+	return entry.Message.ID, nil
+}
+
+type MemoryOutbox struct {
+	mu      sync.Mutex
+	entries []OutboxEntry
+}
+
+func (m *MemoryOutbox) Append(entry OutboxEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = append(m.entries, entry)
+	return nil
+}
+
+func (m *MemoryOutbox) Update(entry OutboxEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.entries {
+		if m.entries[i].Message.ID == entry.Message.ID {
+			m.entries[i] = entry
+			return nil
+		}
+	}
+	return ErrOutboxEntryNotFound
+}
+
+func (m *MemoryOutbox) Remove(ID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.entries {
+		if m.entries[i].Message.ID == ID {
+			m.entries = append(m.entries[:i], m.entries[i+1:]...)
+			return nil
+		}
+	}
+	return ErrOutboxEntryNotFound
+}
+
+func (m *MemoryOutbox) Entries() ([]OutboxEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]OutboxEntry(nil), m.entries...), nil
+}
+
+// FileOutbox keeps the outbox in a JSON Lines file. Every append and update
+// adds a line holding the whole entry and is synced to disk before it
+// returns; the last line of an entry wins when the file is opened again. A
+// removal adds the entry with the status removed, which drops it.
+type FileOutbox struct {
+	mu     sync.Mutex
+	memory MemoryOutbox
+	file   *os.File
+}
+
+func OpenFileOutbox(path string) (*FileOutbox, error) {
+	outbox := &FileOutbox{}
+	indexes := make(map[string]int)
+	file, err := openLogFile(path, "outbox", func(line []byte) error {
+		entry := OutboxEntry{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return err
+		}
+		if i, ok := indexes[entry.Message.ID]; ok {
+			outbox.memory.entries[i] = entry
+		} else {
+			indexes[entry.Message.ID] = len(outbox.memory.entries)
+			outbox.memory.entries = append(outbox.memory.entries, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	outbox.file = file
+
+	kept := outbox.memory.entries[:0]
+	for _, entry := range outbox.memory.entries {
+		if entry.Status != deliveryRemoved {
+			kept = append(kept, entry)
+		}
+	}
+	outbox.memory.entries = kept
+	sort.SliceStable(outbox.memory.entries, func(i, j int) bool {
+		return outbox.memory.entries[i].Message.Seq < outbox.memory.entries[j].Message.Seq
+	})
+	return outbox, nil
+}
+
+func (f *FileOutbox) Append(entry OutboxEntry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := appendLogLine(f.file, entry); err != nil {
+		return err
+	}
+	return f.memory.Append(entry)
+}
+
+func (f *FileOutbox) Update(entry OutboxEntry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.find(entry.Message.ID); err != nil {
+		return err
+	}
+	if err := appendLogLine(f.file, entry); err != nil {
+		return err
+	}
+	return f.memory.Update(entry)
+}
+
+func (f *FileOutbox) Remove(ID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entry, err := f.find(ID)
+	if err != nil {
+		return err
+	}
+	entry.Status = deliveryRemoved
+	if err = appendLogLine(f.file, entry); err != nil {
+		return err
+	}
+	return f.memory.Remove(ID)
+}
+
+func (f *FileOutbox) Entries() ([]OutboxEntry, error) {
+	return f.memory.Entries()
+}
+
+func (f *FileOutbox) Close() error {
+	return f.file.Close()
+}
+
+func (f *FileOutbox) find(ID string) (OutboxEntry, error) {
+	entries, _ := f.memory.Entries()
+	for _, entry := range entries {
+		if entry.Message.ID == ID {
+			return entry, nil
+		}
+	}
+	return OutboxEntry{}, ErrOutboxEntryNotFound
+}
@@ -0,0 +1,149 @@
+package wallet
+
+import (
+	"errors"
+	"github.com/bdaler/wallet/pkg/types"
+	"path/filepath"
+	"testing"
+)
+
+type failingOutbox struct {
+	MemoryOutbox
+}
+
+var errOutboxDown = errors.New("outbox is down")
+
+func (f *failingOutbox) Append(entry OutboxEntry) error {
+	return errOutboxDown
+}
+
+func TestService_SetOutbox(t *testing.T) {
+	s := newTestService()
+	outbox := &MemoryOutbox{}
+	_ = s.SetOutbox(outbox)
+
+	account, _ := s.AddAccountWithBalance("9127660305", 100)
+	payment1, _ := s.Pay(account.ID, 10, types.CategoryIt)
+	payment2, _ := s.Pay(account.ID, 20, types.CategoryIt)
+	_ = s.Reject(payment1.ID)
+	_ = s.Complete(payment2.ID)
+
+	entries, _ := outbox.Entries()
+	want := []struct {
+		eventType EventType
+		paymentID string
+		status    types.PaymentStatus
+	}{
+		{EventPaymentCreated, payment1.ID, types.PaymentStatusInProgress},
+		{EventPaymentCreated, payment2.ID, types.PaymentStatusInProgress},
+		{EventPaymentRejected, payment1.ID, types.PaymentStatusFail},
+		{EventPaymentCompleted, payment2.ID, types.PaymentStatusOK},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("SetOutbox() entries = %+v", entries)
+	}
+	for i, entry := range entries {
+		message := entry.Message
+		if message.Seq != int64(i+1) || message.Type != want[i].eventType ||
+			message.Payment.ID != want[i].paymentID || message.Payment.Status != want[i].status || entry.Status != DeliveryPending {
+			t.Errorf("SetOutbox() entry %d = %+v", i, entry)
+		}
+	}
+}
+
+func TestService_Pay_outboxFailure(t *testing.T) {
+	s := newTestService()
+	account, _ := s.AddAccountWithBalance("9127660305", 100)
+	payment, _ := s.Pay(account.ID, 10, types.CategoryIt)
+	_ = s.SetOutbox(&failingOutbox{})
+
+	if _, err := s.Pay(account.ID, 10, types.CategoryIt); err != errOutboxDown {
+		t.Errorf("Pay() error = %v, want %v", err, errOutboxDown)
+	}
+	if err := s.Reject(payment.ID); err != errOutboxDown {
+		t.Errorf("Reject() error = %v, want %v", err, errOutboxDown)
+	}
+	if account.Balance != 90 || len(s.payments) != 1 || payment.Status != types.PaymentStatusInProgress {
+		t.Errorf("failed outbox write changed the service: balance = %d, payments = %d", account.Balance, len(s.payments))
+	}
+}
+
+func TestOpenFileOutbox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	outbox, err := OpenFileOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestService()
+	_ = s.SetOutbox(outbox)
+	account, _ := s.AddAccountWithBalance("9127660305", 100)
+	payment, _ := s.Pay(account.ID, 10, types.CategoryIt)
+	entries, _ := outbox.Entries()
+	entries[0].Status = DeliveryDelivered
+	_ = outbox.Update(entries[0])
+	_ = outbox.Close()
+
+	reopened, err := OpenFileOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = reopened.Close()
+	}()
+
+	entries, _ = reopened.Entries()
+	if len(entries) != 1 || entries[0].Status != DeliveryDelivered || entries[0].Message.Payment.ID != payment.ID {
+		t.Errorf("OpenFileOutbox() entries = %+v", entries)
+	}
+
+	_ = s.SetOutbox(reopened)
+	_ = s.Reject(payment.ID)
+	entries, _ = reopened.Entries()
+	if len(entries) != 2 || entries[1].Message.Seq != 2 {
+		t.Errorf("SetOutbox() did not continue the sequence: %+v", entries)
+	}
+}
+
+func TestService_Pay_eventStoreFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	outbox, err := OpenFileOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestService()
+	_ = s.SetOutbox(outbox)
+	account, _ := s.AddAccountWithBalance("9127660305", 100)
+	payment, _ := s.Pay(account.ID, 10, types.CategoryIt)
+	errDisk := errors.New("disk full")
+	_ = s.SetEventStore(&failingEventStore{err: errDisk})
+
+	if _, err = s.Pay(account.ID, 10, types.CategoryIt); err != errDisk {
+		t.Errorf("Pay() error = %v, want %v", err, errDisk)
+	}
+	if err = s.Complete(payment.ID); err != errDisk {
+		t.Errorf("Complete() error = %v, want %v", err, errDisk)
+	}
+	if err = s.Reject(payment.ID); err != errDisk {
+		t.Errorf("Reject() error = %v, want %v", err, errDisk)
+	}
+	if _, err = s.Refund(payment.ID, 10); err != errDisk {
+		t.Errorf("Refund() error = %v, want %v", err, errDisk)
+	}
+	entries, _ := outbox.Entries()
+	if len(entries) != 1 || entries[0].Message.Payment.ID != payment.ID {
+		t.Errorf("Entries() after failed events = %+v", entries)
+	}
+	_ = outbox.Close()
+
+	reopened, err := OpenFileOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = reopened.Close()
+	}()
+	if entries, _ = reopened.Entries(); len(entries) != 1 {
+		t.Errorf("OpenFileOutbox() kept removed entries: %+v", entries)
+	}
+}
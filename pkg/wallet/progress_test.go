@@ -0,0 +1,193 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"github.com/bdaler/wallet/pkg/types"
+	"sync"
+	"testing"
+)
+
+func TestService_SumPaymentsWithProgress_parts(t *testing.T) {
+	s := newQueryTestService(10_000)
+
+	updates := 0
+	last := make(map[int]types.Progress)
+	ch := s.SumPaymentsWithProgress()
+	for progress := range ch {
+		updates++
+		if progress.Processed < last[progress.Part].Processed || progress.Processed > progress.Total {
+			t.Errorf("SumPaymentsWithProgress() got out of order update %+v", progress)
+		}
+		last[progress.Part] = progress
+	}
+
+	sum := types.Money(0)
+	for part, progress := range last {
+		if progress.Processed != progress.Total {
+			t.Errorf("SumPaymentsWithProgress() part %d ended at %d of %d", part, progress.Processed, progress.Total)
+		}
+		sum += progress.Result
+	}
+	if want := s.SumPayments(0); sum != want {
+		t.Errorf("SumPaymentsWithProgress() got = %v, want %v", sum, want)
+	}
+	if updates <= len(last) || updates != cap(ch) {
+		t.Errorf("SumPaymentsWithProgress() sent %d updates for %d parts, buffered %d", updates, len(last), cap(ch))
+	}
+}
+
+func TestService_SelectPayments_progress(t *testing.T) {
+	s := newQueryTestService(3_000)
+	mu := sync.Mutex{}
+	results := make(map[int]types.Money)
+	selected, err := s.SelectPayments(context.Background(), QueryOptions{
+		Workers: 3,
+		Progress: func(progress types.Progress) {
+			mu.Lock()
+			results[progress.Part] = progress.Result
+			mu.Unlock()
+		},
+	}, func(payment types.Payment) bool {
+		return payment.AccountID == 1
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := types.Money(0)
+	for _, payment := range selected {
+		want += payment.Amount
+	}
+	if got := results[0] + results[1] + results[2]; got != want {
+		t.Errorf("SelectPayments() progress result = %v, want %v", got, want)
+	}
+}
+
+func TestService_ExportToWithProgress(t *testing.T) {
+	s := newExportTestService()
+	_ = s.Deposit(1, 10_000)
+	for i := 0; i < 2_500; i++ {
+		_, _ = s.Pay(1, 1, types.CategoryIt)
+	}
+
+	buf := bytes.Buffer{}
+	var exported []types.Progress
+	err := s.ExportToWithProgress(context.Background(), &buf, func(progress types.Progress) {
+		exported = append(exported, progress)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var imported []types.Progress
+	i := newTestService()
+	_, err = i.ImportFromWithProgress(context.Background(), bytes.NewReader(buf.Bytes()), ImportOptions{
+		Progress: func(progress types.Progress) {
+			imported = append(imported, progress)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, updates := range map[string][]types.Progress{"export": exported, "import": imported} {
+		final := updates[len(updates)-1]
+		if len(updates) != 5 || final.Part != 2 || final.Processed != final.Total {
+			t.Errorf("%s progress = %+v", name, updates)
+		}
+		if want := s.SumPayments(0); final.Result != want {
+			t.Errorf("%s progress result = %v, want %v", name, final.Result, want)
+		}
+	}
+}
+
+func TestService_ImportWithProgress_formats(t *testing.T) {
+	s := newExportTestService()
+	_ = s.Deposit(1, 10_000)
+	for i := 0; i < 2_500; i++ {
+		_, _ = s.Pay(1, 1, types.CategoryIt)
+	}
+
+	tests := []struct {
+		name      string
+		export    func(buf *bytes.Buffer) error
+		load      func(i *Service, buf *bytes.Buffer, options ImportOptions) error
+		processed int
+		total     int
+	}{
+		{
+			name:   "json",
+			export: func(buf *bytes.Buffer) error { return s.ExportJSON(buf) },
+			load: func(i *Service, buf *bytes.Buffer, options ImportOptions) error {
+				_, err := i.ImportJSONWithOptions(buf, options)
+				return err
+			},
+			processed: len(s.payments),
+			total:     len(s.payments),
+		},
+		{
+			name:   "jsonl",
+			export: func(buf *bytes.Buffer) error { return s.ExportJSONLines(buf) },
+			load: func(i *Service, buf *bytes.Buffer, options ImportOptions) error {
+				_, err := i.ImportJSONLinesWithOptions(buf, options)
+				return err
+			},
+			processed: 2_000,
+		},
+		{
+			name:   "csv",
+			export: func(buf *bytes.Buffer) error { return s.ExportPaymentsCSV(buf, CSVOptions{}) },
+			load: func(i *Service, buf *bytes.Buffer, options ImportOptions) error {
+				_, _ = i.AddAccountWithBalance("9127660305", 0)
+				_, _ = i.AddAccountWithBalance("9127660306", 0)
+				_, err := i.ImportPaymentsCSV(buf, CSVOptions{}, options)
+				return err
+			},
+			processed: 2_000,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := bytes.Buffer{}
+			if err := tt.export(&buf); err != nil {
+				t.Fatal(err)
+			}
+
+			var updates []types.Progress
+			options := ImportOptions{Progress: func(progress types.Progress) {
+				if progress.Part == 1 {
+					updates = append(updates, progress)
+				}
+			}}
+			if err := tt.load(newTestService().Service, &buf, options); err != nil {
+				t.Fatal(err)
+			}
+			if len(updates) < 2 {
+				t.Fatalf("import progress = %+v", updates)
+			}
+			final := updates[len(updates)-1]
+			if final.Processed != tt.processed || final.Total != tt.total {
+				t.Errorf("import progress = %+v", final)
+			}
+		})
+	}
+}
+
+func TestService_ImportFromWithProgress_canceled(t *testing.T) {
+	s := newExportTestService()
+	buf := bytes.Buffer{}
+	_ = s.ExportTo(&buf)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.ExportToWithProgress(ctx, &bytes.Buffer{}, nil); err != context.Canceled {
+		t.Errorf("ExportToWithProgress() error = %v, want %v", err, context.Canceled)
+	}
+
+	i := newTestService()
+	_, err := i.ImportFromWithProgress(ctx, &buf, ImportOptions{})
+	if err != context.Canceled || len(i.accounts) != 0 {
+		t.Errorf("ImportFromWithProgress() error = %v, accounts = %v", err, i.accounts)
+	}
+}
@@ -0,0 +1,208 @@
+package wallet
+
+import (
+	"context"
+	"github.com/bdaler/wallet/pkg/types"
+	"runtime"
+	"sync"
+)
+
+// queryCheckEvery is how many payments a worker processes between checks of
+// the context.
+const queryCheckEvery = 1024
+
+// progressEvery is how many records are processed between progress updates.
+const progressEvery = 1000
+
+// ProgressFunc receives progress updates. Queries call it from their worker
+// goroutines, so it must be safe for concurrent use.
+type ProgressFunc func(progress types.Progress)
+
+type QueryOptions struct {
+	// Workers limits the number of goroutines. Zero or less uses one per CPU;
+	// it is never more than the number of payments.
+	Workers int
+	// Progress, when set, receives updates for every part: Processed and
+	// Total count the payments of the part and Result is its partial result.
+	// The last update of a part has Processed == Total.
+	Progress ProgressFunc
+}
+
+func (o QueryOptions) workers(payments int) int {
+	workers := o.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > payments {
+		workers = payments
+	}
+	return workers
+}
+
+// updates returns how many progress updates a query over payments sends.
+func (o QueryOptions) updates(payments int) int {
+	workers := o.workers(payments)
+	updates := 0
+	for part := 0; part < workers; part++ {
+		size := (part+1)*payments/workers - part*payments/workers
+		updates += (size + progressEvery - 1) / progressEvery
+	}
+	return updates
+}
+
+// queryParts splits the payments of s into contiguous parts, one per worker,
+// and runs fn on each part concurrently. Results are returned in part order,
+// so callers that merge them in that order see the payments in store order.
+func queryParts[T any](ctx context.Context, s *Service, options QueryOptions, fn func(ctx context.Context, part int, payments []*types.Payment) T) ([]T, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	payments := s.payments
+	workers := options.workers(len(payments))
+	results := make([]T, workers)
+
+	wg := sync.WaitGroup{}
+	for part := 0; part < workers; part++ {
+		from := part * len(payments) / workers
+		to := (part + 1) * len(payments) / workers
+		wg.Add(1)
+		go func(part int, payments []*types.Payment) {
+			defer wg.Done()
+			results[part] = fn(ctx, part, payments)
+		}(part, payments[from:to])
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// eachPayment calls fn for every payment until ctx is done. When progress is
+// set, it is called with the number of processed payments every
+// progressEvery payments and after the last one.
+func eachPayment(ctx context.Context, payments []*types.Payment, fn func(payment types.Payment), progress func(processed int)) {
+	for i, payment := range payments {
+		if i%queryCheckEvery == 0 && ctx.Err() != nil {
+			return
+		}
+		fn(*payment)
+		if progress != nil && ((i+1)%progressEvery == 0 || i+1 == len(payments)) {
+			progress(i + 1)
+		}
+	}
+}
+
+// partProgress adapts options.Progress to eachPayment; result returns the
+// partial result of the part.
+func (o QueryOptions) partProgress(part int, total int, result func() types.Money) func(processed int) {
+	if o.Progress == nil {
+		return nil
+	}
+	return func(processed int) {
+		o.Progress(types.Progress{Part: part, Processed: processed, Total: total, Result: result()})
+	}
+}
+
+// MapPayments returns fn applied to every payment of s, in store order.
+func MapPayments[T any](ctx context.Context, s *Service, options QueryOptions, fn func(payment types.Payment) T) ([]T, error) {
+	parts, err := queryParts(ctx, s, options, func(ctx context.Context, part int, payments []*types.Payment) []T {
+		mapped := make([]T, 0, len(payments))
+		eachPayment(ctx, payments, func(payment types.Payment) {
+			mapped = append(mapped, fn(payment))
+		}, options.partProgress(part, len(payments), func() types.Money { return 0 }))
+		return mapped
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var mapped []T
+	for _, part := range parts {
+		mapped = append(mapped, part...)
+	}
+	return mapped, nil
+}
+
+// SelectPayments returns the payments matching filter, in store order. The
+// partial result of its progress is the amount of the selected payments.
+func (s *Service) SelectPayments(ctx context.Context, options QueryOptions, filter func(payment types.Payment) bool) ([]types.Payment, error) {
+	parts, err := queryParts(ctx, s, options, func(ctx context.Context, part int, payments []*types.Payment) []types.Payment {
+		var selected []types.Payment
+		amount := types.Money(0)
+		eachPayment(ctx, payments, func(payment types.Payment) {
+			if filter(payment) {
+				selected = append(selected, payment)
+				amount += payment.Amount
+			}
+		}, options.partProgress(part, len(payments), func() types.Money { return amount }))
+		return selected
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []types.Payment
+	for _, part := range parts {
+		selected = append(selected, part...)
+	}
+	return selected, nil
+}
+
+// Reducer folds payments into an accumulator of type T. Zero is called once
+// per part so that parts never share an accumulator; Combine merges the part
+// results in store order. Money, when set, gives the partial result reported
+// as progress.
+type Reducer[T any] struct {
+	Zero    func() T
+	Reduce  func(acc T, payment types.Payment) T
+	Combine func(acc T, part T) T
+	Money   func(acc T) types.Money
+}
+
+// ReducePayments folds every part of the payments of s with reducer and
+// merges the part results.
+func ReducePayments[T any](ctx context.Context, s *Service, options QueryOptions, reducer Reducer[T]) (T, error) {
+	parts, err := queryParts(ctx, s, options, func(ctx context.Context, part int, payments []*types.Payment) T {
+		acc := reducer.Zero()
+		eachPayment(ctx, payments, func(payment types.Payment) {
+			acc = reducer.Reduce(acc, payment)
+		}, options.partProgress(part, len(payments), func() types.Money {
+			if reducer.Money == nil {
+				return 0
+			}
+			return reducer.Money(acc)
+		}))
+		return acc
+	})
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+
+	result := reducer.Zero()
+	for _, part := range parts {
+		result = reducer.Combine(result, part)
+	}
+	return result, nil
+}
+
+// moneyReducer sums an amount taken from every payment.
+func moneyReducer(amount func(payment types.Payment) types.Money) Reducer[types.Money] {
+	return Reducer[types.Money]{
+		Zero:    func() types.Money { return 0 },
+		Reduce:  func(acc types.Money, payment types.Payment) types.Money { return acc + amount(payment) },
+		Combine: func(acc types.Money, part types.Money) types.Money { return acc + part },
+		Money:   func(acc types.Money) types.Money { return acc },
+	}
+}
+
+// SumPaymentsWithOptions adds up the amounts of all payments. The last
+// progress updates of all parts add up to the returned sum.
+func (s *Service) SumPaymentsWithOptions(ctx context.Context, options QueryOptions) (types.Money, error) {
+	return ReducePayments(ctx, s, options, moneyReducer(func(payment types.Payment) types.Money {
+		return payment.Amount
+	}))
+}
@@ -0,0 +1,91 @@
+package wallet
+
+import (
+	"context"
+	"github.com/bdaler/wallet/pkg/types"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func newQueryTestService(count int) *testService {
+	s := newTestService()
+	for i := 0; i < count; i++ {
+		s.payments = append(s.payments, &types.Payment{
+			ID:        strconv.Itoa(i),
+			AccountID: int64(i%3 + 1),
+			Amount:    types.Money(i + 1),
+			Status:    types.PaymentStatusOK,
+		})
+	}
+	return s
+}
+
+func TestService_SumPayments_workers(t *testing.T) {
+	for _, count := range []int{0, 1, 10, 5_000} {
+		s := newQueryTestService(count)
+		want := types.Money(count * (count + 1) / 2)
+		for _, goroutines := range []int{-1, 0, 1, 3, 7, 10_000} {
+			if got := s.SumPayments(goroutines); got != want {
+				t.Errorf("SumPayments(%d) with %d payments got = %v, want %v", goroutines, count, got, want)
+			}
+		}
+	}
+}
+
+func TestService_FilterPaymentsByFn_order(t *testing.T) {
+	s := newQueryTestService(1_000)
+	var want []types.Payment
+	for _, payment := range s.payments {
+		if payment.AccountID == 2 {
+			want = append(want, *payment)
+		}
+	}
+
+	for _, goroutines := range []int{0, 1, 4, 33} {
+		got, err := s.FilterPaymentsByFn(func(payment types.Payment) bool {
+			return payment.AccountID == 2
+		}, goroutines)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("FilterPaymentsByFn(%d) did not keep store order", goroutines)
+		}
+	}
+
+	got, err := s.FilterPaymentsByFn(func(payment types.Payment) bool { return false }, 4)
+	if got != nil || err != nil {
+		t.Errorf("FilterPaymentsByFn() got = %v, %v, want nil", got, err)
+	}
+}
+
+func TestService_MapPayments(t *testing.T) {
+	s := newQueryTestService(100)
+	got, err := MapPayments(context.Background(), s.Service, QueryOptions{Workers: 6}, func(payment types.Payment) string {
+		return payment.ID
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ID := range got {
+		if ID != strconv.Itoa(i) {
+			t.Fatalf("MapPayments() got[%d] = %s, want %d", i, ID, i)
+		}
+	}
+}
+
+func TestService_ReducePayments_canceled(t *testing.T) {
+	s := newQueryTestService(100)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := s.SumPaymentsWithOptions(ctx, QueryOptions{Workers: 4})
+	if err != context.Canceled {
+		t.Errorf("SumPaymentsWithOptions() error = %v, want %v", err, context.Canceled)
+	}
+	_, err = s.SelectPayments(ctx, QueryOptions{}, func(payment types.Payment) bool { return true })
+	if err != context.Canceled {
+		t.Errorf("SelectPayments() error = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,338 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bdaler/wallet/pkg/types"
+	"time"
+)
+
+var ErrPaymentDenied = errors.New("payment denied")
+var ErrPaymentHeld = errors.New("payment is held for review")
+var ErrPaymentNotHeld = errors.New("payment is not held for review")
+
+// RiskInput is what a rule knows about a payment before it is made.
+type RiskInput struct {
+	Payment types.Payment
+	Account types.Account
+	Now     time.Time
+	// Opened is when the account was registered or imported.
+	Opened time.Time
+	// Categories is the category of the payment followed by its parents.
+	Categories []types.PaymentCategory
+	// Attempts are the earlier payment attempts of the account, denied ones
+	// included, oldest first, as far back as the largest AttemptWindow of
+	// the rules.
+	Attempts []RiskAttempt
+	// Payments are the earlier payments of the account.
+	Payments []types.Payment
+}
+
+type RiskAttempt struct {
+	Amount types.Money
+	Time   time.Time
+}
+
+// RiskResult is the decision of a rule; an empty Decision lets the payment
+// through.
+type RiskResult struct {
+	Decision types.PaymentDecision
+	Reason   string
+}
+
+type RiskRule interface {
+	Evaluate(input RiskInput) RiskResult
+}
+
+// AttemptWindow is implemented by rules that look at the attempts of the last
+// Window only. The service keeps the attempts of the largest window of its
+// rules, and of the last 24 hours for rules that do not implement it.
+type AttemptWindow interface {
+	AttemptWindow() time.Duration
+}
+
+const defaultAttemptWindow = 24 * time.Hour
+
+// RiskRuleFunc lets an ordinary function be used as a rule.
+type RiskRuleFunc func(input RiskInput) RiskResult
+
+func (f RiskRuleFunc) Evaluate(input RiskInput) RiskResult {
+	return f(input)
+}
+
+type riskAttempt struct {
+	accountID int64
+	attempt   RiskAttempt
+}
+
+// SetRiskRules makes Pay evaluate rules before each payment. The strictest
+// decision wins: a denied payment is kept as failed and returned with
+// ErrPaymentDenied, a held one waits in PaymentStatusHeld for ReviewPayment,
+// and the others go on as usual. Without rules payments carry no decision.
+func (s *Service) SetRiskRules(rules ...RiskRule) {
+	s.riskRules = append([]RiskRule(nil), rules...)
+}
+
+// assessRisk records the decision of the rules on payment.
+func (s *Service) assessRisk(account *types.Account, payment *types.Payment) types.PaymentDecision {
+	if len(s.riskRules) == 0 {
+		return ""
+	}
+
+	input := RiskInput{
+		Payment:    *payment,
+		Account:    *account,
+		Now:        s.clock(),
+		Categories: s.categoryPath(payment.Category),
+	}
+	if history := s.balances[account.ID]; len(history) > 0 {
+		input.Opened = history[0].Time
+	}
+	s.pruneRiskAttempts(input.Now)
+	for _, attempt := range s.riskAttempts {
+		if attempt.accountID == account.ID {
+			input.Attempts = append(input.Attempts, attempt.attempt)
+		}
+	}
+	for _, earlier := range s.payments {
+		if earlier.AccountID == account.ID {
+			input.Payments = append(input.Payments, *earlier)
+		}
+	}
+	s.riskAttempts = append(s.riskAttempts, &riskAttempt{
+		accountID: account.ID,
+		attempt:   RiskAttempt{Amount: payment.Amount, Time: input.Now},
+	})
+
+	result := RiskResult{Decision: types.DecisionAllow}
+	for _, rule := range s.riskRules {
+		current := rule.Evaluate(input)
+		if riskLevel(current.Decision) > riskLevel(result.Decision) {
+			result = current
+		}
+	}
+	payment.Decision = result.Decision
+	payment.DecisionReason = result.Reason
+	return result.Decision
+}
+
+// pruneRiskAttempts forgets the attempts no rule looks at anymore.
+func (s *Service) pruneRiskAttempts(now time.Time) {
+	window := time.Duration(0)
+	for _, rule := range s.riskRules {
+		current := defaultAttemptWindow
+		if windowed, ok := rule.(AttemptWindow); ok {
+			current = windowed.AttemptWindow()
+		}
+		if current > window {
+			window = current
+		}
+	}
+
+	kept := s.riskAttempts[:0]
+	for _, attempt := range s.riskAttempts {
+		if now.Sub(attempt.attempt.Time) < window {
+			kept = append(kept, attempt)
+		}
+	}
+	for i := len(kept); i < len(s.riskAttempts); i++ {
+		s.riskAttempts[i] = nil
+	}
+	s.riskAttempts = kept
+}
+
+func riskLevel(decision types.PaymentDecision) int {
+	switch decision {
+	case types.DecisionDeny:
+		return 2
+	case types.DecisionHold:
+		return 1
+	}
+	return 0
+}
+
+// denyPayment keeps payment as failed without moving its money and returns it
+// with ErrPaymentDenied, unless it can not be stored.
+func (s *Service) denyPayment(account *types.Account, payment *types.Payment) (*types.Payment, error) {
+	if err := s.addPayment(EventPaymentDenied, account, payment, types.PaymentStatusFail); err != nil {
+		return nil, err
+	}
+	return payment, fmt.Errorf("%w: %s", ErrPaymentDenied, payment.DecisionReason)
+}
+
+func (s *Service) holdPayment(account *types.Account, payment *types.Payment) error {
+	return s.addPayment(EventPaymentHeld, account, payment, types.PaymentStatusHeld)
+}
+
+// addPayment adds payment with status without moving its money.
+func (s *Service) addPayment(eventType EventType, account *types.Account, payment *types.Payment, status types.PaymentStatus) error {
+	added := *payment
+	added.Status = status
+	return s.emit(paymentEvent(eventType, account, &added, 0), func() {
+		payment.Status = status
+		s.payments = append(s.payments, payment)
+		s.touchPayment(payment.ID)
+	})
+}
+
+// ReviewPayment approves or declines a held payment. An approved payment goes
+// on as if the rules had let it through; a declined one fails.
+func (s *Service) ReviewPayment(paymentID string, approve bool) error {
+	payment, err := s.FindPaymentByID(paymentID)
+	if err != nil {
+		return err
+	}
+	if payment.Status != types.PaymentStatusHeld {
+		return ErrPaymentNotHeld
+	}
+
+	account, err := s.FindAccountByID(payment.AccountID)
+	if err != nil {
+		return err
+	}
+
+	if !approve {
+		return s.cancelPayment(account, payment)
+	}
+	if account.Balance < payment.Amount+payment.Fee {
+		return ErrNotEnoughBalance
+	}
+	_, err = s.startPayment(account, payment, false)
+	return err
+}
+
+func ruleDecision(decision types.PaymentDecision, fallback types.PaymentDecision) types.PaymentDecision {
+	if decision == "" {
+		return fallback
+	}
+	return decision
+}
+
+// VelocityRule limits the number and the total amount of the payments an
+// account makes within Window. Zero limits are not checked; Decision
+// defaults to DecisionDeny.
+type VelocityRule struct {
+	Window      time.Duration
+	MaxPayments int
+	MaxAmount   types.Money
+	Decision    types.PaymentDecision
+}
+
+func (r VelocityRule) AttemptWindow() time.Duration {
+	return r.Window
+}
+
+func (r VelocityRule) Evaluate(input RiskInput) RiskResult {
+	count := 1
+	total := input.Payment.Amount
+	for _, attempt := range input.Attempts {
+		if input.Now.Sub(attempt.Time) < r.Window {
+			count++
+			total += attempt.Amount
+		}
+	}
+
+	decision := ruleDecision(r.Decision, types.DecisionDeny)
+	if r.MaxPayments > 0 && count > r.MaxPayments {
+		return RiskResult{Decision: decision, Reason: fmt.Sprintf("%d payments within %v", count, r.Window)}
+	}
+	if r.MaxAmount > 0 && total > r.MaxAmount {
+		return RiskResult{Decision: decision, Reason: fmt.Sprintf("%d paid within %v", total, r.Window)}
+	}
+	return RiskResult{}
+}
+
+// AmountAnomalyRule flags a payment above Factor times the average of the
+// earlier payments of the account that did not fail. It needs MinPayments of
+// them, 3 when zero; Factor defaults to 10 and Decision to DecisionHold.
+type AmountAnomalyRule struct {
+	Factor      int64
+	MinPayments int
+	Decision    types.PaymentDecision
+}
+
+// AttemptWindow is zero, the rule does not look at attempts.
+func (r AmountAnomalyRule) AttemptWindow() time.Duration {
+	return 0
+}
+
+func (r AmountAnomalyRule) Evaluate(input RiskInput) RiskResult {
+	factor := r.Factor
+	if factor <= 0 {
+		factor = 10
+	}
+	minPayments := r.MinPayments
+	if minPayments <= 0 {
+		minPayments = 3
+	}
+
+	count := 0
+	total := types.Money(0)
+	for _, payment := range input.Payments {
+		if payment.Status != types.PaymentStatusFail {
+			count++
+			total += payment.Amount
+		}
+	}
+	if count < minPayments {
+		return RiskResult{}
+	}
+
+	average := total / types.Money(count)
+	if input.Payment.Amount > average*types.Money(factor) {
+		return RiskResult{
+			Decision: ruleDecision(r.Decision, types.DecisionHold),
+			Reason:   fmt.Sprintf("amount %d is over %d times the average %d", input.Payment.Amount, factor, average),
+		}
+	}
+	return RiskResult{}
+}
+
+// NewAccountRule flags payments above MaxAmount from accounts younger than
+// Age. Decision defaults to DecisionHold.
+type NewAccountRule struct {
+	Age       time.Duration
+	MaxAmount types.Money
+	Decision  types.PaymentDecision
+}
+
+// AttemptWindow is zero, the rule does not look at attempts.
+func (r NewAccountRule) AttemptWindow() time.Duration {
+	return 0
+}
+
+func (r NewAccountRule) Evaluate(input RiskInput) RiskResult {
+	if input.Opened.IsZero() || input.Now.Sub(input.Opened) >= r.Age || input.Payment.Amount <= r.MaxAmount {
+		return RiskResult{}
+	}
+	return RiskResult{
+		Decision: ruleDecision(r.Decision, types.DecisionHold),
+		Reason:   fmt.Sprintf("account opened less than %v ago", r.Age),
+	}
+}
+
+// CategoryBlockRule flags payments in Categories or in their sub-categories.
+// Decision defaults to DecisionDeny.
+type CategoryBlockRule struct {
+	Categories []types.PaymentCategory
+	Decision   types.PaymentDecision
+}
+
+// AttemptWindow is zero, the rule does not look at attempts.
+func (r CategoryBlockRule) AttemptWindow() time.Duration {
+	return 0
+}
+
+func (r CategoryBlockRule) Evaluate(input RiskInput) RiskResult {
+	for _, category := range input.Categories {
+		for _, blocked := range r.Categories {
+			if category == blocked {
+				return RiskResult{
+					Decision: ruleDecision(r.Decision, types.DecisionDeny),
+					Reason:   fmt.Sprintf("category %s is blocked", blocked),
+				}
+			}
+		}
+	}
+	return RiskResult{}
+}
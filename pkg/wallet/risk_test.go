@@ -0,0 +1,157 @@
+package wallet
+
+import (
+	"bytes"
+	"errors"
+	"github.com/bdaler/wallet/pkg/types"
+	"testing"
+	"time"
+)
+
+func newRiskTest(rules ...RiskRule) (*testService, *types.Account, *time.Time) {
+	s := newTestService()
+	now := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	account, _ := s.AddAccountWithBalance("9127660305", 10_000)
+	s.SetRiskRules(rules...)
+	return s, account, &now
+}
+
+func TestService_Pay_velocity(t *testing.T) {
+	s, account, now := newRiskTest(VelocityRule{Window: time.Minute, MaxPayments: 2})
+
+	first, _ := s.Pay(account.ID, 10, types.CategoryIt)
+	*now = now.Add(10 * time.Second)
+	_, _ = s.Pay(account.ID, 10, types.CategoryIt)
+	*now = now.Add(10 * time.Second)
+	denied, err := s.Pay(account.ID, 10, types.CategoryIt)
+	if !errors.Is(err, ErrPaymentDenied) {
+		t.Fatalf("Pay() error = %v, want %v", err, ErrPaymentDenied)
+	}
+	if first.Decision != types.DecisionAllow || denied.Decision != types.DecisionDeny || denied.Status != types.PaymentStatusFail || denied.DecisionReason == "" {
+		t.Errorf("Pay() decisions = %+v, %+v", first, denied)
+	}
+	if account.Balance != 10_000-20 {
+		t.Errorf("Pay() balance = %v, want %v", account.Balance, 10_000-20)
+	}
+
+	*now = now.Add(time.Minute)
+	if _, err = s.Pay(account.ID, 10, types.CategoryIt); err != nil {
+		t.Errorf("Pay() after the window error = %v", err)
+	}
+}
+
+func TestService_Pay_amountAnomaly(t *testing.T) {
+	s, account, _ := newRiskTest(AmountAnomalyRule{Factor: 5})
+	for i := 0; i < 3; i++ {
+		_, _ = s.Pay(account.ID, 100, types.CategoryIt)
+	}
+
+	held, err := s.Pay(account.ID, 600, types.CategoryIt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if held.Status != types.PaymentStatusHeld || held.Decision != types.DecisionHold || account.Balance != 10_000-300 {
+		t.Errorf("Pay() status = %v, decision = %v, balance = %v", held.Status, held.Decision, account.Balance)
+	}
+	if _, err = s.Refund(held.ID, 10); err != ErrPaymentHeld {
+		t.Errorf("Refund() error = %v, want %v", err, ErrPaymentHeld)
+	}
+
+	if err = s.ReviewPayment(held.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if held.Status != types.PaymentStatusInProgress || account.Balance != 10_000-900 {
+		t.Errorf("ReviewPayment() status = %v, balance = %v", held.Status, account.Balance)
+	}
+	if err = s.ReviewPayment(held.ID, true); err != ErrPaymentNotHeld {
+		t.Errorf("ReviewPayment() twice error = %v, want %v", err, ErrPaymentNotHeld)
+	}
+}
+
+func TestService_ReviewPayment_confirmation(t *testing.T) {
+	s, account, now := newRiskTest(NewAccountRule{Age: 24 * time.Hour, MaxAmount: 100})
+	sender := &testCodeSender{}
+	s.SetPaymentConfirmation(ConfirmationOptions{Threshold: 500, Sender: sender})
+
+	held, _ := s.Pay(account.ID, 1000, types.CategoryIt)
+	if held.Status != types.PaymentStatusHeld {
+		t.Fatalf("Pay() status = %v, want %v", held.Status, types.PaymentStatusHeld)
+	}
+	if err := s.ReviewPayment(held.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if held.Status != types.PaymentStatusPending {
+		t.Fatalf("ReviewPayment() status = %v, want %v", held.Status, types.PaymentStatusPending)
+	}
+	if err := s.ConfirmPayment(held.ID, sender.codes[held.ID]); err != nil || account.Balance != 9_000 {
+		t.Errorf("ConfirmPayment() error = %v, balance = %v", err, account.Balance)
+	}
+
+	declined, _ := s.Pay(account.ID, 200, types.CategoryIt)
+	if err := s.ReviewPayment(declined.ID, false); err != nil || declined.Status != types.PaymentStatusFail {
+		t.Errorf("ReviewPayment() decline error = %v, status = %v", err, declined.Status)
+	}
+
+	*now = now.Add(48 * time.Hour)
+	if payment, _ := s.Pay(account.ID, 200, types.CategoryIt); payment.Status != types.PaymentStatusInProgress {
+		t.Errorf("Pay() from an older account status = %v", payment.Status)
+	}
+}
+
+func TestService_Pay_pruneAttempts(t *testing.T) {
+	s, account, now := newRiskTest(VelocityRule{Window: time.Minute, MaxPayments: 5}, AmountAnomalyRule{})
+	for i := 0; i < 3; i++ {
+		_, _ = s.Pay(account.ID, 10, types.CategoryIt)
+		*now = now.Add(time.Minute)
+	}
+	if len(s.riskAttempts) != 1 {
+		t.Errorf("Pay() kept %d attempts, want 1", len(s.riskAttempts))
+	}
+
+	s.SetRiskRules(RiskRuleFunc(func(input RiskInput) RiskResult {
+		return RiskResult{}
+	}))
+	*now = now.Add(time.Hour)
+	_, _ = s.Pay(account.ID, 10, types.CategoryIt)
+	if len(s.riskAttempts) != 2 {
+		t.Errorf("Pay() with a rule without window kept %d attempts, want 2", len(s.riskAttempts))
+	}
+}
+
+func TestService_Pay_categoryBlock(t *testing.T) {
+	s, account, _ := newRiskTest(CategoryBlockRule{Categories: []types.PaymentCategory{"gambling"}})
+	_, _ = s.RegisterCategory("gambling", "Gambling", "")
+	_, _ = s.RegisterCategory("casino", "Casino", "gambling")
+	_, _ = s.RegisterCategory(types.CategoryIt, "IT", "")
+
+	if _, err := s.Pay(account.ID, 10, "casino"); !errors.Is(err, ErrPaymentDenied) {
+		t.Errorf("Pay() sub-category error = %v, want %v", err, ErrPaymentDenied)
+	}
+	if _, err := s.Pay(account.ID, 10, types.CategoryIt); err != nil {
+		t.Errorf("Pay() error = %v", err)
+	}
+}
+
+func TestService_Pay_decisionRoundTrip(t *testing.T) {
+	s, account, _ := newRiskTest(RiskRuleFunc(func(input RiskInput) RiskResult {
+		return RiskResult{Decision: types.DecisionHold, Reason: "manual review; always"}
+	}))
+	held, _ := s.Pay(account.ID, 10, types.CategoryIt)
+
+	buffer := &bytes.Buffer{}
+	if err := s.ExportTo(buffer); err != nil {
+		t.Fatal(err)
+	}
+	imported := newTestService()
+	if err := imported.ImportFrom(buffer); err != nil {
+		t.Fatal(err)
+	}
+	payment, err := imported.FindPaymentByID(held.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *payment != *held {
+		t.Errorf("ImportFrom() payment = %+v, want %+v", payment, held)
+	}
+}
@@ -2,18 +2,17 @@ package wallet
 
 import (
 	"bufio"
+	"context"
 	"errors"
-	"fmt"
 	"github.com/bdaler/wallet/pkg/types"
 	"github.com/google/uuid"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 )
 
 var ErrPhoneRegistered = errors.New("phone already registered")
@@ -24,12 +23,40 @@ var ErrPaymentNotFound = errors.New("payment not found")
 var ErrCannotRegisterAccount = errors.New("can not register account")
 var ErrCannotDepositAccount = errors.New("can not deposit account")
 var ErrFavoriteNotFound = errors.New("favorite payment not found")
+var ErrPaymentNotInProgress = errors.New("payment is not in progress")
+var ErrPaymentAlreadyRejected = errors.New("payment already rejected")
 
 type Service struct {
 	nextAccountID int64
 	accounts      []*types.Account
 	payments      []*types.Payment
 	favorites     []*types.Favorite
+	categories    []*types.Category
+	cashbackRules []*types.CashbackRule
+	cashbacks     []*types.Cashback
+	feeRules      []*types.FeeRule
+	refunds       []*types.Refund
+	balances      map[int64][]types.BalanceChange
+	seq           int64
+	changes       map[string]int64
+	now           func() time.Time
+	events        *eventBus
+	outbox        OutboxStore
+	outboxSeq     int64
+	confirmation  ConfirmationOptions
+	confirmations []*confirmation
+	lockouts      map[int64]time.Time
+	totpSecrets   map[int64][]byte
+	totpCounters  map[int64]int64
+	riskRules     []RiskRule
+	riskAttempts  []*riskAttempt
+}
+
+func (s *Service) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
 }
 
 func (s *Service) RegisterAccount(phone types.Phone) (*types.Account, error) {
@@ -38,13 +65,19 @@ func (s *Service) RegisterAccount(phone types.Phone) (*types.Account, error) {
 			return nil, ErrPhoneRegistered
 		}
 	}
-	s.nextAccountID++
 	account := &types.Account{
-		ID:      s.nextAccountID,
+		ID:      s.nextAccountID + 1,
 		Phone:   phone,
 		Balance: 0,
 	}
-	s.accounts = append(s.accounts, account)
+	err := s.emit(accountEvent(EventAccountRegistered, account, 0), func() {
+		s.nextAccountID = account.ID
+		s.accounts = append(s.accounts, account)
+		s.touchAccount(account.ID)
+	})
+	if err != nil {
+		return nil, err
+	}
 	return account, nil
 }
 
@@ -64,10 +97,17 @@ func (s *Service) Deposit(accountID int64, amount types.Money) error {
 		return ErrAccountNotFound
 	}
 
-	account.Balance += amount
-	return nil
+	deposited := *account
+	deposited.Balance += amount
+	return s.emit(accountEvent(EventDeposited, &deposited, amount), func() {
+		account.Balance = deposited.Balance
+		s.touchAccount(account.ID)
+	})
 }
 
+// Pay makes a payment from accountID. A payment the risk rules deny is kept
+// as failed and returned together with ErrPaymentDenied, so the caller can
+// show its decision and reason.
 func (s *Service) Pay(accountID int64, amount types.Money, category types.PaymentCategory) (*types.Payment, error) {
 	if amount <= 0 {
 		return nil, ErrAmountMustBePositive
@@ -78,24 +118,75 @@ func (s *Service) Pay(accountID int64, amount types.Money, category types.Paymen
 		return nil, err
 	}
 
-	if account.Balance < amount {
+	err = s.checkCategory(category)
+	if err != nil {
+		return nil, err
+	}
+
+	fee := s.CalculateFee(amount, category)
+	if account.Balance < amount+fee {
 		return nil, ErrNotEnoughBalance
 	}
 
-	account.Balance -= amount
 	paymentID := uuid.New().String()
 	payment := &types.Payment{
 		ID:        paymentID,
 		AccountID: accountID,
 		Amount:    amount,
+		Fee:       fee,
 		Category:  category,
 		Status:    types.PaymentStatusInProgress,
 	}
+	switch s.assessRisk(account, payment) {
+	case types.DecisionDeny:
+		return s.denyPayment(account, payment)
+	case types.DecisionHold:
+		if err = s.holdPayment(account, payment); err != nil {
+			return nil, err
+		}
+		return payment, nil
+	}
+	return s.startPayment(account, payment, true)
+}
 
-	s.payments = append(s.payments, payment)
+// startPayment asks for the confirmation of payment or moves its money. add
+// tells whether payment still has to be added to the service.
+func (s *Service) startPayment(account *types.Account, payment *types.Payment, add bool) (*types.Payment, error) {
+	if s.confirmation.Threshold > 0 && payment.Amount >= s.confirmation.Threshold {
+		return s.awaitConfirmation(account, payment, add)
+	}
+	if err := s.debit(account, payment, add); err != nil {
+		return nil, err
+	}
 	return payment, nil
 }
 
+// debit writes the outbox message of payment, takes its amount and fee from
+// account and accrues its cashback. add tells whether payment still has to be
+// added to the service.
+func (s *Service) debit(account *types.Account, payment *types.Payment, add bool) error {
+	created := *payment
+	created.Status = types.PaymentStatusInProgress
+	debited := *account
+	debited.Balance -= payment.Amount + payment.Fee
+	event := paymentEvent(EventPaymentCreated, &debited, &created, -(payment.Amount + payment.Fee))
+	if cashback := s.accruedCashback(&created); cashback != nil {
+		event.Cashbacks = []types.Cashback{*cashback}
+	}
+	return s.withOutbox(EventPaymentCreated, created, func() error {
+		return s.emit(event, func() {
+			account.Balance = debited.Balance
+			payment.Status = created.Status
+			if add {
+				s.payments = append(s.payments, payment)
+			}
+			s.saveCashbacks(event.Cashbacks)
+			s.touchAccount(account.ID)
+			s.touchPayment(payment.ID)
+		})
+	})
+}
+
 func (s *Service) FindAccountByID(accountID int64) (*types.Account, error) {
 	for _, account := range s.accounts {
 		if account.ID == accountID {
@@ -120,15 +211,58 @@ func (s *Service) Reject(paymentID string) error {
 		return err
 	}
 
+	if payment.Status == types.PaymentStatusFail {
+		return ErrPaymentAlreadyRejected
+	}
+
 	var account, er = s.FindAccountByID(payment.AccountID)
 	if er != nil {
 		return er
 	}
 
-	payment.Status = types.PaymentStatusFail
-	account.Balance += payment.Amount
+	if payment.Status == types.PaymentStatusPending || payment.Status == types.PaymentStatusHeld {
+		return s.cancelPayment(account, payment)
+	}
 
-	return nil
+	rejected := *payment
+	rejected.Status = types.PaymentStatusFail
+	return s.withOutbox(EventPaymentRejected, rejected, func() error {
+		_, err := s.emitRefund(EventPaymentRejected, account, payment, rejected, payment.Amount-s.refundedAmount(payment.ID))
+		return err
+	})
+}
+
+func (s *Service) Complete(paymentID string) error {
+	payment, err := s.FindPaymentByID(paymentID)
+	if err != nil {
+		return err
+	}
+
+	if payment.Status != types.PaymentStatusInProgress {
+		return ErrPaymentNotInProgress
+	}
+
+	account, err := s.FindAccountByID(payment.AccountID)
+	if err != nil {
+		return err
+	}
+
+	completed := *payment
+	completed.Status = types.PaymentStatusOK
+	cashbacks, change := s.settleCashbacks(payment.ID, true)
+	credited := *account
+	credited.Balance += change
+	event := paymentEvent(EventPaymentCompleted, &credited, &completed, change)
+	event.Cashbacks = cashbacks
+	return s.withOutbox(EventPaymentCompleted, completed, func() error {
+		return s.emit(event, func() {
+			account.Balance = credited.Balance
+			payment.Status = completed.Status
+			s.saveCashbacks(cashbacks)
+			s.touchAccount(account.ID)
+			s.touchPayment(payment.ID)
+		})
+	})
 }
 
 func (s *Service) AddAccountWithBalance(phone types.Phone, balance types.Money) (*types.Account, error) {
@@ -164,6 +298,10 @@ func (s *Service) FavoritePayment(paymentID string, name string) (*types.Favorit
 		return nil, err
 	}
 
+	// The account only adds its balance to the event, so a payment of a
+	// removed account can still be saved.
+	account, _ := s.FindAccountByID(payment.AccountID)
+
 	favorite := &types.Favorite{
 		ID:        uuid.New().String(),
 		AccountID: payment.AccountID,
@@ -171,7 +309,13 @@ func (s *Service) FavoritePayment(paymentID string, name string) (*types.Favorit
 		Amount:    payment.Amount,
 		Category:  payment.Category,
 	}
-	s.favorites = append(s.favorites, favorite)
+	err = s.emit(favoriteEvent(EventFavoriteCreated, account, favorite), func() {
+		s.favorites = append(s.favorites, favorite)
+		s.touchFavorite(favorite.ID)
+	})
+	if err != nil {
+		return nil, err
+	}
 	return favorite, nil
 }
 
@@ -202,6 +346,10 @@ func (s *Service) getAccounts() []*types.Account {
 }
 
 func (s *Service) ExportToFile(path string) error {
+	return s.exportToFile(context.Background(), path)
+}
+
+func (s *Service) exportToFile(ctx context.Context, path string) error {
 	file, err := os.Create(path)
 	if err != nil {
 		log.Print(err)
@@ -213,112 +361,111 @@ func (s *Service) ExportToFile(path string) error {
 		}
 	}()
 
+	err = s.exportLegacy(newContextWriter(ctx, file))
+	if err != nil {
+		log.Print(err)
+	}
+	return err
+}
+
+func (s *Service) exportLegacy(w io.Writer) error {
+	writer := bufio.NewWriter(w)
 	for _, account := range s.getAccounts() {
 		ID := strconv.FormatInt(account.ID, 10) + ";"
 		phone := string(account.Phone) + ";"
 		balance := strconv.FormatInt(int64(account.Balance), 10)
-		_, err = file.Write([]byte(ID + phone + balance + "|"))
+		_, err := writer.WriteString(ID + phone + balance + "|")
 		if err != nil {
-			log.Print(err)
 			return err
 		}
 	}
-	return nil
+	return writer.Flush()
 }
 
 func (s *Service) ImportFromFile(path string) error {
+	_, err := s.ImportFromFileWithOptions(path, ImportOptions{})
+	return err
+}
+
+func (s *Service) ImportFromFileWithOptions(path string, options ImportOptions) (*ImportReport, error) {
+	return s.importFromFile(context.Background(), path, options)
+}
+
+func (s *Service) importFromFile(ctx context.Context, path string, options ImportOptions) (*ImportReport, error) {
+	report := &ImportReport{DryRun: options.DryRun}
 
 	file, err := os.Open(path)
 	if err != nil {
 		log.Print(err)
-		return err
+		return report, err
 	}
 	defer func() {
 		if closeErr := file.Close(); closeErr != nil {
 			log.Print(closeErr)
 		}
 	}()
+	return s.importLegacyFrom(ctx, file, filepath.Base(path), options)
+}
 
-	content := make([]byte, 0)
-	buff := make([]byte, 4)
+func (s *Service) importLegacyFrom(ctx context.Context, r io.Reader, name string, options ImportOptions) (*ImportReport, error) {
+	report := &ImportReport{DryRun: options.DryRun}
+	batch := s.newImportBatch(ctx, options)
+	defer batch.rollback()
+	err := importLegacy(newContextReader(ctx, r), name, options.Policy, batch, report)
+	if err == nil {
+		err = batch.commit()
+	}
+	if err != nil {
+		log.Print(err)
+	}
+	return report, err
+}
 
-	for {
-		read, err := file.Read(buff)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			log.Print(err)
+// importLegacy merges the accounts of an ExportToFile file into batch. Empty
+// segments, such as a trailing newline after the last "|", are ignored.
+func importLegacy(r io.Reader, name string, policy ImportPolicy, batch *importBatch, report *ImportReport) error {
+	reader := bufio.NewReader(r)
+	for number := 1; ; number++ {
+		line, err := reader.ReadString('|')
+		if err != nil && err != io.EOF {
 			return err
 		}
-		content = append(content, buff[:read]...)
-	}
-	str := string(content)
-	for _, line := range strings.Split(str, "|") {
-		if len(line) <= 0 {
-			return err
+		line = strings.TrimSpace(strings.TrimSuffix(line, "|"))
+		if line != "" {
+			account, parseErr := parseAccount(strings.Split(line, ";"))
+			if parseErr == nil {
+				parseErr = batch.addAccount(account, report)
+			}
+			if parseErr != nil {
+				if parseErr = report.record(policy, &ImportError{File: name, Line: number, Err: parseErr}); parseErr != nil {
+					return parseErr
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
 		}
-
-		item := strings.Split(line, ";")
-		ID, _ := strconv.ParseInt(item[0], 10, 64)
-		balance, _ := strconv.ParseInt(item[2], 10, 64)
-
-		s.accounts = append(s.accounts, &types.Account{
-			ID:      ID,
-			Phone:   types.Phone(item[1]),
-			Balance: types.Money(balance),
-		})
 	}
-
-	return err
 }
 
 func (s *Service) Export(dir string) error {
-	log.Print("start exporting accounts entity, count of account: ", len(s.accounts))
-	accExp := 0
-	for _, account := range s.accounts {
-		ID := strconv.FormatInt(account.ID, 10) + ";"
-		phone := string(account.Phone) + ";"
-		balance := strconv.FormatInt(int64(account.Balance), 10)
-		err := WriteToFile(dir+"/accounts.dump", []byte(ID+phone+balance+"\n"))
-		if err != nil {
-			return err
-		}
-		accExp++
-	}
-	log.Print("end of exporting accounts entity, amount of exported acc: ", accExp)
+	return s.export(context.Background(), dir)
+}
 
-	log.Print("start exporting payments entity, count of payments: ", len(s.payments))
-	payExp := 0
-	for _, payment := range s.payments {
-		ID := payment.ID + ";"
-		AccountID := strconv.FormatInt(payment.AccountID, 10) + ";"
-		Amount := strconv.FormatInt(int64(payment.Amount), 10) + ";"
-		Category := string(payment.Category) + ";"
-		Status := string(payment.Status) + "\n"
-		err := WriteToFile(dir+"/payments.dump", []byte(ID+AccountID+Amount+Category+Status))
-		if err != nil {
-			return err
-		}
-		payExp++
+func (s *Service) export(ctx context.Context, dir string) error {
+	dumps := s.snapshotDumps()
+	log.Print("start exporting snapshot, accounts: ", len(dumps[0].records),
+		", payments: ", len(dumps[1].records), ", favorites: ", len(dumps[2].records))
+	created := s.clock()
+	files, err := writeDumpFiles(ctx, dir, created, dumps)
+	if err == nil {
+		err = writeManifest(dir, dumpManifestName, DumpManifest{Version: DumpVersion, Created: created.UTC(), Files: files})
 	}
-	log.Print("end of exporting payments entity, amount of exported pay: ", payExp)
-
-	log.Print("start exporting favorites entity, count of favorites: ", len(s.favorites))
-	favExp := 0
-	for _, favorite := range s.favorites {
-		ID := favorite.ID + ";"
-		AccountID := strconv.FormatInt(favorite.AccountID, 10) + ";"
-		Name := favorite.Name + ";"
-		Amount := strconv.FormatInt(int64(favorite.Amount), 10) + ";"
-		Category := string(favorite.Category) + "\n"
-		err := WriteToFile(dir+"/favorites.dump", []byte(ID+AccountID+Name+Amount+Category))
-		favExp++
-		if err != nil {
-			return err
-		}
+	if err != nil {
+		log.Print(err)
+		return err
 	}
-	log.Print("end of exporting favorites entity, amount of exported fav: ", favExp)
+	log.Print("end of exporting snapshot to ", dir)
 	return nil
 }
 
@@ -350,129 +497,6 @@ func WriteToFile(fileName string, data []byte) error {
 	return nil
 }
 
-func (s *Service) Import(dir string) error {
-	log.Print("account count in the start of import method: ", len(s.accounts))
-	log.Print("Start Import method with param: " + dir)
-	files, err := ioutil.ReadDir(dir)
-	if err != nil {
-		log.Print(err)
-		return err
-	}
-	for _, file := range files {
-		log.Print("files in Import->dir: " + file.Name())
-		read, err := os.Open(dir + "/" + file.Name())
-		if err != nil {
-			log.Print(err)
-			return err
-		}
-		defer func() {
-			if closeErr := read.Close(); closeErr != nil {
-				log.Print(closeErr)
-			}
-		}()
-
-		reader := bufio.NewReader(read)
-
-		for {
-			line, err := reader.ReadString('\n')
-			if err == io.EOF {
-				log.Print("line in OEF: ", line)
-				break
-			}
-			if err != nil {
-				log.Print(err)
-				return err
-			}
-
-			item := strings.Split(line, ";")
-			switch file.Name() {
-			case "accounts.dump":
-				acc := s.convertToAccount(item)
-				if acc != nil {
-					s.accounts = append(s.accounts, acc)
-				}
-			case "favorites.dump":
-				favorite := s.convertToFavorites(item)
-				if favorite != nil {
-					s.favorites = append(s.favorites, favorite)
-				}
-			case "payments.dump":
-				payment := s.convertToPayments(item)
-				if payment != nil {
-					s.payments = append(s.payments, payment)
-				}
-			default:
-				break
-			}
-		}
-
-	}
-	log.Print("account count in the end of import method: ", len(s.accounts))
-	return nil
-}
-
-func (s *Service) convertToAccount(item []string) *types.Account {
-	ID, _ := strconv.ParseInt(item[0], 10, 64)
-	balance, _ := strconv.ParseInt(removeEndLine(item[2]), 10, 64)
-	account, err := s.FindAccountByID(ID)
-	if err != nil {
-		s.nextAccountID++
-		return &types.Account{
-			ID:      ID,
-			Phone:   types.Phone(item[1]),
-			Balance: types.Money(balance),
-		}
-	}
-	account.ID = ID
-	account.Phone = types.Phone(item[1])
-	account.Balance = types.Money(balance)
-	return nil
-}
-
-func (s *Service) convertToFavorites(item []string) *types.Favorite {
-	AccountID, _ := strconv.ParseInt(item[1], 10, 64)
-	Amount, _ := strconv.ParseInt(item[3], 10, 64)
-
-	favorite, err := s.FindFavoriteByID(item[0])
-	if err != nil {
-		return &types.Favorite{
-			ID:        item[0],
-			AccountID: AccountID,
-			Name:      item[2],
-			Amount:    types.Money(Amount),
-			Category:  types.PaymentCategory(item[4]),
-		}
-	}
-	favorite.ID = item[0]
-	favorite.AccountID = AccountID
-	favorite.Name = item[2]
-	favorite.Amount = types.Money(Amount)
-	favorite.Category = types.PaymentCategory(removeEndLine(item[4]))
-	return nil
-}
-
-func (s *Service) convertToPayments(item []string) *types.Payment {
-	AccountID, _ := strconv.ParseInt(item[1], 10, 64)
-	Amount, _ := strconv.ParseInt(item[2], 10, 64)
-
-	payment, err := s.FindPaymentByID(item[0])
-	if err != nil {
-		return &types.Payment{
-			ID:        item[0],
-			AccountID: AccountID,
-			Amount:    types.Money(Amount),
-			Category:  types.PaymentCategory(item[3]),
-			Status:    types.PaymentStatus(removeEndLine(item[4])),
-		}
-	}
-	payment.ID = item[0]
-	payment.AccountID = AccountID
-	payment.Amount = types.Money(Amount)
-	payment.Category = types.PaymentCategory(item[3])
-	payment.Status = types.PaymentStatus(item[4])
-	return nil
-}
-
 func removeEndLine(balance string) string {
 	return strings.TrimRightFunc(balance, func(c rune) bool {
 		return c == '\r' || c == '\n'
@@ -492,258 +516,39 @@ func (s *Service) ExportAccountHistory(accountID int64) ([]types.Payment, error)
 	return payments, nil
 }
 
-func (s *Service) HistoryToFiles(payments []types.Payment, dir string, records int) error {
-	if len(payments) > 0 {
-		if len(payments) <= records {
-			file, _ := os.OpenFile(dir+"/payments.dump", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
-			defer file.Close()
-
-			var str string
-			for _, v := range payments {
-				str += fmt.Sprint(v.ID) + ";" + fmt.Sprint(v.AccountID) + ";" + fmt.Sprint(v.Amount) + ";" + fmt.Sprint(v.Category) + ";" + fmt.Sprint(v.Status) + "\n"
-			}
-			file.WriteString(str)
-		} else {
-
-			var str string
-			k := 0
-			t := 1
-			var file *os.File
-			for _, v := range payments {
-				if k == 0 {
-					file, _ = os.OpenFile(dir+"/payments"+fmt.Sprint(t)+".dump", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
-				}
-				k++
-				str = fmt.Sprint(v.ID) + ";" + fmt.Sprint(v.AccountID) + ";" + fmt.Sprint(v.Amount) + ";" + fmt.Sprint(v.Category) + ";" + fmt.Sprint(v.Status) + "\n"
-				_, _ = file.WriteString(str)
-				if k == records {
-					str = ""
-					t++
-					k = 0
-					file.Close()
-				}
-			}
-
-		}
-	}
-	return nil
-}
-
 func (s Service) SumPayments(goroutines int) types.Money {
-	wg := sync.WaitGroup{}
-	mu := sync.Mutex{}
-
-	i := 0
-	sum := int64(0)
-	count := len(s.payments) / goroutines
-
-	if goroutines == 0 {
-		count = len(s.payments)
-	}
-
-	for i = 0; i < goroutines-1; i++ {
-		wg.Add(1)
-		go func(index int) {
-			defer wg.Done()
-			val := int64(0)
-			payments := s.payments[index*count : (index+1)*count]
-			for _, payment := range payments {
-				val += int64(payment.Amount)
-			}
-			mu.Lock()
-			sum += val
-			mu.Unlock()
-
-		}(i)
-	}
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		val := int64(0)
-		payments := s.payments[i*count:]
-		for _, payment := range payments {
-			val += int64(payment.Amount)
-		}
-		mu.Lock()
-		sum += val
-		mu.Unlock()
-
-	}()
-	wg.Wait()
-	return types.Money(sum)
+	sum, _ := s.SumPaymentsWithOptions(context.Background(), QueryOptions{Workers: goroutines})
+	return sum
 }
 
 func (s *Service) FilterPayments(accountID int64, goroutines int) ([]types.Payment, error) {
-
 	account, err := s.FindAccountByID(accountID)
-
 	if err != nil {
 		return nil, err
 	}
 
-	wg := sync.WaitGroup{}
-	mu := sync.Mutex{}
-	count := len(s.payments) / goroutines
-	i := 0
-	var ps []types.Payment
-	if goroutines == 0 {
-		count = len(s.payments)
-	}
-
-	for i = 0; i < goroutines-1; i++ {
-		wg.Add(1)
-		go func(index int) {
-			defer wg.Done()
-			var pays []types.Payment
-			payments := s.payments[index*count : (index+1)*count]
-			for _, payment := range payments {
-				if payment.AccountID == account.ID {
-					pays = append(pays, types.Payment{
-						ID:        payment.ID,
-						AccountID: payment.AccountID,
-						Amount:    payment.Amount,
-						Category:  payment.Category,
-						Status:    payment.Status,
-					})
-				}
-			}
-			mu.Lock()
-			ps = append(ps, pays...)
-			mu.Unlock()
-
-		}(i)
-	}
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		var pays []types.Payment
-		payments := s.payments[i*count:]
-		for _, payment := range payments {
-			if payment.AccountID == account.ID {
-				pays = append(pays, types.Payment{
-					ID:        payment.ID,
-					AccountID: payment.AccountID,
-					Amount:    payment.Amount,
-					Category:  payment.Category,
-					Status:    payment.Status,
-				})
-			}
-		}
-		mu.Lock()
-		ps = append(ps, pays...)
-		mu.Unlock()
-
-	}()
-	wg.Wait()
-	if len(ps) == 0 {
-		return nil, nil
-	}
-	return ps, nil
+	return s.FilterPaymentsByFn(func(payment types.Payment) bool {
+		return payment.AccountID == account.ID
+	}, goroutines)
 }
 
 func (s *Service) FilterPaymentsByFn(filter func(payment types.Payment) bool, goroutines int) ([]types.Payment, error) {
-	wg := sync.WaitGroup{}
-	mu := sync.Mutex{}
-	i := 0
-	count := len(s.payments) / goroutines
-
-	var ps []types.Payment
-	if goroutines == 0 {
-		count = len(s.payments)
-	}
-
-	for i = 0; i < goroutines-1; i++ {
-		wg.Add(1)
-		go func(index int) {
-			defer wg.Done()
-			var pays []types.Payment
-			payments := s.payments[index*count : (index+1)*count]
-			for _, payment := range payments {
-				p := types.Payment{
-					ID:        payment.ID,
-					AccountID: payment.AccountID,
-					Amount:    payment.Amount,
-					Category:  payment.Category,
-					Status:    payment.Status,
-				}
-
-				if filter(p) {
-					pays = append(pays, p)
-				}
-			}
-			mu.Lock()
-			ps = append(ps, pays...)
-			mu.Unlock()
-
-		}(i)
-	}
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		var pays []types.Payment
-		payments := s.payments[i*count:]
-		for _, payment := range payments {
-
-			p := types.Payment{
-				ID:        payment.ID,
-				AccountID: payment.AccountID,
-				Amount:    payment.Amount,
-				Category:  payment.Category,
-				Status:    payment.Status,
-			}
-
-			if filter(p) {
-				pays = append(pays, p)
-			}
-		}
-		mu.Lock()
-		ps = append(ps, pays...)
-		mu.Unlock()
-
-	}()
-
-	wg.Wait()
-
-	if len(ps) == 0 {
-		return nil, nil
-	}
-
-	return ps, nil
+	return s.SelectPayments(context.Background(), QueryOptions{Workers: goroutines}, filter)
 }
 
+// SumPaymentsWithProgress sums the payments in parts and streams their
+// progress. The channel is closed once the sum is done. It has room for every
+// update, so the sum finishes even if the caller stops reading; use
+// SumPaymentsWithProgressContext to stop it early.
 func (s *Service) SumPaymentsWithProgress() <-chan types.Progress {
-	size := 100_0000
-
-	amountOfMoney := make([]types.Money, 0)
-	for _, pay := range s.payments {
-		amountOfMoney = append(amountOfMoney, pay.Amount)
-	}
-
-	wg := sync.WaitGroup{}
-	goroutines := (len(amountOfMoney) + 1) / size
-	ch := make(chan types.Progress)
-	if goroutines <= 0 {
-		goroutines = 1
+	options := QueryOptions{}
+	ch := make(chan types.Progress, options.updates(len(s.payments)))
+	options.Progress = func(progress types.Progress) {
+		ch <- progress
 	}
-	for i := 0; i < goroutines; i++ {
-		wg.Add(1)
-		go func(ch chan<- types.Progress, amountOfMoney []types.Money, part int) {
-			sum := 0
-			defer wg.Done()
-			for _, val := range amountOfMoney {
-				sum += int(val)
-
-			}
-			ch <- types.Progress{
-				Result: types.Money(sum),
-			}
-		}(ch, amountOfMoney, i)
-	}
-
 	go func() {
 		defer close(ch)
-		wg.Wait()
+		_, _ = s.SumPaymentsWithOptions(context.Background(), options)
 	}()
-
 	return ch
 }
@@ -517,6 +517,16 @@ func TestService_FavoritePayment_success(t *testing.T) {
 	}
 }
 
+func TestService_FavoritePayment_withoutAccount(t *testing.T) {
+	s := newTestService()
+	s.payments = append(s.payments, &types.Payment{ID: "p1", AccountID: 9, Amount: 10, Category: types.CategoryIt})
+
+	favorite, err := s.FavoritePayment("p1", "rent")
+	if err != nil || favorite.AccountID != 9 {
+		t.Errorf("FavoritePayment() got = %v, error = %v", favorite, err)
+	}
+}
+
 func TestService_FindFavoriteByID(t *testing.T) {
 	type fields struct {
 		nextAccountID int64
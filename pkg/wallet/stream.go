@@ -0,0 +1,90 @@
+package wallet
+
+import (
+	"context"
+	"github.com/bdaler/wallet/pkg/types"
+	"io"
+)
+
+// ExportTo writes accounts, payments and favorites to w as consecutive dump
+// sections. Records are encoded one at a time, so memory use does not depend
+// on the size of the dump.
+func (s *Service) ExportTo(w io.Writer) error {
+	return s.ExportToWithProgress(context.Background(), w, nil)
+}
+
+// ExportToWithProgress is ExportTo reporting a part per section: Processed
+// and Total count its records and Result is the amount of the payments
+// written so far. It stops with ctx.Err() once ctx is done.
+func (s *Service) ExportToWithProgress(ctx context.Context, w io.Writer, progress ProgressFunc) error {
+	writer := newDumpWriter(newContextWriter(ctx, w))
+	created := s.clock()
+	amount := types.Money(0)
+
+	sections := []struct {
+		entity string
+		count  int
+		record func(i int) []string
+	}{
+		{entityAccounts, len(s.accounts), func(i int) []string { return accountRecord(s.accounts[i]) }},
+		{entityPayments, len(s.payments), func(i int) []string {
+			amount += s.payments[i].Amount
+			return paymentRecord(s.payments[i])
+		}},
+		{entityFavorites, len(s.favorites), func(i int) []string { return favoriteRecord(s.favorites[i]) }},
+	}
+	for part, section := range sections {
+		err := writeDumpHeader(writer, section.entity, created, section.count)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < section.count; i++ {
+			if i%queryCheckEvery == 0 {
+				if err = ctx.Err(); err != nil {
+					return err
+				}
+			}
+			if err = writer.Write(section.record(i)); err != nil {
+				return err
+			}
+			if progress != nil && ((i+1)%progressEvery == 0 || i+1 == section.count) {
+				progress(types.Progress{Part: part, Processed: i + 1, Total: section.count, Result: amount})
+			}
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// ImportFrom reads the dump sections written by ExportTo. Records are merged
+// one at a time as they are read, and the whole import is rolled back if any
+// of them fails, so the memory used beyond the imported records themselves is
+// an index of their IDs.
+func (s *Service) ImportFrom(r io.Reader) error {
+	_, err := s.ImportFromWithOptions(r, ImportOptions{})
+	return err
+}
+
+func (s *Service) ImportFromWithOptions(r io.Reader, options ImportOptions) (*ImportReport, error) {
+	return s.ImportFromWithProgress(context.Background(), r, options)
+}
+
+// ImportFromWithProgress is ImportFromWithOptions reporting to
+// options.Progress. Once ctx is done it stops with ctx.Err() and merges
+// nothing.
+func (s *Service) ImportFromWithProgress(ctx context.Context, r io.Reader, options ImportOptions) (*ImportReport, error) {
+	report := &ImportReport{DryRun: options.DryRun}
+	batch := s.newImportBatch(ctx, options)
+	defer batch.rollback()
+
+	_, err := readDump(r, "stream", "", options.Policy, batch, report)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return report, contextErr(ctx, err)
+	}
+
+	return report, batch.commit()
+}
@@ -0,0 +1,88 @@
+package wallet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"github.com/bdaler/wallet/pkg/types"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestService_ExportTo_gzip(t *testing.T) {
+	s := newTestService()
+	account, _ := s.AddAccountWithBalance("9127660305", 100)
+	payment, _ := s.Pay(account.ID, 10, types.CategoryIt)
+	_, _ = s.FavoritePayment(payment.ID, "internet; home")
+
+	buf := bytes.Buffer{}
+	writer := gzip.NewWriter(&buf)
+	if err := s.ExportTo(writer); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := newTestService()
+	if err = i.ImportFrom(reader); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(s.accounts, i.accounts) ||
+		!reflect.DeepEqual(s.payments, i.payments) ||
+		!reflect.DeepEqual(s.favorites, i.favorites) {
+		t.Error("imported and exported entities doesn't match")
+	}
+}
+
+func TestService_ImportFrom_missingHeader(t *testing.T) {
+	s := newTestService()
+	err := s.ImportFrom(strings.NewReader("1;9127660305;10\n"))
+	if !errors.Is(err, ErrMissingDumpHeader) {
+		t.Errorf("ImportFrom() error = %v, want %v", err, ErrMissingDumpHeader)
+	}
+}
+
+func TestService_ImportFrom_rollback(t *testing.T) {
+	const dump = "#wallet-dump;version=2;entity=accounts;records=2;created=2020-11-01T00:00:00Z\n" +
+		"1;9127660305;500\n2;9127660306;20\n" +
+		"#wallet-dump;version=2;entity=payments;records=1;created=2020-11-01T00:00:00Z\n" +
+		"e1dceb29-6cc4-48c5-acd4-455530f9d50a;9;1;it;OK\n"
+
+	s := newTestService()
+	account, _ := s.AddAccountWithBalance("9127660305", 10)
+	if err := s.ImportFrom(strings.NewReader(dump)); !errors.Is(err, ErrInvalidRecord) {
+		t.Fatalf("ImportFrom() error = %v, want %v", err, ErrInvalidRecord)
+	}
+	if len(s.accounts) != 1 || account.Balance != 10 {
+		t.Errorf("ImportFrom() left accounts = %v", s.accounts)
+	}
+	if registered, _ := s.RegisterAccount("9127660307"); registered.ID != 2 {
+		t.Errorf("RegisterAccount() after a failed import got ID %d, want 2", registered.ID)
+	}
+}
+
+func TestService_ImportFrom_longQuotedValue(t *testing.T) {
+	s := newTestService()
+	account, _ := s.AddAccountWithBalance("9127660305", 100)
+	payment, _ := s.Pay(account.ID, 10, types.CategoryIt)
+	_, _ = s.FavoritePayment(payment.ID, strings.Repeat("\"line\"\n", 50_000))
+
+	buf := bytes.Buffer{}
+	if err := s.ExportTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	i := newTestService()
+	if err := i.ImportFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.favorites, i.favorites) {
+		t.Error("imported favorite doesn't match")
+	}
+}
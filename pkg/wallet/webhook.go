@@ -0,0 +1,246 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	WebhookSignatureHeader = "X-Wallet-Signature"
+	WebhookTimestampHeader = "X-Wallet-Timestamp"
+	WebhookEventHeader     = "X-Wallet-Event"
+	WebhookDeliveryHeader  = "X-Wallet-Delivery"
+)
+
+const (
+	defaultWebhookAttempts  = 8
+	defaultWebhookBaseDelay = time.Second
+	defaultWebhookMaxDelay  = time.Hour
+	defaultWebhookTimeout   = 10 * time.Second
+)
+
+// WebhookDispatcher delivers the outbox to URL. The zero values of the
+// optional fields select the defaults: 8 attempts, retries after 1s, 2s, 4s,
+// ... up to an hour, and an HTTP client with a 10 second timeout.
+type WebhookDispatcher struct {
+	Outbox OutboxStore
+	URL    string
+	// Secret signs every request, see SignWebhook.
+	Secret []byte
+
+	Client      *http.Client
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+
+	now func() time.Time
+}
+
+type DispatchReport struct {
+	Delivered int
+	Failed    int
+	Dead      int
+}
+
+func (d *WebhookDispatcher) clock() time.Time {
+	if d.now == nil {
+		return time.Now()
+	}
+	return d.now()
+}
+
+func (d *WebhookDispatcher) client() *http.Client {
+	if d.Client == nil {
+		return &http.Client{Timeout: defaultWebhookTimeout}
+	}
+	return d.Client
+}
+
+func (d *WebhookDispatcher) maxAttempts() int {
+	if d.MaxAttempts <= 0 {
+		return defaultWebhookAttempts
+	}
+	return d.MaxAttempts
+}
+
+// backoff returns the delay before the attempt after attempts failed ones.
+func (d *WebhookDispatcher) backoff(attempts int) time.Duration {
+	delay, limit := d.BaseDelay, d.MaxDelay
+	if delay <= 0 {
+		delay = defaultWebhookBaseDelay
+	}
+	if limit <= 0 {
+		limit = defaultWebhookMaxDelay
+	}
+	for i := 1; i < attempts && delay < limit; i++ {
+		delay *= 2
+	}
+	if delay > limit {
+		delay = limit
+	}
+	return delay
+}
+
+// Dispatch makes one delivery attempt for every pending entry that is due.
+// Messages of a payment are delivered in order: while one waits for a retry,
+// the later ones wait too, and after one is dead they wait until it is
+// replayed.
+func (d *WebhookDispatcher) Dispatch(ctx context.Context) (*DispatchReport, error) {
+	report := &DispatchReport{}
+	entries, err := d.Outbox.Entries()
+	if err != nil {
+		return report, err
+	}
+
+	now := d.clock()
+	waiting := make(map[string]bool)
+	for _, entry := range entries {
+		paymentID := entry.Message.Payment.ID
+		if entry.Status == DeliveryDead {
+			waiting[paymentID] = true
+		}
+		if entry.Status != DeliveryPending {
+			continue
+		}
+		if waiting[paymentID] || entry.NextAttempt.After(now) {
+			waiting[paymentID] = true
+			continue
+		}
+		if err = ctx.Err(); err != nil {
+			return report, err
+		}
+
+		entry.Attempts++
+		deliveryErr := d.deliver(ctx, entry.Message)
+		switch {
+		case deliveryErr == nil:
+			entry.Status = DeliveryDelivered
+			entry.LastError = ""
+			report.Delivered++
+		case entry.Attempts >= d.maxAttempts():
+			entry.Status = DeliveryDead
+			entry.LastError = deliveryErr.Error()
+			waiting[paymentID] = true
+			report.Dead++
+		default:
+			entry.NextAttempt = now.Add(d.backoff(entry.Attempts))
+			entry.LastError = deliveryErr.Error()
+			waiting[paymentID] = true
+			report.Failed++
+		}
+		if err = d.Outbox.Update(entry); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// Run dispatches every interval until ctx is done.
+func (d *WebhookDispatcher) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := d.Dispatch(ctx); err != nil && ctx.Err() == nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *WebhookDispatcher) deliver(ctx context.Context, message OutboxMessage) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	timestamp := strconv.FormatInt(d.clock().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WebhookEventHeader, string(message.Type))
+	request.Header.Set(WebhookDeliveryHeader, message.ID)
+	request.Header.Set(WebhookTimestampHeader, timestamp)
+	request.Header.Set(WebhookSignatureHeader, SignWebhook(d.Secret, timestamp, body))
+
+	response, err := d.client().Do(request)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, response.Body)
+		_ = response.Body.Close()
+	}()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook responded %s", response.Status)
+	}
+	return nil
+}
+
+// DeadLetters returns the entries that ran out of attempts.
+func (d *WebhookDispatcher) DeadLetters() ([]OutboxEntry, error) {
+	entries, err := d.Outbox.Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	var dead []OutboxEntry
+	for _, entry := range entries {
+		if entry.Status == DeliveryDead {
+			dead = append(dead, entry)
+		}
+	}
+	return dead, nil
+}
+
+// Replay queues the entry with messageID again with fresh attempts, whether
+// it is dead or was already delivered. Replaying a dead entry releases the
+// later messages of its payment.
+func (d *WebhookDispatcher) Replay(messageID string) error {
+	entries, err := d.Outbox.Entries()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.Message.ID == messageID {
+			entry.Status = DeliveryPending
+			entry.Attempts = 0
+			entry.NextAttempt = d.clock()
+			entry.LastError = ""
+			return d.Outbox.Update(entry)
+		}
+	}
+	return ErrOutboxEntryNotFound
+}
+
+// SignWebhook returns the signature header value for a request: the hex
+// HMAC-SHA256 of timestamp, a dot and body, keyed with secret.
+func SignWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook checks a signature made by SignWebhook in constant time.
+func VerifyWebhook(secret []byte, timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(SignWebhook(secret, timestamp, body)), []byte(signature))
+}
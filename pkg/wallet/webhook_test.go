@@ -0,0 +1,132 @@
+package wallet
+
+import (
+	"context"
+	"github.com/bdaler/wallet/pkg/types"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type webhookReceiver struct {
+	mu       sync.Mutex
+	failures int
+	received []string
+	invalid  int
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	body, _ := ioutil.ReadAll(request.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	signature := request.Header.Get(WebhookSignatureHeader)
+	if !VerifyWebhook([]byte("secret"), request.Header.Get(WebhookTimestampHeader), body, signature) {
+		r.invalid++
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.failures > 0 {
+		r.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	r.received = append(r.received, request.Header.Get(WebhookEventHeader))
+}
+
+func newWebhookTest(t *testing.T, failures int) (*Service, *WebhookDispatcher, *webhookReceiver, *time.Time) {
+	receiver := &webhookReceiver{failures: failures}
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+
+	now := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	s := newTestService()
+	s.now = func() time.Time { return now }
+	outbox := &MemoryOutbox{}
+	_ = s.SetOutbox(outbox)
+
+	dispatcher := &WebhookDispatcher{
+		Outbox:      outbox,
+		URL:         server.URL,
+		Secret:      []byte("secret"),
+		MaxAttempts: 3,
+		now:         func() time.Time { return now },
+	}
+	return s.Service, dispatcher, receiver, &now
+}
+
+func TestWebhookDispatcher_Dispatch(t *testing.T) {
+	s, dispatcher, receiver, now := newWebhookTest(t, 1)
+	account, _ := s.AddAccountWithBalance("9127660305", 100)
+	payment, _ := s.Pay(account.ID, 10, types.CategoryIt)
+	_ = s.Complete(payment.ID)
+
+	report, err := dispatcher.Dispatch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Failed != 1 || report.Delivered != 0 {
+		t.Errorf("Dispatch() report = %+v, want the first message to fail and the second to wait", report)
+	}
+
+	entries, _ := dispatcher.Outbox.Entries()
+	if entries[0].Attempts != 1 || !entries[0].NextAttempt.Equal(now.Add(time.Second)) || entries[0].LastError == "" {
+		t.Errorf("Dispatch() did not schedule a retry: %+v", entries[0])
+	}
+
+	*now = now.Add(time.Second)
+	report, _ = dispatcher.Dispatch(context.Background())
+	if report.Delivered != 2 {
+		t.Errorf("Dispatch() retry report = %+v", report)
+	}
+	want := []string{string(EventPaymentCreated), string(EventPaymentCompleted)}
+	if len(receiver.received) != 2 || receiver.received[0] != want[0] || receiver.received[1] != want[1] || receiver.invalid != 0 {
+		t.Errorf("receiver got %v, %d invalid signatures", receiver.received, receiver.invalid)
+	}
+}
+
+func TestWebhookDispatcher_deadLetter(t *testing.T) {
+	s, dispatcher, receiver, now := newWebhookTest(t, 3)
+	account, _ := s.AddAccountWithBalance("9127660305", 100)
+	payment, _ := s.Pay(account.ID, 10, types.CategoryIt)
+	_ = s.Complete(payment.ID)
+
+	for i, delay := range []time.Duration{0, time.Second, 2 * time.Second} {
+		*now = now.Add(delay)
+		if _, err := dispatcher.Dispatch(context.Background()); err != nil {
+			t.Fatalf("Dispatch() attempt %d error = %v", i+1, err)
+		}
+	}
+
+	dead, _ := dispatcher.DeadLetters()
+	if len(dead) != 1 || dead[0].Attempts != 3 {
+		t.Fatalf("DeadLetters() got = %+v", dead)
+	}
+	if report, _ := dispatcher.Dispatch(context.Background()); report.Delivered != 0 || len(receiver.received) != 0 {
+		t.Errorf("Dispatch() delivered past a dead message: %+v, %v", report, receiver.received)
+	}
+
+	if err := dispatcher.Replay(dead[0].Message.ID); err != nil {
+		t.Fatal(err)
+	}
+	report, _ := dispatcher.Dispatch(context.Background())
+	want := []string{string(EventPaymentCreated), string(EventPaymentCompleted)}
+	if report.Delivered != 2 || len(receiver.received) != 2 || receiver.received[0] != want[0] || receiver.received[1] != want[1] {
+		t.Errorf("Dispatch() after Replay() report = %+v, received = %v", report, receiver.received)
+	}
+	if err := dispatcher.Replay("unknown"); err != ErrOutboxEntryNotFound {
+		t.Errorf("Replay() error = %v, want %v", err, ErrOutboxEntryNotFound)
+	}
+}
+
+func TestWebhookDispatcher_backoff(t *testing.T) {
+	dispatcher := &WebhookDispatcher{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	for attempts, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 30: 5 * time.Second} {
+		if got := dispatcher.backoff(attempts); got != want {
+			t.Errorf("backoff(%d) got = %v, want %v", attempts, got, want)
+		}
+	}
+}